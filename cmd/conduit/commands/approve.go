@@ -0,0 +1,131 @@
+package commands
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/ehazlett/conduit/types"
+	"github.com/spf13/cobra"
+)
+
+var (
+	conduitURL   string
+	rejectReason string
+)
+
+func init() {
+	for _, c := range []*cobra.Command{approvalsCmd, approveCmd, rejectCmd} {
+		c.Flags().StringVar(&conduitURL, "url", "http://localhost:8080", "Conduit URL")
+		RootCmd.AddCommand(c)
+	}
+	rejectCmd.Flags().StringVar(&rejectReason, "reason", "", "Reason the deploy was rejected")
+}
+
+// apiRequest sends a request to the conduit api and decodes the response
+func apiRequest(method, path string, body interface{}, v interface{}) error {
+	sep := "?"
+	if strings.Contains(path, "?") {
+		sep = "&"
+	}
+	u := fmt.Sprintf("%s%s%s%s", strings.TrimSuffix(conduitURL, "/"), path, sep, url.Values{"token": {token}}.Encode())
+
+	var buf bytes.Buffer
+	if body != nil {
+		if err := json.NewEncoder(&buf).Encode(body); err != nil {
+			return err
+		}
+	}
+
+	req, err := http.NewRequest(method, u, &buf)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	client := &http.Client{
+		Timeout: time.Second * 30,
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		b, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(b)))
+	}
+
+	if v == nil {
+		return nil
+	}
+
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+var approvalsCmd = &cobra.Command{
+	Use:   "approvals",
+	Short: "List pending approvals",
+	Long:  "List deploys waiting for approval.",
+	Run: func(cmd *cobra.Command, args []string) {
+		var approvals []types.Approval
+		if err := apiRequest("GET", "/approvals", nil, &approvals); err != nil {
+			logrus.Fatal(err)
+		}
+
+		w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+		fmt.Fprintln(w, "ID\tREPOSITORY\tTAG\tCREATED\tEXPIRES")
+		for _, a := range approvals {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", a.ID, a.Repository, a.Tag, a.Created.Format(time.RFC3339), a.Expires.Format(time.RFC3339))
+		}
+		w.Flush()
+	},
+}
+
+var approveCmd = &cobra.Command{
+	Use:   "approve <id>",
+	Short: "Approve a pending deploy",
+	Long:  "Approve a pending deploy so it is queued to run.",
+	Run: func(cmd *cobra.Command, args []string) {
+		if len(args) != 1 {
+			cmd.Help()
+			logrus.Fatal("you must specify an approval id")
+		}
+
+		var a types.Approval
+		if err := apiRequest("POST", "/approvals/"+args[0]+"/approve", nil, &a); err != nil {
+			logrus.Fatal(err)
+		}
+
+		fmt.Printf("approved deploy %s of %s\n", a.ID, a.Repository)
+	},
+}
+
+var rejectCmd = &cobra.Command{
+	Use:   "reject <id>",
+	Short: "Reject a pending deploy",
+	Long:  "Reject a pending deploy so it is discarded.",
+	Run: func(cmd *cobra.Command, args []string) {
+		if len(args) != 1 {
+			cmd.Help()
+			logrus.Fatal("you must specify an approval id")
+		}
+
+		var a types.Approval
+		body := map[string]string{"reason": rejectReason}
+		if err := apiRequest("POST", "/approvals/"+args[0]+"/reject", body, &a); err != nil {
+			logrus.Fatal(err)
+		}
+
+		fmt.Printf("rejected deploy %s of %s\n", a.ID, a.Repository)
+	},
+}
@@ -1,17 +1,45 @@
 package commands
 
 import (
+	"time"
+
 	"github.com/Sirupsen/logrus"
+	"github.com/docker/go-units"
 	"github.com/ehazlett/conduit/handler"
 	"github.com/spf13/cobra"
 )
 
 var (
-	debug        bool
-	repositories []string
-	listenAddr   string
-	dockerURL    string
-	token        string
+	debug           bool
+	repositories    []string
+	listenAddr      string
+	dockerURL       string
+	token           string
+	tags            []string
+	labelEnable     bool
+	strategy        string
+	healthTimeout   time.Duration
+	stopTimeout     time.Duration
+	deployTimeout   time.Duration
+	keepVolumes     bool
+	keepPrevious    int
+	imageCleanup    bool
+	keepImages      int
+	pruneInterval   time.Duration
+	pruneDryRun     bool
+	preflight       bool
+	minFreeSpace    string
+	pullConcurrency int
+	enginePulls     int
+	configPath      string
+	callbackTimeout time.Duration
+	callbackRetries int
+	stateDir        string
+	shutdownTimeout time.Duration
+	dryRun          bool
+	externalURL     string
+	manifestPath    string
+	reconcileEvery  time.Duration
 )
 
 func init() {
@@ -21,6 +49,31 @@ func init() {
 	RootCmd.PersistentFlags().StringSliceVarP(&repositories, "repository", "r", []string{}, "Enable deployment for Docker repository (i.e. ehazlett/conduit)")
 	RootCmd.PersistentFlags().StringVar(&dockerURL, "docker", "unix:///run/docker.sock", "Docker Engine URL")
 	RootCmd.PersistentFlags().StringVarP(&token, "token", "t", "", "Token for hooks")
+	RootCmd.PersistentFlags().DurationVar(&callbackTimeout, "callback-timeout", time.Second*10, "Timeout for webhook callback requests")
+	RootCmd.PersistentFlags().IntVar(&callbackRetries, "callback-retries", 5, "Number of times to retry a failed webhook callback")
+	RootCmd.PersistentFlags().StringVar(&stateDir, "state-dir", "/var/lib/conduit", "Directory for persisted state")
+	RootCmd.PersistentFlags().DurationVar(&shutdownTimeout, "shutdown-timeout", time.Minute*5, "Time to wait for a running deploy when shutting down")
+	RootCmd.PersistentFlags().BoolVar(&dryRun, "dry-run", false, "Report what would be deployed without changing containers")
+	RootCmd.PersistentFlags().StringVar(&externalURL, "external-url", "", "URL conduit is reachable at for links in notifications")
+	RootCmd.PersistentFlags().StringVarP(&configPath, "config", "c", "", "Path to configuration file")
+	RootCmd.PersistentFlags().StringVar(&manifestPath, "manifest", "", "Path to a manifest of services to reconcile the engines to")
+	RootCmd.PersistentFlags().DurationVar(&reconcileEvery, "reconcile-interval", time.Minute, "Interval to reconcile the engines to the manifest (0 to only reconcile on start)")
+	RootCmd.PersistentFlags().StringSliceVar(&tags, "tag", []string{}, "Only deploy containers using the specified image tag")
+	RootCmd.PersistentFlags().BoolVar(&labelEnable, "label-enable", false, "Only deploy containers labeled conduit.enable=true")
+	RootCmd.PersistentFlags().StringVar(&strategy, "strategy", handler.StrategyAuto, "Rotation strategy (auto, stop-first, start-first)")
+	RootCmd.PersistentFlags().DurationVar(&healthTimeout, "health-timeout", 0, "Time to wait for new containers to become healthy (0 to disable)")
+	RootCmd.PersistentFlags().DurationVar(&stopTimeout, "stop-timeout", time.Second*5, "Time to wait for old containers to stop before killing when they do not set a stop timeout")
+	RootCmd.PersistentFlags().DurationVar(&deployTimeout, "deploy-timeout", 0, "Deadline of a deploy after which it is aborted and rolled back (0 for none)")
+	RootCmd.PersistentFlags().BoolVar(&keepVolumes, "keep-volumes", false, "Keep the volumes of removed containers")
+	RootCmd.PersistentFlags().BoolVar(&imageCleanup, "image-cleanup", false, "Remove unused images of a repository after it is deployed")
+	RootCmd.PersistentFlags().IntVar(&keepImages, "keep-images", 2, "Number of unused images of each repository to keep for rollback")
+	RootCmd.PersistentFlags().DurationVar(&pruneInterval, "prune-interval", 0, "Interval to prune unused images of all repositories (0 to disable)")
+	RootCmd.PersistentFlags().BoolVar(&pruneDryRun, "prune-dry-run", false, "Only report the images the periodic prune would remove")
+	RootCmd.PersistentFlags().BoolVar(&preflight, "preflight", false, "Check engine disk space and memory before rotating containers")
+	RootCmd.PersistentFlags().StringVar(&minFreeSpace, "min-free-space", "1g", "Disk space that must remain free after pulling images")
+	RootCmd.PersistentFlags().IntVar(&pullConcurrency, "pull-concurrency", 4, "Number of images pulled at once across all engines")
+	RootCmd.PersistentFlags().IntVar(&enginePulls, "engine-pull-concurrency", 1, "Number of images pulled at once on a single engine")
+	RootCmd.PersistentFlags().IntVar(&keepPrevious, "keep-previous", 0, "Number of previous containers of each service to keep stopped for rollback")
 }
 
 var RootCmd = &cobra.Command{
@@ -33,15 +86,57 @@ var RootCmd = &cobra.Command{
 		}
 	},
 	Run: func(cmd *cobra.Command, args []string) {
-		if len(repositories) == 0 {
+		if len(repositories) == 0 && manifestPath == "" {
 			cmd.Help()
-			logrus.Fatal("you must specify at least one repository")
+			logrus.Fatal("you must specify at least one repository or a manifest")
+		}
+
+		c, err := loadConfig(configPath)
+		if err != nil {
+			logrus.Fatalf("error loading config: %s", err)
+		}
+
+		manifest, err := loadManifest(manifestPath)
+		if err != nil {
+			logrus.Fatalf("error loading manifest: %s", err)
+		}
+
+		freeSpace, err := units.RAMInBytes(minFreeSpace)
+		if err != nil {
+			logrus.Fatalf("invalid min free space: %s", err)
 		}
 
 		cfg := &handler.HandlerConfig{
-			ListenAddr:   listenAddr,
-			Repositories: repositories,
-			Token:        token,
+			ListenAddr:            listenAddr,
+			Repositories:          repositories,
+			Token:                 token,
+			Tags:                  tags,
+			LabelEnable:           labelEnable,
+			Strategy:              strategy,
+			HealthTimeout:         healthTimeout,
+			StopTimeout:           stopTimeout,
+			DeployTimeout:         deployTimeout,
+			KeepVolumes:           keepVolumes,
+			KeepPrevious:          keepPrevious,
+			ImageCleanup:          imageCleanup,
+			KeepImages:            keepImages,
+			PruneInterval:         pruneInterval,
+			PruneDryRun:           pruneDryRun,
+			Preflight:             preflight,
+			MinFreeSpace:          freeSpace,
+			PullConcurrency:       pullConcurrency,
+			EnginePullConcurrency: enginePulls,
+			Notifiers:             c.Notifiers,
+			CallbackTimeout:       callbackTimeout,
+			CallbackRetries:       callbackRetries,
+			StateDir:              stateDir,
+			ShutdownTimeout:       shutdownTimeout,
+			DryRun:                dryRun,
+			RepositoryConfig:      c.Repositories,
+			ExternalURL:           externalURL,
+			Engines:               c.Engines,
+			Manifest:              manifest,
+			ReconcileInterval:     reconcileEvery,
 		}
 		h, err := handler.New(cfg)
 		if err != nil {
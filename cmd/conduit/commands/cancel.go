@@ -0,0 +1,31 @@
+package commands
+
+import (
+	"fmt"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+func init() {
+	cancelCmd.Flags().StringVar(&conduitURL, "url", "http://localhost:8080", "Conduit URL")
+	RootCmd.AddCommand(cancelCmd)
+}
+
+var cancelCmd = &cobra.Command{
+	Use:   "cancel <deployment>",
+	Short: "Cancel a running deploy",
+	Long:  "Abort the running deploy of a deployment and roll back the containers it replaced.",
+	Run: func(cmd *cobra.Command, args []string) {
+		if len(args) != 1 {
+			cmd.Help()
+			logrus.Fatal("you must specify a deployment")
+		}
+
+		if err := apiRequest("POST", "/deployments/"+args[0]+"/cancel", nil, nil); err != nil {
+			logrus.Fatal(err)
+		}
+
+		fmt.Printf("cancelling deployment %s\n", args[0])
+	},
+}
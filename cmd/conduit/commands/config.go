@@ -0,0 +1,47 @@
+package commands
+
+import (
+	"encoding/json"
+	"os"
+
+	"github.com/ehazlett/conduit/types"
+)
+
+func loadConfig(path string) (*types.Config, error) {
+	cfg := &types.Config{}
+	if path == "" {
+		return cfg, nil
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	if err := json.NewDecoder(f).Decode(cfg); err != nil {
+		return nil, err
+	}
+
+	return cfg, nil
+}
+
+// loadManifest returns the manifest at path or nil when path is empty
+func loadManifest(path string) (*types.Manifest, error) {
+	if path == "" {
+		return nil, nil
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	m := &types.Manifest{}
+	if err := json.NewDecoder(f).Decode(m); err != nil {
+		return nil, err
+	}
+
+	return m, nil
+}
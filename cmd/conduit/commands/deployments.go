@@ -0,0 +1,66 @@
+package commands
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/ehazlett/conduit/types"
+	"github.com/spf13/cobra"
+)
+
+var (
+	deploymentsRepository string
+)
+
+func init() {
+	deploymentsCmd.Flags().StringVar(&conduitURL, "url", "http://localhost:8080", "Conduit URL")
+	deploymentsCmd.Flags().StringVar(&deploymentsRepository, "repository", "", "Only show deployments of the repository")
+	RootCmd.AddCommand(deploymentsCmd)
+}
+
+// stageSummary formats the status of each promotion stage
+func stageSummary(d types.Deployment) string {
+	stages := []string{}
+	for _, s := range d.Stages {
+		group := s.Group
+		if group == "" {
+			group = "all"
+		}
+		status := s.Status
+		if !s.SoakUntil.IsZero() && d.Status == types.DeploymentSoaking {
+			status += " (soaking until " + s.SoakUntil.Format(time.RFC3339) + ")"
+		}
+		stages = append(stages, group+": "+status)
+	}
+
+	return strings.Join(stages, ", ")
+}
+
+var deploymentsCmd = &cobra.Command{
+	Use:   "deployments",
+	Short: "Show deployment history",
+	Long:  "Show recent deployments and the status of each promotion stage.",
+	Run: func(cmd *cobra.Command, args []string) {
+		path := "/deployments"
+		if deploymentsRepository != "" {
+			path += "?" + url.Values{"repository": {deploymentsRepository}}.Encode()
+		}
+
+		var deployments []types.Deployment
+		if err := apiRequest("GET", path, nil, &deployments); err != nil {
+			logrus.Fatal(err)
+		}
+
+		w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+		fmt.Fprintln(w, "ID\tREPOSITORY\tTAG\tSTATUS\tSTARTED\tSTAGES")
+		for _, d := range deployments {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\n", d.ID, d.Repository, d.Tag, d.Status, d.Started.Format(time.RFC3339), stageSummary(d))
+		}
+		w.Flush()
+	},
+}
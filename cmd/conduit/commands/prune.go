@@ -0,0 +1,56 @@
+package commands
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/ehazlett/conduit/types"
+	"github.com/spf13/cobra"
+)
+
+var (
+	pruneReportDryRun bool
+)
+
+func init() {
+	pruneCmd.Flags().StringVar(&conduitURL, "url", "http://localhost:8080", "Conduit URL")
+	pruneCmd.Flags().BoolVar(&pruneReportDryRun, "dry-run", false, "Only report the images that would be removed")
+	RootCmd.AddCommand(pruneCmd)
+}
+
+var pruneCmd = &cobra.Command{
+	Use:   "prune",
+	Short: "Prune unused images",
+	Long:  "Remove the images of the repositories that are no longer used by any container.",
+	Run: func(cmd *cobra.Command, args []string) {
+		path := "/images/prune"
+		if pruneReportDryRun {
+			path += "?dry_run=true"
+		}
+
+		var report types.PruneReport
+		if err := apiRequest("POST", path, nil, &report); err != nil {
+			logrus.Fatal(err)
+		}
+
+		w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+		fmt.Fprintln(w, "ENGINE\tIMAGE\tREFERENCES\tSIZE")
+		for _, img := range report.Images {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%d\n", img.Engine, img.ID, strings.Join(img.References, ", "), img.Size)
+		}
+		w.Flush()
+
+		for _, e := range report.Errors {
+			logrus.Error(e)
+		}
+
+		action := "reclaimed"
+		if report.DryRun {
+			action = "would reclaim"
+		}
+		fmt.Printf("%s %d bytes from %d image(s)\n", action, report.Reclaimed, len(report.Images))
+	},
+}
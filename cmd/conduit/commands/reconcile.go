@@ -0,0 +1,55 @@
+package commands
+
+import (
+	"fmt"
+	"os"
+	"text/tabwriter"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/ehazlett/conduit/types"
+	"github.com/spf13/cobra"
+)
+
+var (
+	reconcileDryRun bool
+)
+
+func init() {
+	reconcileCmd.Flags().StringVar(&conduitURL, "url", "http://localhost:8080", "Conduit URL")
+	reconcileCmd.Flags().BoolVar(&reconcileDryRun, "dry-run", false, "Only report the changes that would be made")
+	RootCmd.AddCommand(reconcileCmd)
+}
+
+var reconcileCmd = &cobra.Command{
+	Use:   "reconcile",
+	Short: "Reconcile the engines to the manifest",
+	Long:  "Create missing, replace drifted and remove orphaned containers of the manifest services.",
+	Run: func(cmd *cobra.Command, args []string) {
+		path := "/reconcile"
+		if reconcileDryRun {
+			path += "?dry_run=true"
+		}
+
+		var report types.ReconcileReport
+		if err := apiRequest("POST", path, nil, &report); err != nil {
+			logrus.Fatal(err)
+		}
+
+		w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+		fmt.Fprintln(w, "ENGINE\tSERVICE\tREPLICA\tACTION\tCONTAINER\tIMAGE\tREASON")
+		for _, a := range report.Actions {
+			fmt.Fprintf(w, "%s\t%s\t%d\t%s\t%s\t%s\t%s\n", a.Engine, a.Service, a.Replica, a.Action, a.Container, a.Image, a.Reason)
+		}
+		w.Flush()
+
+		for _, e := range report.Errors {
+			logrus.Error(e)
+		}
+
+		action := "made"
+		if report.DryRun {
+			action = "would make"
+		}
+		fmt.Printf("%s %d change(s)\n", action, len(report.Actions))
+	},
+}
@@ -0,0 +1,50 @@
+package commands
+
+import (
+	"fmt"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/ehazlett/conduit/types"
+	"github.com/spf13/cobra"
+)
+
+func init() {
+	rollbackCmd.Flags().StringVar(&conduitURL, "url", "http://localhost:8080", "Conduit URL")
+	RootCmd.AddCommand(rollbackCmd)
+}
+
+var rollbackCmd = &cobra.Command{
+	Use:   "rollback <repository>",
+	Short: "Roll back a repository",
+	Long:  "Restart the previous containers of a repository in place of the running containers.",
+	Run: func(cmd *cobra.Command, args []string) {
+		if len(args) != 1 {
+			cmd.Help()
+			logrus.Fatal("you must specify a repository")
+		}
+
+		// conduit in dry run responds with the rollback plan instead
+		var d struct {
+			types.Deployment
+			DryRun     bool                      `json:"dry_run"`
+			Containers []types.PreviousContainer `json:"containers"`
+		}
+		if err := apiRequest("POST", "/repositories/"+args[0]+"/rollback", nil, &d); err != nil {
+			logrus.Fatal(err)
+		}
+
+		if d.DryRun {
+			fmt.Printf("dry run: would roll back %d container(s) of %s\n", len(d.Containers), d.Repository)
+			for _, c := range d.Containers {
+				fmt.Printf("  %s on %s: %s (%s)\n", c.Name, c.Engine, c.Image, c.ID)
+			}
+			return
+		}
+
+		containers := 0
+		for _, s := range d.Stages {
+			containers += s.Containers
+		}
+		fmt.Printf("rolled back %d container(s) of %s (deployment %s)\n", containers, d.Repository, d.ID)
+	},
+}
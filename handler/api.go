@@ -0,0 +1,505 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/ehazlett/conduit/types"
+	"github.com/gorilla/mux"
+)
+
+// authorized checks the token of an API request
+func (h *Handler) authorized(w http.ResponseWriter, r *http.Request) bool {
+	token := r.URL.Query().Get("token")
+	if token != h.config.Token {
+		authFailures.Inc()
+		rErr := fmt.Errorf("invalid token %s", token)
+		http.Error(w, rErr.Error(), http.StatusUnauthorized)
+		logrus.Error(rErr)
+		return false
+	}
+
+	return true
+}
+
+// repositoryPlan returns the containers that would be rotated for the
+// repository when the optional tag is pushed.  The optional group limits
+// the plan to the engines of the group.  The repository does not need to
+// be enabled for deploy so the plan can be reviewed before it is.
+func (h *Handler) repositoryPlan(w http.ResponseWriter, r *http.Request) {
+	if !h.authorized(w, r) {
+		return
+	}
+
+	repo := mux.Vars(r)["name"]
+
+	plan, _, err := h.planDeploy(context.Background(), repo, r.URL.Query().Get("tag"), r.URL.Query().Get("group"))
+	if err != nil {
+		rErr := fmt.Errorf("error planning deploy of %s: %s", repo, err)
+		logrus.Error(rErr)
+		http.Error(w, rErr.Error(), http.StatusInternalServerError)
+		return
+	}
+	plan.DryRun = true
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(plan); err != nil {
+		logrus.Error(err)
+	}
+}
+
+// freezeRequest sets an ad-hoc freeze.  Start defaults to now and either
+// End or Duration (i.e. "2h") must be set.
+type freezeRequest struct {
+	Start    time.Time `json:"start"`
+	End      time.Time `json:"end"`
+	Duration string    `json:"duration"`
+	Reason   string    `json:"reason"`
+}
+
+func (h *Handler) listFreezes(w http.ResponseWriter, r *http.Request) {
+	if !h.authorized(w, r) {
+		return
+	}
+
+	repo := mux.Vars(r)["name"]
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(h.adhocFreezes(repo)); err != nil {
+		logrus.Error(err)
+	}
+}
+
+func (h *Handler) createFreeze(w http.ResponseWriter, r *http.Request) {
+	if !h.authorized(w, r) {
+		return
+	}
+
+	repo := mux.Vars(r)["name"]
+
+	var req freezeRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	f := types.Freeze{
+		Start:  req.Start,
+		End:    req.End,
+		Reason: req.Reason,
+	}
+	if f.Start.IsZero() {
+		f.Start = time.Now()
+	}
+	if req.Duration != "" {
+		d, err := time.ParseDuration(req.Duration)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("invalid duration: %s", err), http.StatusBadRequest)
+			return
+		}
+		f.End = f.Start.Add(d)
+	}
+	if !f.End.After(f.Start) {
+		http.Error(w, "freeze end must be after start", http.StatusBadRequest)
+		return
+	}
+
+	if err := h.addFreeze(repo, f); err != nil {
+		rErr := fmt.Errorf("error saving freeze: %s", err)
+		logrus.Error(rErr)
+		http.Error(w, rErr.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	logrus.WithFields(logrus.Fields{
+		"name":   repo,
+		"start":  f.Start,
+		"end":    f.End,
+		"reason": f.Reason,
+	}).Info("deploy freeze added")
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	if err := json.NewEncoder(w).Encode(f); err != nil {
+		logrus.Error(err)
+	}
+}
+
+func (h *Handler) deleteFreezes(w http.ResponseWriter, r *http.Request) {
+	if !h.authorized(w, r) {
+		return
+	}
+
+	repo := mux.Vars(r)["name"]
+
+	if err := h.clearFreezes(repo); err != nil {
+		rErr := fmt.Errorf("error removing freezes: %s", err)
+		logrus.Error(rErr)
+		http.Error(w, rErr.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	logrus.WithFields(logrus.Fields{
+		"name": repo,
+	}).Info("deploy freezes removed")
+
+	// deploys held by the freeze can run now
+	h.releaseDeferred()
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (h *Handler) getApprovals(w http.ResponseWriter, r *http.Request) {
+	if !h.authorized(w, r) {
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(h.listApprovals()); err != nil {
+		logrus.Error(err)
+	}
+}
+
+func (h *Handler) approveDeploy(w http.ResponseWriter, r *http.Request) {
+	// the confirmation page of a signed link posts its signature instead
+	// of the token
+	if r.URL.Query().Get("sig") != "" {
+		h.approveLink(w, r)
+		return
+	}
+
+	if !h.authorized(w, r) {
+		return
+	}
+
+	h.writeApproval(w, mux.Vars(r)["id"])
+}
+
+// approveLink handles the signed link sent in notifications.  Opening the
+// link only shows a confirmation page so that link previews and scanners
+// fetching it do not approve the deploy; the deploy is approved when the
+// page is submitted.
+func (h *Handler) approveLink(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	q := r.URL.Query()
+	if !h.validApprovalSignature(id, q.Get("expires"), q.Get("sig")) {
+		authFailures.Inc()
+		http.Error(w, "invalid or expired approval link", http.StatusUnauthorized)
+		return
+	}
+
+	if r.Method == http.MethodPost {
+		h.writeApproval(w, id)
+		return
+	}
+
+	a, ok := h.approvalInfo(id)
+	if !ok {
+		http.Error(w, fmt.Sprintf("no pending approval %s", id), http.StatusNotFound)
+		return
+	}
+
+	v := url.Values{}
+	v.Set("expires", q.Get("expires"))
+	v.Set("sig", q.Get("sig"))
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := approvalPage.Execute(w, struct {
+		Approval types.Approval
+		Action   string
+	}{
+		Approval: a,
+		Action:   r.URL.Path + "?" + v.Encode(),
+	}); err != nil {
+		logrus.Error(err)
+	}
+}
+
+func (h *Handler) writeApproval(w http.ResponseWriter, id string) {
+	p, err := h.approve(id)
+	if err != nil {
+		status := http.StatusNotFound
+		if err == errShuttingDown {
+			status = http.StatusServiceUnavailable
+		}
+		http.Error(w, err.Error(), status)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(p.info()); err != nil {
+		logrus.Error(err)
+	}
+}
+
+// rejectRequest optionally gives the reason a deploy was rejected
+type rejectRequest struct {
+	Reason string `json:"reason"`
+}
+
+func (h *Handler) rejectDeploy(w http.ResponseWriter, r *http.Request) {
+	if !h.authorized(w, r) {
+		return
+	}
+
+	var req rejectRequest
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	p, err := h.reject(mux.Vars(r)["id"], req.Reason)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(p.info()); err != nil {
+		logrus.Error(err)
+	}
+}
+
+func (h *Handler) getDeployments(w http.ResponseWriter, r *http.Request) {
+	if !h.authorized(w, r) {
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(h.listDeployments(r.URL.Query().Get("repository"))); err != nil {
+		logrus.Error(err)
+	}
+}
+
+func (h *Handler) getDeployment(w http.ResponseWriter, r *http.Request) {
+	if !h.authorized(w, r) {
+		return
+	}
+
+	id := mux.Vars(r)["id"]
+	d, ok := h.deployment(id)
+	if !ok {
+		http.Error(w, fmt.Sprintf("no deployment %s", id), http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(d); err != nil {
+		logrus.Error(err)
+	}
+}
+
+// cancelDeploy aborts the running deploy of the deployment.  The deploy
+// rolls back the containers it replaced and is recorded as cancelled.
+func (h *Handler) cancelDeploy(w http.ResponseWriter, r *http.Request) {
+	if !h.authorized(w, r) {
+		return
+	}
+
+	id := mux.Vars(r)["id"]
+	if _, ok := h.deployment(id); !ok {
+		http.Error(w, fmt.Sprintf("no deployment %s", id), http.StatusNotFound)
+		return
+	}
+
+	if err := h.cancelDeployment(id); err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+
+	w.WriteHeader(http.StatusAccepted)
+}
+
+func (h *Handler) getPrevious(w http.ResponseWriter, r *http.Request) {
+	if !h.authorized(w, r) {
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(h.listPrevious(mux.Vars(r)["name"])); err != nil {
+		logrus.Error(err)
+	}
+}
+
+// getContainers responds with the containers of the repository from the
+// inventory of each engine
+func (h *Handler) getContainers(w http.ResponseWriter, r *http.Request) {
+	if !h.authorized(w, r) {
+		return
+	}
+
+	containers, err := h.repositoryContainers(mux.Vars(r)["name"])
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(containers); err != nil {
+		logrus.Error(err)
+	}
+}
+
+// rollbackRepository queues a rollback of the repository to its previous
+// containers and responds with the deployment once it has run
+func (h *Handler) rollbackRepository(w http.ResponseWriter, r *http.Request) {
+	if !h.authorized(w, r) {
+		return
+	}
+
+	repo := mux.Vars(r)["name"]
+	if !h.isValidRepository(repo) {
+		http.Error(w, fmt.Sprintf("%s is not in whitelist", repo), http.StatusNotFound)
+		return
+	}
+
+	if h.config.DryRun {
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(h.rollbackPlan(repo)); err != nil {
+			logrus.Error(err)
+		}
+		return
+	}
+
+	j := newJob(repo, "", "", false)
+	j.Rollback = true
+	result := j.result
+	if err := h.queue.push(j); err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+
+	if err := <-result; err != nil {
+		status := http.StatusInternalServerError
+		if err == errJobPersisted {
+			status = http.StatusServiceUnavailable
+		}
+		http.Error(w, err.Error(), status)
+		return
+	}
+
+	d, _ := h.deployment(j.DeploymentID)
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(d); err != nil {
+		logrus.Error(err)
+	}
+}
+
+func (h *Handler) getPruneReport(w http.ResponseWriter, r *http.Request) {
+	if !h.authorized(w, r) {
+		return
+	}
+
+	report := h.pruneReport()
+	if report == nil {
+		http.Error(w, "no image prune has run", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(report); err != nil {
+		logrus.Error(err)
+	}
+}
+
+// prune queues an image prune of all repositories and responds with the
+// report once it has run.  dry_run=true only reports the images.
+func (h *Handler) prune(w http.ResponseWriter, r *http.Request) {
+	if !h.authorized(w, r) {
+		return
+	}
+
+	dryRun := false
+	if v := r.URL.Query().Get("dry_run"); v != "" {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("invalid dry_run value %q", v), http.StatusBadRequest)
+			return
+		}
+		dryRun = b
+	}
+
+	j := newPruneJob(dryRun || h.config.DryRun)
+	result := j.result
+	if err := h.queue.push(j); err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+
+	if err := <-result; err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(j.Report); err != nil {
+		logrus.Error(err)
+	}
+}
+
+func (h *Handler) getReconcileReport(w http.ResponseWriter, r *http.Request) {
+	if !h.authorized(w, r) {
+		return
+	}
+
+	report := h.reconcileReport()
+	if report == nil {
+		http.Error(w, "no reconcile has run", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(report); err != nil {
+		logrus.Error(err)
+	}
+}
+
+// reconcileManifest queues a reconcile of the engines to the manifest and
+// responds with the report once it has run.  dry_run=true only reports the
+// changes.
+func (h *Handler) reconcileManifest(w http.ResponseWriter, r *http.Request) {
+	if !h.authorized(w, r) {
+		return
+	}
+
+	if len(h.services) == 0 {
+		http.Error(w, "no manifest is configured", http.StatusNotFound)
+		return
+	}
+
+	dryRun := h.config.DryRun
+	if v := r.URL.Query().Get("dry_run"); v != "" {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("invalid dry_run value %q", v), http.StatusBadRequest)
+			return
+		}
+		// the global dry run setting cannot be disabled per request
+		dryRun = dryRun || b
+	}
+
+	j := newReconcileJob(dryRun)
+	result := j.result
+	if err := h.queue.push(j); err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+
+	if err := <-result; err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(j.Reconciled); err != nil {
+		logrus.Error(err)
+	}
+}
@@ -0,0 +1,347 @@
+package handler
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/ehazlett/conduit/notify"
+	"github.com/ehazlett/conduit/types"
+)
+
+const (
+	approvalsFile = "approvals.json"
+
+	// defaultApprovalExpiry is used when a repository requires approval
+	// without configuring an expiry
+	defaultApprovalExpiry = time.Hour * 24
+)
+
+// approvalPage confirms the approval of a deploy opened from a signed link
+var approvalPage = template.Must(template.New("approval").Parse(`<!DOCTYPE html>
+<html>
+<head><title>Approve deploy {{ .Approval.ID }}</title></head>
+<body>
+<p>Approve the deploy of {{ .Approval.Repository }}{{ if .Approval.Tag }}:{{ .Approval.Tag }}{{ end }}?</p>
+<p>The approval expires at {{ .Approval.Expires.Format "2006-01-02T15:04:05Z07:00" }}.</p>
+<form method="POST" action="{{ .Action }}">
+<button type="submit">Approve</button>
+</form>
+</body>
+</html>
+`))
+
+// pendingError is returned for a job that is waiting for approval
+type pendingError struct {
+	id string
+}
+
+func (e *pendingError) Error() string {
+	return fmt.Sprintf("deploy is pending approval: %s", e.id)
+}
+
+// pendingApproval is a job waiting to be approved
+type pendingApproval struct {
+	Job     *job      `json:"job"`
+	Created time.Time `json:"created"`
+	Expires time.Time `json:"expires"`
+}
+
+func (p *pendingApproval) info() types.Approval {
+	return types.Approval{
+		ID:         p.Job.ID,
+		Repository: p.Job.Repository,
+		Tag:        p.Job.Tag,
+		Created:    p.Created,
+		Expires:    p.Expires,
+	}
+}
+
+// requiresApproval reports whether deploys of the repository must be
+// approved before they run
+func (h *Handler) requiresApproval(repo string) bool {
+	a := h.repositoryConfig(repo).Approval
+	return a != nil && a.Required
+}
+
+func (h *Handler) approvalExpiry(repo string) time.Duration {
+	a := h.repositoryConfig(repo).Approval
+	if a == nil || a.Expire == "" {
+		return defaultApprovalExpiry
+	}
+
+	d, err := time.ParseDuration(a.Expire)
+	if err != nil {
+		return defaultApprovalExpiry
+	}
+
+	return d
+}
+
+// requestApproval holds the job until it is approved or expires and
+// notifies the approvers
+func (h *Handler) requestApproval(j *job) error {
+	now := time.Now()
+	p := &pendingApproval{
+		Job:     j,
+		Created: now,
+		Expires: now.Add(h.approvalExpiry(j.Repository)),
+	}
+
+	h.approvalLock.Lock()
+	h.approvals[j.ID] = p
+	err := h.saveApprovals()
+	h.approvalLock.Unlock()
+	if err != nil {
+		return err
+	}
+
+	logrus.WithFields(logrus.Fields{
+		"job":     j.ID,
+		"name":    j.Repository,
+		"expires": p.Expires,
+	}).Info("deploy pending approval")
+
+	desc := fmt.Sprintf("deploy %s of %s is pending approval until %s", j.ID, j.Repository, p.Expires.Format(time.RFC3339))
+	if j.Tag != "" {
+		desc = fmt.Sprintf("deploy %s of %s:%s is pending approval until %s", j.ID, j.Repository, j.Tag, p.Expires.Format(time.RFC3339))
+	}
+	e := notify.NewEvent(notify.EventApproval, j.Repository, desc)
+	e.URL = h.approvalURL(p)
+	h.notifier.Send(e)
+
+	return nil
+}
+
+// approvalSignature signs the approval id and expiry with the token
+func (h *Handler) approvalSignature(id string, expires int64) string {
+	mac := hmac.New(sha256.New, []byte(h.config.Token))
+	fmt.Fprintf(mac, "%s:%d", id, expires)
+
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func (h *Handler) validApprovalSignature(id, expires, sig string) bool {
+	n, err := strconv.ParseInt(expires, 10, 64)
+	if err != nil || time.Now().Unix() > n {
+		return false
+	}
+
+	return hmac.Equal([]byte(sig), []byte(h.approvalSignature(id, n)))
+}
+
+// approvalURL returns a signed link that approves the deploy.  It is
+// empty unless the external url of conduit is configured.
+func (h *Handler) approvalURL(p *pendingApproval) string {
+	if h.config.ExternalURL == "" {
+		return ""
+	}
+
+	expires := p.Expires.Unix()
+	v := url.Values{}
+	v.Set("expires", strconv.FormatInt(expires, 10))
+	v.Set("sig", h.approvalSignature(p.Job.ID, expires))
+
+	return fmt.Sprintf("%s/approvals/%s/approve?%s", strings.TrimSuffix(h.config.ExternalURL, "/"), p.Job.ID, v.Encode())
+}
+
+// approve queues the pending job.  An approval that has expired is
+// discarded and an approval that cannot be queued is kept pending.
+func (h *Handler) approve(id string) (*pendingApproval, error) {
+	p, err := h.takeApproval(id)
+	if err != nil {
+		return nil, err
+	}
+
+	if time.Now().After(p.Expires) {
+		logrus.WithFields(logrus.Fields{
+			"job":  id,
+			"name": p.Job.Repository,
+		}).Info("deploy approval expired")
+
+		h.failApproval(p, fmt.Sprintf("approval for deploy of %s expired", p.Job.Repository), "")
+		return nil, fmt.Errorf("approval %s has expired", id)
+	}
+
+	logrus.WithFields(logrus.Fields{
+		"job":  id,
+		"name": p.Job.Repository,
+	}).Info("deploy approved")
+
+	p.Job.Approved = true
+	if err := h.queue.push(p.Job); err != nil {
+		p.Job.Approved = false
+		h.restoreApproval(p)
+		return nil, err
+	}
+
+	return p, nil
+}
+
+// reject discards the pending job and reports it to the callback
+func (h *Handler) reject(id, reason string) (*pendingApproval, error) {
+	p, err := h.takeApproval(id)
+	if err != nil {
+		return nil, err
+	}
+
+	logrus.WithFields(logrus.Fields{
+		"job":  id,
+		"name": p.Job.Repository,
+	}).Info("deploy rejected")
+
+	h.failApproval(p, fmt.Sprintf("deploy of %s was rejected", p.Job.Repository), reason)
+
+	return p, nil
+}
+
+func (h *Handler) takeApproval(id string) (*pendingApproval, error) {
+	h.approvalLock.Lock()
+	defer h.approvalLock.Unlock()
+
+	p, ok := h.approvals[id]
+	if !ok {
+		return nil, fmt.Errorf("no pending approval %s", id)
+	}
+	delete(h.approvals, id)
+
+	if err := h.saveApprovals(); err != nil {
+		logrus.Errorf("error saving approvals: %s", err)
+	}
+
+	return p, nil
+}
+
+// restoreApproval returns the taken approval to the pending approvals
+func (h *Handler) restoreApproval(p *pendingApproval) {
+	h.approvalLock.Lock()
+	defer h.approvalLock.Unlock()
+
+	h.approvals[p.Job.ID] = p
+	if err := h.saveApprovals(); err != nil {
+		logrus.Errorf("error saving approvals: %s", err)
+	}
+}
+
+// failApproval reports a rejected or expired approval
+func (h *Handler) failApproval(p *pendingApproval, msg, reason string) {
+	if reason != "" {
+		msg += ": " + reason
+	}
+
+	webhooksReceived.Inc(p.Job.Repository, outcomeRejected)
+	h.notifier.Send(notify.NewEvent(notify.EventFailure, p.Job.Repository, msg))
+
+	h.sendCallback(&types.CallbackPayload{
+		State:       "error",
+		Description: msg,
+	}, p.Job.CallbackURL)
+}
+
+// expireApprovals discards pending approvals that have expired
+func (h *Handler) expireApprovals() {
+	now := time.Now()
+
+	h.approvalLock.Lock()
+	expired := []*pendingApproval{}
+	for id, p := range h.approvals {
+		if now.After(p.Expires) {
+			expired = append(expired, p)
+			delete(h.approvals, id)
+		}
+	}
+	if len(expired) > 0 {
+		if err := h.saveApprovals(); err != nil {
+			logrus.Errorf("error saving approvals: %s", err)
+		}
+	}
+	h.approvalLock.Unlock()
+
+	for _, p := range expired {
+		logrus.WithFields(logrus.Fields{
+			"job":  p.Job.ID,
+			"name": p.Job.Repository,
+		}).Info("deploy approval expired")
+
+		h.failApproval(p, fmt.Sprintf("approval for deploy of %s expired", p.Job.Repository), "")
+	}
+}
+
+// approvalInfo returns the pending approval of the job
+func (h *Handler) approvalInfo(id string) (types.Approval, bool) {
+	h.approvalLock.Lock()
+	defer h.approvalLock.Unlock()
+
+	p, ok := h.approvals[id]
+	if !ok {
+		return types.Approval{}, false
+	}
+
+	return p.info(), true
+}
+
+// listApprovals returns the pending approvals ordered by creation
+func (h *Handler) listApprovals() []types.Approval {
+	h.approvalLock.Lock()
+	defer h.approvalLock.Unlock()
+
+	approvals := []types.Approval{}
+	for _, p := range h.approvals {
+		approvals = append(approvals, p.info())
+	}
+	sort.Slice(approvals, func(i, j int) bool {
+		return approvals[i].Created.Before(approvals[j].Created)
+	})
+
+	return approvals
+}
+
+func (h *Handler) approvalsPath() string {
+	return filepath.Join(h.config.StateDir, approvalsFile)
+}
+
+// saveApprovals persists the pending approvals.  The approval lock must
+// be held.
+func (h *Handler) saveApprovals() error {
+	data, err := json.MarshalIndent(h.approvals, "", "    ")
+	if err != nil {
+		return err
+	}
+
+	tmp := h.approvalsPath() + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, h.approvalsPath())
+}
+
+func loadApprovals(path string) (map[string]*pendingApproval, error) {
+	approvals := map[string]*pendingApproval{}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return approvals, nil
+		}
+		return nil, err
+	}
+
+	if err := json.Unmarshal(data, &approvals); err != nil {
+		return nil, err
+	}
+
+	return approvals, nil
+}
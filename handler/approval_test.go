@@ -0,0 +1,101 @@
+package handler
+
+import (
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/ehazlett/conduit/notify"
+)
+
+func newApprovalHandler(t *testing.T) *Handler {
+	return &Handler{
+		config:    &HandlerConfig{StateDir: t.TempDir(), Token: "secret"},
+		queue:     newJobQueue(),
+		notifier:  &notify.Dispatcher{},
+		approvals: map[string]*pendingApproval{},
+	}
+}
+
+func TestValidApprovalSignature(t *testing.T) {
+	h := newApprovalHandler(t)
+	future := time.Now().Add(time.Hour).Unix()
+	past := time.Now().Add(-time.Hour).Unix()
+
+	tests := []struct {
+		name    string
+		id      string
+		expires string
+		sig     string
+		want    bool
+	}{
+		{"valid", "a1", strconv.FormatInt(future, 10), h.approvalSignature("a1", future), true},
+		{"other id", "b2", strconv.FormatInt(future, 10), h.approvalSignature("a1", future), false},
+		{"changed expiry", "a1", strconv.FormatInt(future+60, 10), h.approvalSignature("a1", future), false},
+		{"expired", "a1", strconv.FormatInt(past, 10), h.approvalSignature("a1", past), false},
+		{"invalid expiry", "a1", "soon", h.approvalSignature("a1", future), false},
+		{"missing signature", "a1", strconv.FormatInt(future, 10), "", false},
+	}
+
+	for _, tt := range tests {
+		if got := h.validApprovalSignature(tt.id, tt.expires, tt.sig); got != tt.want {
+			t.Errorf("%s: validApprovalSignature = %t, want %t", tt.name, got, tt.want)
+		}
+	}
+
+	other := newApprovalHandler(t)
+	other.config.Token = "other"
+	if h.approvalSignature("a1", future) == other.approvalSignature("a1", future) {
+		t.Error("approval signatures do not depend on the token")
+	}
+}
+
+func TestApprove(t *testing.T) {
+	h := newApprovalHandler(t)
+	j := newJob("app", "1.0", "", false)
+	h.approvals[j.ID] = &pendingApproval{Job: j, Created: time.Now(), Expires: time.Now().Add(time.Hour)}
+
+	if _, err := h.approve(j.ID); err != nil {
+		t.Fatalf("approve error: %s", err)
+	}
+	if _, ok := h.approvals[j.ID]; ok {
+		t.Error("approved deploy is still pending")
+	}
+	if pending := h.queue.waiting(); len(pending) != 1 || pending[0] != j || !j.Approved {
+		t.Errorf("queued jobs = %v, want the approved job", pending)
+	}
+}
+
+func TestApproveExpired(t *testing.T) {
+	h := newApprovalHandler(t)
+	j := newJob("app", "1.0", "", false)
+	h.approvals[j.ID] = &pendingApproval{Job: j, Created: time.Now().Add(-time.Hour), Expires: time.Now().Add(-time.Minute)}
+
+	if _, err := h.approve(j.ID); err == nil {
+		t.Error("approve = nil error, want error for an expired approval")
+	}
+	if _, ok := h.approvals[j.ID]; ok {
+		t.Error("expired approval is still pending")
+	}
+	if pending := h.queue.waiting(); len(pending) != 0 {
+		t.Errorf("queued %d jobs for an expired approval", len(pending))
+	}
+}
+
+func TestApproveShuttingDown(t *testing.T) {
+	h := newApprovalHandler(t)
+	j := newJob("app", "1.0", "", false)
+	h.approvals[j.ID] = &pendingApproval{Job: j, Created: time.Now(), Expires: time.Now().Add(time.Hour)}
+	h.queue.close()
+
+	if _, err := h.approve(j.ID); err != errShuttingDown {
+		t.Errorf("approve error = %v, want %v", err, errShuttingDown)
+	}
+	p, ok := h.approvals[j.ID]
+	if !ok {
+		t.Fatal("approval that could not be queued was discarded")
+	}
+	if p.Job.Approved {
+		t.Error("approval that could not be queued is marked approved")
+	}
+}
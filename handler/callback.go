@@ -0,0 +1,130 @@
+package handler
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/ehazlett/conduit/types"
+)
+
+const (
+	// maxCallbackBackoff caps the delay between callback attempts
+	maxCallbackBackoff = time.Second * 30
+)
+
+// callbackStatusError is returned for a callback the receiver responded to
+// with an error status
+type callbackStatusError struct {
+	status string
+	code   int
+	body   []byte
+}
+
+func (e *callbackStatusError) Error() string {
+	return fmt.Sprintf("unexpected status %s: %s", e.status, e.body)
+}
+
+// retryable reports whether a failed callback should be retried.  Only
+// network errors and server errors are retried; the receiver rejected the
+// callback otherwise.
+func retryable(err error) bool {
+	if e, ok := err.(*callbackStatusError); ok {
+		return e.code >= 500
+	}
+
+	return true
+}
+
+// sendCallback delivers the callback payload in the background so that a
+// slow or unreachable receiver does not hold up the queue
+func (h *Handler) sendCallback(payload *types.CallbackPayload, callbackURL string) {
+	if callbackURL == "" {
+		return
+	}
+
+	h.callbacks.Add(1)
+	go func() {
+		defer h.callbacks.Done()
+
+		if err := h.sendResponse(payload, callbackURL); err != nil {
+			logrus.Error(err)
+		}
+	}()
+}
+
+// sendResponse delivers the callback payload, retrying with exponential
+// backoff until it is accepted or the retries are exhausted
+func (h *Handler) sendResponse(payload *types.CallbackPayload, callbackURL string) error {
+	logrus.Debugf("sending response payload: callback=%s", callbackURL)
+
+	var buf bytes.Buffer
+	if err := json.NewEncoder(&buf).Encode(payload); err != nil {
+		return err
+	}
+	body := buf.Bytes()
+
+	backoff := time.Second
+	var err error
+	attempts := 0
+	for attempt := 1; attempt <= h.config.CallbackRetries+1; attempt++ {
+		attempts = attempt
+		if err = h.postCallback(callbackURL, body); err == nil {
+			callbackDeliveries.Inc(outcomeSuccess)
+			logrus.WithFields(logrus.Fields{
+				"callback": callbackURL,
+				"attempt":  attempt,
+			}).Debug("callback delivered")
+			return nil
+		}
+
+		logrus.WithFields(logrus.Fields{
+			"callback": callbackURL,
+			"attempt":  attempt,
+		}).Warnf("error delivering callback: %s", err)
+
+		if attempt > h.config.CallbackRetries || !retryable(err) {
+			break
+		}
+
+		callbackRetries.Inc()
+		time.Sleep(backoff)
+		if backoff *= 2; backoff > maxCallbackBackoff {
+			backoff = maxCallbackBackoff
+		}
+	}
+
+	callbackDeliveries.Inc(outcomeError)
+
+	return fmt.Errorf("callback to %s failed after %d attempts: %s", callbackURL, attempts, err)
+}
+
+func (h *Handler) postCallback(callbackURL string, body []byte) error {
+	resp, err := h.callbackClient.Post(callbackURL, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	b, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return &callbackStatusError{
+			status: resp.Status,
+			code:   resp.StatusCode,
+			body:   bytes.TrimSpace(b),
+		}
+	}
+
+	return nil
+}
+
+func newCallbackClient(timeout time.Duration) *http.Client {
+	return &http.Client{
+		Timeout: timeout,
+	}
+}
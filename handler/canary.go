@@ -0,0 +1,269 @@
+package handler
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	dockertypes "github.com/docker/docker/api/types"
+	"github.com/ehazlett/conduit/notify"
+	"github.com/ehazlett/conduit/types"
+)
+
+const (
+	// canaryInterval is how often the canary is checked while it is
+	// watched
+	canaryInterval = time.Second * 5
+
+	// defaultCanaryPeriod is used when a canary is configured without a
+	// period
+	defaultCanaryPeriod = time.Minute
+)
+
+// canaryConfig returns the canary settings of the repository or nil when
+// the repository is not deployed with a canary
+func (h *Handler) canaryConfig(repo string) *types.CanaryConfig {
+	return h.repositoryConfig(repo).Canary
+}
+
+func canaryPeriod(c *types.CanaryConfig) time.Duration {
+	if c.Period == "" {
+		return defaultCanaryPeriod
+	}
+
+	d, err := time.ParseDuration(c.Period)
+	if err != nil {
+		return defaultCanaryPeriod
+	}
+
+	return d
+}
+
+// rotateCanary rotates the target as the canary and watches it.  The old
+// container is kept stopped until the canary passes and restored if it
+// fails or ctx is done.
+func (h *Handler) rotateCanary(ctx context.Context, t *deployTarget, c *types.CanaryConfig) error {
+	e := t.Engine
+	t.KeepOld = true
+
+	if err := h.rotate(ctx, t); err != nil {
+		return err
+	}
+
+	logrus.WithFields(logrus.Fields{
+		"container": shortID(t.NewID),
+		"engine":    e.Name,
+		"period":    canaryPeriod(c),
+	}).Info("watching canary")
+
+	if err := h.watchCanary(ctx, e, t.NewID, c); err != nil {
+		repo, _ := parseImage(t.Image)
+		rollbacks.Inc(repo)
+		h.notifier.Send(notify.NewEvent(notify.EventRollback, repo, fmt.Sprintf("canary %s was rolled back: %s", shortID(t.NewID), err)))
+
+		if rErr := h.rollbackRotation(t); rErr != nil {
+			logrus.WithFields(logrus.Fields{
+				"container": shortID(t.Container.ID),
+			}).Errorf("error restoring container after canary failure: %s", rErr)
+		}
+
+		return fmt.Errorf("canary failed: %s", err)
+	}
+
+	logrus.WithFields(logrus.Fields{
+		"container": shortID(t.NewID),
+	}).Info("canary passed")
+
+	return h.retireRotated(ctx, t)
+}
+
+// rollbackRotation removes the replacement of a target rotated with
+// KeepOld, i.e. a canary, and restarts the old container
+func (h *Handler) rollbackRotation(t *deployTarget) error {
+	if err := h.removeReplacement(t); err != nil {
+		return err
+	}
+
+	return h.restartOld(t)
+}
+
+// removeReplacement removes the replacement of the rotated target
+func (h *Handler) removeReplacement(t *deployTarget) error {
+	return h.removeContainer(context.Background(), t.Engine, t.NewID, t.Options)
+}
+
+// restartOld gives the stopped old container of the rotated target its
+// name back and starts it.  The replacement must have been removed.
+func (h *Handler) restartOld(t *deployTarget) error {
+	e := t.Engine
+
+	old, err := e.client.ContainerInspect(context.Background(), t.Container.ID)
+	if err != nil {
+		return err
+	}
+
+	// compose containers were renamed for the replacement
+	name := strings.TrimPrefix(old.Name, "/")
+	if strings.HasSuffix(name, composeOldSuffix) {
+		if err := e.client.ContainerRename(context.Background(), old.ID, strings.TrimSuffix(name, composeOldSuffix)); err != nil {
+			return err
+		}
+	}
+
+	logrus.WithFields(logrus.Fields{
+		"container": shortID(old.ID),
+	}).Info("restarting replaced container")
+
+	return e.client.ContainerStart(context.Background(), old.ID, dockertypes.ContainerStartOptions{})
+}
+
+// watchCanary checks the canary until the canary period has elapsed
+func (h *Handler) watchCanary(ctx context.Context, e *engine, id string, c *types.CanaryConfig) error {
+	cID := shortID(id)
+	deadline := time.Now().Add(canaryPeriod(c))
+
+	var before map[string]float64
+	if c.MetricsURL != "" {
+		m, err := scrapeMetrics(c.MetricsURL, c.ErrorMetric, c.RequestMetric)
+		if err != nil {
+			return err
+		}
+		before = m
+	}
+
+	for {
+		cfg, err := e.client.ContainerInspect(ctx, id)
+		if err != nil {
+			return err
+		}
+
+		state := cfg.State
+		if !state.Running {
+			return fmt.Errorf("container %s exited with code %d", cID, state.ExitCode)
+		}
+		if state.Health != nil && state.Health.Status == dockertypes.Unhealthy {
+			return fmt.Errorf("container %s is unhealthy", cID)
+		}
+		if cfg.RestartCount > c.MaxRestarts {
+			return fmt.Errorf("container %s restarted %d times", cID, cfg.RestartCount)
+		}
+
+		remaining := deadline.Sub(time.Now())
+		if remaining <= 0 {
+			break
+		}
+		if remaining > canaryInterval {
+			remaining = canaryInterval
+		}
+
+		select {
+		case <-time.After(remaining):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+
+	if c.MetricsURL == "" {
+		return nil
+	}
+
+	after, err := scrapeMetrics(c.MetricsURL, c.ErrorMetric, c.RequestMetric)
+	if err != nil {
+		return err
+	}
+
+	requests := after[c.RequestMetric] - before[c.RequestMetric]
+	if requests <= 0 {
+		return nil
+	}
+
+	rate := (after[c.ErrorMetric] - before[c.ErrorMetric]) / requests
+	logrus.WithFields(logrus.Fields{
+		"container":  cID,
+		"error_rate": rate,
+	}).Debug("canary error rate")
+
+	if rate > c.MaxErrorRate {
+		return fmt.Errorf("error rate %.4f is above %.4f", rate, c.MaxErrorRate)
+	}
+
+	return nil
+}
+
+// scrapeMetrics returns the sum of all series of each of the metrics from
+// a Prometheus text format endpoint
+func scrapeMetrics(url string, names ...string) (map[string]float64, error) {
+	client := &http.Client{
+		Timeout: time.Second * 10,
+	}
+	resp, err := client.Get(url)
+	if err != nil {
+		return nil, fmt.Errorf("error scraping canary metrics: %s", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("error scraping canary metrics: %s", resp.Status)
+	}
+
+	values := map[string]float64{}
+	s := bufio.NewScanner(resp.Body)
+	for s.Scan() {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		name := line
+		if i := strings.IndexAny(line, "{ "); i > 0 {
+			name = line[:i]
+		}
+		if !containsString(names, name) {
+			continue
+		}
+
+		// the value follows the labels and may be followed by a timestamp
+		rest := line[len(name):]
+		if i := strings.LastIndex(rest, "}"); i >= 0 {
+			rest = rest[i+1:]
+		}
+		fields := strings.Fields(rest)
+		if len(fields) == 0 {
+			continue
+		}
+
+		v, err := strconv.ParseFloat(fields[0], 64)
+		if err != nil {
+			continue
+		}
+		values[name] += v
+	}
+
+	return values, s.Err()
+}
+
+// validateCanaries checks the canary settings of the repositories
+func validateCanaries(configs map[string]*types.RepositoryConfig) error {
+	for repo, rc := range configs {
+		if rc == nil || rc.Canary == nil {
+			continue
+		}
+
+		c := rc.Canary
+		if c.Period != "" {
+			if _, err := time.ParseDuration(c.Period); err != nil {
+				return fmt.Errorf("invalid canary period for %s: %s", repo, err)
+			}
+		}
+		if c.MetricsURL != "" && (c.ErrorMetric == "" || c.RequestMetric == "") {
+			return fmt.Errorf("invalid canary for %s: error_metric and request_metric are required with metrics_url", repo)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,50 @@
+package handler
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+func TestScrapeMetrics(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `# HELP http_requests_total The total number of requests.
+# TYPE http_requests_total counter
+http_requests_total{code="200",method="get"} 1027 1395066363000
+http_requests_total{code="500",method="get"} 3
+http_requests_total_other 99
+http_errors_total 4
+http_errors_total{path="/{id}"} 1.5
+
+rpc_duration_seconds{quantile="0.5"} 4773
+invalid_value_total NaNx
+`)
+	}))
+	defer srv.Close()
+
+	got, err := scrapeMetrics(srv.URL, "http_requests_total", "http_errors_total", "missing_total")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string]float64{
+		"http_requests_total": 1030,
+		"http_errors_total":   5.5,
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("scrapeMetrics = %v, want %v", got, want)
+	}
+}
+
+func TestScrapeMetricsError(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "unavailable", http.StatusServiceUnavailable)
+	}))
+	defer srv.Close()
+
+	if _, err := scrapeMetrics(srv.URL, "http_requests_total"); err == nil {
+		t.Error("scrapeMetrics = nil error, want error for a failed scrape")
+	}
+}
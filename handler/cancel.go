@@ -0,0 +1,206 @@
+package handler
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/ehazlett/conduit/types"
+)
+
+var (
+	errNotCancellable = errors.New("deployment is not running")
+)
+
+// cancelledError is returned for a deploy that was cancelled
+type cancelledError struct {
+	repo string
+}
+
+func (e *cancelledError) Error() string {
+	return fmt.Sprintf("deploy of %s was cancelled", e.repo)
+}
+
+// runningDeploy is the deploy in progress
+type runningDeploy struct {
+	DeploymentID string
+	Repository   string
+	cancel       context.CancelFunc
+}
+
+// deployTimeout returns the deadline of a deploy of the repository
+func (h *Handler) deployTimeout(repo string) time.Duration {
+	rc := h.repositoryConfig(repo)
+	if rc.DeployTimeout != "" {
+		if d, err := time.ParseDuration(rc.DeployTimeout); err == nil {
+			return d
+		}
+	}
+
+	return h.config.DeployTimeout
+}
+
+// startDeploy returns the context of the deploy of the job with the deploy
+// deadline of the repository.  The returned func must be called once the
+// deploy has finished.
+func (h *Handler) startDeploy(j *job) (context.Context, func()) {
+	ctx, cancel := deployContext(h.deployTimeout(j.Repository))
+
+	h.runningLock.Lock()
+	h.running = &runningDeploy{
+		DeploymentID: j.DeploymentID,
+		Repository:   j.Repository,
+		cancel:       cancel,
+	}
+	h.runningLock.Unlock()
+
+	return ctx, func() {
+		h.runningLock.Lock()
+		h.running = nil
+		h.runningLock.Unlock()
+
+		cancel()
+	}
+}
+
+// deployContext returns a context with the deadline when it is set
+func deployContext(timeout time.Duration) (context.Context, context.CancelFunc) {
+	if timeout > 0 {
+		return context.WithTimeout(context.Background(), timeout)
+	}
+
+	return context.WithCancel(context.Background())
+}
+
+// deployError returns the error of a deploy that was aborted because its
+// context is done
+func (h *Handler) deployError(ctx context.Context, repo string, err error) error {
+	switch ctx.Err() {
+	case context.Canceled:
+		return &cancelledError{repo: repo}
+	case context.DeadlineExceeded:
+		return fmt.Errorf("deploy deadline of %s exceeded", h.deployTimeout(repo))
+	}
+
+	return err
+}
+
+// cancelRunning aborts the running deploy, if any
+func (h *Handler) cancelRunning() bool {
+	h.runningLock.Lock()
+	defer h.runningLock.Unlock()
+
+	if h.running == nil {
+		return false
+	}
+
+	h.running.cancel()
+	return true
+}
+
+// cancelDeployment aborts the running deploy of the deployment or drops
+// its stages waiting to be promoted
+func (h *Handler) cancelDeployment(id string) error {
+	h.runningLock.Lock()
+	running := h.running
+	h.runningLock.Unlock()
+
+	if running != nil && running.DeploymentID == id {
+		logrus.WithFields(logrus.Fields{
+			"deployment": id,
+		}).Info("cancelling deploy")
+		running.cancel()
+		return nil
+	}
+
+	h.deferredLock.Lock()
+	held := []*job{}
+	cancelled := []*job{}
+	for _, j := range h.deferred {
+		if j.DeploymentID != "" && j.DeploymentID == id {
+			cancelled = append(cancelled, j)
+			continue
+		}
+		held = append(held, j)
+	}
+	h.deferred = held
+	h.deferredLock.Unlock()
+	h.queue.notifyChanged()
+
+	if len(cancelled) == 0 {
+		return errNotCancellable
+	}
+
+	for _, j := range cancelled {
+		logrus.WithFields(logrus.Fields{
+			"deployment": id,
+			"job":        j.ID,
+		}).Info("cancelling deferred deploy")
+
+		err := &cancelledError{repo: j.Repository}
+		h.failStage(j, nil, err)
+		j.finish(err)
+	}
+
+	return nil
+}
+
+// rollbackTargets restores the old containers of the targets that were
+// already rotated when a deploy is aborted.  The old containers are kept
+// stopped until the deploy has finished.  The replacements are removed in
+// reverse order before the old containers are started in rotation order
+// so that a container sharing the namespace or volumes of another starts
+// after it.
+func (h *Handler) rollbackTargets(targets []*deployTarget) {
+	removed := []*deployTarget{}
+	for i := len(targets) - 1; i >= 0; i-- {
+		t := targets[i]
+
+		logrus.WithFields(logrus.Fields{
+			"container": shortID(t.Container.ID),
+			"engine":    t.Engine.Name,
+		}).Info("rolling back replaced container")
+
+		if err := h.removeReplacement(t); err != nil {
+			// the old container is left stopped as the replacement
+			// may still hold its name
+			logrus.WithFields(logrus.Fields{
+				"container": shortID(t.NewID),
+			}).Errorf("error removing replacement container: %s", err)
+			continue
+		}
+		removed = append([]*deployTarget{t}, removed...)
+	}
+
+	for _, t := range removed {
+		if err := h.restartOld(t); err != nil {
+			logrus.WithFields(logrus.Fields{
+				"container": shortID(t.Container.ID),
+			}).Errorf("error rolling back container: %s", err)
+		}
+	}
+}
+
+// retireTargets takes the old containers of the targets that were already
+// rotated out of service when a deploy fails and its replacements are kept
+func (h *Handler) retireTargets(targets []*deployTarget) {
+	for _, t := range targets {
+		if err := h.retireContainer(context.Background(), t); err != nil {
+			logrus.WithFields(logrus.Fields{
+				"container": shortID(t.Container.ID),
+			}).Errorf("error retiring replaced container: %s", err)
+		}
+	}
+}
+
+// failedStatus is the status of a deployment that failed with err
+func failedStatus(err error) string {
+	switch err.(type) {
+	case *cancelledError, *supersededError:
+		return types.DeploymentCancelled
+	}
+
+	return types.DeploymentFailed
+}
@@ -0,0 +1,59 @@
+package handler
+
+import (
+	"reflect"
+	"testing"
+
+	dockertypes "github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+)
+
+// rotatedTarget adds the stopped old container and the running
+// replacement of a rotated target
+func rotatedTarget(h *Handler, f *fakeEngine, name string) *deployTarget {
+	old := f.add(name+"-old", name, false, nil)
+	repl := f.add(name+"-new", name+"-new", true, nil)
+	e, _ := h.engine("local")
+
+	return &deployTarget{
+		Engine:    e,
+		Container: dockertypes.Container{ID: old.ID},
+		Options:   &deployOptions{},
+		NewID:     repl.ID,
+	}
+}
+
+func TestRollbackTargetsOrder(t *testing.T) {
+	h, f := newFakeHandler(t)
+	parent := rotatedTarget(h, f, "db")
+	dependent := rotatedTarget(h, f, "app")
+	f.containers[dependent.Container.ID].HostConfig.NetworkMode = container.NetworkMode("container:" + parent.Container.ID)
+
+	h.rollbackTargets([]*deployTarget{parent, dependent})
+
+	want := []string{
+		"stop app-new",
+		"remove app-new",
+		"stop db-new",
+		"remove db-new",
+		"start db",
+		"start app",
+	}
+	if got := f.recorded(""); !reflect.DeepEqual(got, want) {
+		t.Errorf("calls = %v, want %v", got, want)
+	}
+}
+
+func TestRollbackTargetsKeepsOldWhenReplacementRemains(t *testing.T) {
+	h, f := newFakeHandler(t)
+	parent := rotatedTarget(h, f, "db")
+	dependent := rotatedTarget(h, f, "app")
+	// the replacement of the dependent cannot be found so it is not removed
+	dependent.NewID = "missing" + dependent.NewID[7:]
+
+	h.rollbackTargets([]*deployTarget{parent, dependent})
+
+	if got, want := f.recorded("start"), []string{"start db"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("started = %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,117 @@
+package handler
+
+import (
+	"context"
+	"io"
+	"time"
+
+	dockertypes "github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/network"
+	"github.com/docker/docker/client"
+)
+
+// instrumentedClient wraps the Docker client to record API errors for
+// the operations conduit uses.  Other methods are passed through to the
+// embedded client.
+type instrumentedClient struct {
+	client.APIClient
+	// changed is called with the id of a container after it was changed
+	// so the inventory does not wait for the engine event
+	changed func(id string)
+}
+
+func (c *instrumentedClient) touch(id string, err error) error {
+	if err == nil && c.changed != nil {
+		c.changed(id)
+	}
+
+	return err
+}
+
+func observeDockerError(operation string, err error) error {
+	// missing objects are expected when probing for containers
+	if err != nil && !client.IsErrNotFound(err) {
+		dockerErrors.Inc(operation)
+	}
+
+	return err
+}
+
+func (c *instrumentedClient) ContainerList(ctx context.Context, options dockertypes.ContainerListOptions) ([]dockertypes.Container, error) {
+	containers, err := c.APIClient.ContainerList(ctx, options)
+	return containers, observeDockerError("container_list", err)
+}
+
+func (c *instrumentedClient) ContainerInspect(ctx context.Context, id string) (dockertypes.ContainerJSON, error) {
+	cfg, err := c.APIClient.ContainerInspect(ctx, id)
+	return cfg, observeDockerError("container_inspect", err)
+}
+
+func (c *instrumentedClient) ContainerCreate(ctx context.Context, config *container.Config, hostConfig *container.HostConfig, networkingConfig *network.NetworkingConfig, name string) (container.ContainerCreateCreatedBody, error) {
+	resp, err := c.APIClient.ContainerCreate(ctx, config, hostConfig, networkingConfig, name)
+	return resp, c.touch(resp.ID, observeDockerError("container_create", err))
+}
+
+func (c *instrumentedClient) ContainerStart(ctx context.Context, id string, options dockertypes.ContainerStartOptions) error {
+	return c.touch(id, observeDockerError("container_start", c.APIClient.ContainerStart(ctx, id, options)))
+}
+
+func (c *instrumentedClient) ContainerStop(ctx context.Context, id string, timeout *time.Duration) error {
+	return c.touch(id, observeDockerError("container_stop", c.APIClient.ContainerStop(ctx, id, timeout)))
+}
+
+func (c *instrumentedClient) ContainerKill(ctx context.Context, id, signal string) error {
+	return c.touch(id, observeDockerError("container_kill", c.APIClient.ContainerKill(ctx, id, signal)))
+}
+
+func (c *instrumentedClient) ContainerWait(ctx context.Context, id string) (int64, error) {
+	code, err := c.APIClient.ContainerWait(ctx, id)
+	if ctx.Err() != nil {
+		// waiting past the stop timeout is not an API error
+		return code, err
+	}
+	return code, observeDockerError("container_wait", err)
+}
+
+func (c *instrumentedClient) ContainerRemove(ctx context.Context, id string, options dockertypes.ContainerRemoveOptions) error {
+	return c.touch(id, observeDockerError("container_remove", c.APIClient.ContainerRemove(ctx, id, options)))
+}
+
+func (c *instrumentedClient) ContainerRename(ctx context.Context, id, name string) error {
+	return c.touch(id, observeDockerError("container_rename", c.APIClient.ContainerRename(ctx, id, name)))
+}
+
+func (c *instrumentedClient) ImagePull(ctx context.Context, ref string, options dockertypes.ImagePullOptions) (io.ReadCloser, error) {
+	r, err := c.APIClient.ImagePull(ctx, ref, options)
+	return r, observeDockerError("image_pull", err)
+}
+
+func (c *instrumentedClient) ImageList(ctx context.Context, options dockertypes.ImageListOptions) ([]dockertypes.ImageSummary, error) {
+	images, err := c.APIClient.ImageList(ctx, options)
+	return images, observeDockerError("image_list", err)
+}
+
+func (c *instrumentedClient) ImageRemove(ctx context.Context, id string, options dockertypes.ImageRemoveOptions) ([]dockertypes.ImageDelete, error) {
+	deleted, err := c.APIClient.ImageRemove(ctx, id, options)
+	return deleted, observeDockerError("image_remove", err)
+}
+
+func (c *instrumentedClient) ContainerUpdate(ctx context.Context, id string, updateConfig container.UpdateConfig) (container.ContainerUpdateOKBody, error) {
+	resp, err := c.APIClient.ContainerUpdate(ctx, id, updateConfig)
+	return resp, observeDockerError("container_update", err)
+}
+
+func (c *instrumentedClient) NetworkConnect(ctx context.Context, networkID, id string, config *network.EndpointSettings) error {
+	return observeDockerError("network_connect", c.APIClient.NetworkConnect(ctx, networkID, id, config))
+}
+
+func (c *instrumentedClient) ImageInspectWithRaw(ctx context.Context, id string) (dockertypes.ImageInspect, []byte, error) {
+	img, raw, err := c.APIClient.ImageInspectWithRaw(ctx, id)
+	return img, raw, observeDockerError("image_inspect", err)
+}
+
+func (c *instrumentedClient) Info(ctx context.Context) (dockertypes.Info, error) {
+	info, err := c.APIClient.Info(ctx)
+	return info, observeDockerError("info", err)
+}
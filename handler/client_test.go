@@ -0,0 +1,255 @@
+package handler
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+
+	dockertypes "github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/filters"
+	"github.com/docker/docker/api/types/network"
+	"github.com/docker/docker/client"
+)
+
+// fakeEngine is an in-memory engine serving the parts of the Docker API
+// conduit uses.  It records the container calls made against it.
+type fakeEngine struct {
+	mu         sync.Mutex
+	containers map[string]*dockertypes.ContainerJSON
+	created    int
+	// failStart makes starting the container fail
+	failStart map[string]bool
+	calls     []string
+}
+
+// newFakeHandler returns a handler with a single engine named local
+// backed by a fake engine
+func newFakeHandler(t *testing.T) (*Handler, *fakeEngine) {
+	f := &fakeEngine{
+		containers: map[string]*dockertypes.ContainerJSON{},
+		failStart:  map[string]bool{},
+	}
+
+	srv := httptest.NewServer(f)
+	t.Cleanup(srv.Close)
+
+	cli, err := client.NewClient("tcp://"+strings.TrimPrefix(srv.URL, "http://"), "", &http.Client{
+		Transport: &http.Transport{},
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	h := &Handler{
+		config:  &HandlerConfig{StateDir: t.TempDir()},
+		engines: []*engine{newEngine("local", "", "", cli)},
+	}
+
+	return h, f
+}
+
+// add creates a container with a 64 character id
+func (f *fakeEngine) add(id, name string, running bool, labels map[string]string) *dockertypes.ContainerJSON {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	c := &dockertypes.ContainerJSON{
+		ContainerJSONBase: &dockertypes.ContainerJSONBase{
+			ID:         id + strings.Repeat("0", 64-len(id)),
+			Name:       "/" + name,
+			State:      &dockertypes.ContainerState{Running: running},
+			HostConfig: &container.HostConfig{},
+		},
+		Config: &container.Config{Labels: labels},
+	}
+	f.containers[c.ID] = c
+
+	return c
+}
+
+// recorded returns the calls made, optionally only those of the kind
+func (f *fakeEngine) recorded(kind string) []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	calls := []string{}
+	for _, c := range f.calls {
+		if kind == "" || strings.HasPrefix(c, kind+" ") {
+			calls = append(calls, c)
+		}
+	}
+
+	return calls
+}
+
+func (f *fakeEngine) lookup(id string) *dockertypes.ContainerJSON {
+	if c, ok := f.containers[id]; ok {
+		return c
+	}
+	for _, c := range f.containers {
+		if c.Name == "/"+id {
+			return c
+		}
+	}
+
+	return nil
+}
+
+func (f *fakeEngine) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	switch {
+	case r.Method == "GET" && r.URL.Path == "/containers/json":
+		f.list(w, r)
+	case r.Method == "POST" && r.URL.Path == "/containers/create":
+		f.create(w, r)
+	case len(parts) == 3 && parts[0] == "networks" && parts[2] == "connect":
+		var nc dockertypes.NetworkConnect
+		if err := json.NewDecoder(r.Body).Decode(&nc); err != nil {
+			fakeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		c := f.lookup(nc.Container)
+		if c == nil {
+			fakeError(w, http.StatusNotFound, "no such container: "+nc.Container)
+			return
+		}
+		f.record("connect", c, parts[1])
+	case len(parts) >= 2 && parts[0] == "containers":
+		c := f.lookup(parts[1])
+		if c == nil {
+			fakeError(w, http.StatusNotFound, "no such container: "+parts[1])
+			return
+		}
+		action := r.Method
+		if len(parts) == 3 {
+			action = parts[2]
+		}
+		f.container(w, r, c, action)
+	default:
+		fakeError(w, http.StatusNotFound, "unsupported call "+r.Method+" "+r.URL.Path)
+	}
+}
+
+func (f *fakeEngine) container(w http.ResponseWriter, r *http.Request, c *dockertypes.ContainerJSON, action string) {
+	switch action {
+	case "json":
+		json.NewEncoder(w).Encode(c)
+	case "start":
+		f.record("start", c)
+		if f.failStart[c.ID] {
+			fakeError(w, http.StatusInternalServerError, "cannot start container")
+			return
+		}
+		c.State.Running = true
+		w.WriteHeader(http.StatusNoContent)
+	case "stop":
+		f.record("stop", c)
+		c.State.Running = false
+		w.WriteHeader(http.StatusNoContent)
+	case "rename":
+		name := r.URL.Query().Get("name")
+		f.record("rename", c, name)
+		c.Name = "/" + name
+		w.WriteHeader(http.StatusNoContent)
+	case "update":
+		f.record("update", c)
+		json.NewEncoder(w).Encode(container.ContainerUpdateOKBody{})
+	case "DELETE":
+		f.record("remove", c)
+		delete(f.containers, c.ID)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		fakeError(w, http.StatusNotFound, "unsupported container call "+action)
+	}
+}
+
+func (f *fakeEngine) list(w http.ResponseWriter, r *http.Request) {
+	args, err := filters.FromParam(r.URL.Query().Get("filters"))
+	if err != nil {
+		fakeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	all := r.URL.Query().Get("all") == "1"
+
+	list := []dockertypes.Container{}
+	for _, c := range f.containers {
+		if !all && !c.State.Running {
+			continue
+		}
+		if !args.MatchKVList("label", c.Config.Labels) {
+			continue
+		}
+		if ids := args.Get("id"); len(ids) > 0 && !strings.HasPrefix(c.ID, ids[0]) {
+			continue
+		}
+
+		state := "exited"
+		if c.State.Running {
+			state = "running"
+		}
+		list = append(list, dockertypes.Container{
+			ID:     c.ID,
+			Names:  []string{c.Name},
+			Image:  c.Config.Image,
+			Labels: c.Config.Labels,
+			State:  state,
+		})
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].ID < list[j].ID })
+
+	json.NewEncoder(w).Encode(list)
+}
+
+func (f *fakeEngine) create(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		*container.Config
+		HostConfig       *container.HostConfig
+		NetworkingConfig *network.NetworkingConfig
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		fakeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	name := r.URL.Query().Get("name")
+	if name != "" && f.lookup(name) != nil {
+		fakeError(w, http.StatusConflict, "name "+name+" is already in use")
+		return
+	}
+
+	f.created++
+	c := &dockertypes.ContainerJSON{
+		ContainerJSONBase: &dockertypes.ContainerJSONBase{
+			ID:         fmt.Sprintf("c%063d", f.created),
+			Name:       "/" + name,
+			State:      &dockertypes.ContainerState{},
+			HostConfig: body.HostConfig,
+		},
+		Config: body.Config,
+	}
+	f.containers[c.ID] = c
+	f.calls = append(f.calls, "create "+body.Config.Image)
+
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(container.ContainerCreateCreatedBody{ID: c.ID})
+}
+
+// record adds the call naming the container by its name
+func (f *fakeEngine) record(kind string, c *dockertypes.ContainerJSON, args ...string) {
+	call := append([]string{kind, strings.TrimPrefix(c.Name, "/")}, args...)
+	f.calls = append(f.calls, strings.Join(call, " "))
+}
+
+func fakeError(w http.ResponseWriter, status int, msg string) {
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{"message": msg})
+}
@@ -0,0 +1,189 @@
+package handler
+
+import (
+	"context"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/Sirupsen/logrus"
+	dockertypes "github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/network"
+)
+
+const (
+	composeProjectLabel   = "com.docker.compose.project"
+	composeServiceLabel   = "com.docker.compose.service"
+	composeNumberLabel    = "com.docker.compose.container-number"
+	composeDependsOnLabel = "com.docker.compose.depends_on"
+
+	// composeOldSuffix is appended to the name of a compose container
+	// while it is being replaced so the new container can take its name
+	composeOldSuffix = "_conduit-old"
+)
+
+func isCompose(labels map[string]string) bool {
+	return labels[composeProjectLabel] != "" && labels[composeServiceLabel] != ""
+}
+
+// composeDependencies returns the services the compose service depends on.
+// The label is written by compose as a comma separated list of
+// "service:condition:restart" entries.
+func composeDependencies(labels map[string]string) []string {
+	deps := []string{}
+	v := labels[composeDependsOnLabel]
+	if v == "" {
+		return deps
+	}
+
+	for _, d := range strings.Split(v, ",") {
+		name := strings.TrimSpace(strings.SplitN(d, ":", 2)[0])
+		if name != "" {
+			deps = append(deps, name)
+		}
+	}
+
+	return deps
+}
+
+// orderTargets sorts the deploy targets so that containers are rotated
+// after the containers whose namespaces or volumes they share or link to,
+// and compose services after the services they depend on in the same
+// project.  Containers of the same service keep their container number
+// order.
+func orderTargets(targets []*deployTarget) []*deployTarget {
+	containerDepth := dependencyDepth(targets)
+
+	services := map[string]bool{}
+	for _, t := range targets {
+		if isCompose(t.Container.Labels) {
+			services[composeKey(t.Container.Labels[composeProjectLabel], t.Container.Labels[composeServiceLabel])] = true
+		}
+	}
+
+	depth := map[string]int{}
+	var serviceDepth func(project, service string, seen map[string]bool) int
+	serviceDepth = func(project, service string, seen map[string]bool) int {
+		key := composeKey(project, service)
+		if d, ok := depth[key]; ok {
+			return d
+		}
+		if seen[key] {
+			// dependency cycle; compose would reject this but do not loop
+			return 0
+		}
+		seen[key] = true
+
+		d := 0
+		for _, t := range targets {
+			l := t.Container.Labels
+			if l[composeProjectLabel] != project || l[composeServiceLabel] != service {
+				continue
+			}
+			for _, dep := range composeDependencies(l) {
+				if !services[composeKey(project, dep)] {
+					continue
+				}
+				if n := serviceDepth(project, dep, seen) + 1; n > d {
+					d = n
+				}
+			}
+			break
+		}
+
+		depth[key] = d
+		return d
+	}
+
+	targetDepth := func(t *deployTarget) int {
+		if !isCompose(t.Container.Labels) {
+			return 0
+		}
+		return serviceDepth(t.Container.Labels[composeProjectLabel], t.Container.Labels[composeServiceLabel], map[string]bool{})
+	}
+
+	ordered := make([]*deployTarget, len(targets))
+	copy(ordered, targets)
+	sort.SliceStable(ordered, func(i, j int) bool {
+		if ci, cj := containerDepth(ordered[i]), containerDepth(ordered[j]); ci != cj {
+			return ci < cj
+		}
+		di, dj := targetDepth(ordered[i]), targetDepth(ordered[j])
+		if di != dj {
+			return di < dj
+		}
+		return composeNumber(ordered[i].Container.Labels) < composeNumber(ordered[j].Container.Labels)
+	})
+
+	return ordered
+}
+
+func composeNumber(labels map[string]string) int {
+	n, err := strconv.Atoi(labels[composeNumberLabel])
+	if err != nil {
+		return 0
+	}
+
+	return n
+}
+
+func composeKey(project, service string) string {
+	return project + "/" + service
+}
+
+// composeNetworking returns the endpoint settings for the container
+// networks so the replacement keeps the service aliases compose
+// configured.  Docker only accepts a single network on create so the
+// network for the network mode is returned separately from the others
+// which must be connected before the container is started.
+func composeNetworking(cfg dockertypes.ContainerJSON) (*network.NetworkingConfig, map[string]*network.EndpointSettings) {
+	primary := &network.NetworkingConfig{
+		EndpointsConfig: map[string]*network.EndpointSettings{},
+	}
+	extra := map[string]*network.EndpointSettings{}
+
+	if cfg.NetworkSettings == nil {
+		return primary, extra
+	}
+
+	mode := string(cfg.HostConfig.NetworkMode)
+	if cfg.HostConfig.NetworkMode.IsDefault() {
+		mode = "bridge"
+	}
+	for name, ep := range cfg.NetworkSettings.Networks {
+		settings := &network.EndpointSettings{
+			IPAMConfig: ep.IPAMConfig,
+			Links:      ep.Links,
+		}
+		for _, a := range ep.Aliases {
+			// the engine adds the short container id as an alias
+			if len(cfg.ID) >= 12 && a == cfg.ID[:12] {
+				continue
+			}
+			settings.Aliases = append(settings.Aliases, a)
+		}
+
+		if name == mode {
+			primary.EndpointsConfig[name] = settings
+			continue
+		}
+		extra[name] = settings
+	}
+
+	return primary, extra
+}
+
+// connectNetworks attaches the container to the additional compose networks
+func (h *Handler) connectNetworks(ctx context.Context, e *engine, id string, networks map[string]*network.EndpointSettings) error {
+	for name, ep := range networks {
+		logrus.WithFields(logrus.Fields{
+			"container": id[:10],
+			"network":   name,
+		}).Debug("connecting container to network")
+		if err := e.client.NetworkConnect(ctx, name, id, ep); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
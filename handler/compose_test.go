@@ -0,0 +1,109 @@
+package handler
+
+import (
+	"reflect"
+	"testing"
+
+	dockertypes "github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/network"
+)
+
+func TestComposeNetworking(t *testing.T) {
+	id := "a1cafe0db123456789abcdef"
+	ipam := &network.EndpointIPAMConfig{IPv4Address: "172.20.0.5"}
+
+	tests := []struct {
+		name     string
+		mode     container.NetworkMode
+		networks map[string]*network.EndpointSettings
+		primary  map[string][]string
+		extra    map[string][]string
+	}{
+		{
+			name: "engine alias dropped",
+			mode: "app_default",
+			networks: map[string]*network.EndpointSettings{
+				"app_default": {Aliases: []string{"web", id[:12]}},
+			},
+			primary: map[string][]string{"app_default": {"web"}},
+			extra:   map[string][]string{},
+		},
+		{
+			name: "aliases that prefix the id are kept",
+			mode: "app_default",
+			networks: map[string]*network.EndpointSettings{
+				"app_default": {Aliases: []string{"a1", "a1cafe", "db", id[:12]}},
+			},
+			primary: map[string][]string{"app_default": {"a1", "a1cafe", "db"}},
+			extra:   map[string][]string{},
+		},
+		{
+			name: "additional networks",
+			mode: "app_front",
+			networks: map[string]*network.EndpointSettings{
+				"app_front": {Aliases: []string{"web"}},
+				"app_back":  {Aliases: []string{"api", id[:12]}, IPAMConfig: ipam},
+			},
+			primary: map[string][]string{"app_front": {"web"}},
+			extra:   map[string][]string{"app_back": {"api"}},
+		},
+		{
+			name: "default network mode is bridge",
+			mode: "default",
+			networks: map[string]*network.EndpointSettings{
+				"bridge": {},
+			},
+			primary: map[string][]string{"bridge": nil},
+			extra:   map[string][]string{},
+		},
+	}
+
+	for _, tt := range tests {
+		cfg := dockertypes.ContainerJSON{
+			ContainerJSONBase: &dockertypes.ContainerJSONBase{
+				ID:         id,
+				HostConfig: &container.HostConfig{NetworkMode: tt.mode},
+			},
+			NetworkSettings: &dockertypes.NetworkSettings{
+				Networks: tt.networks,
+			},
+		}
+
+		primary, extra := composeNetworking(cfg)
+		if got := endpointAliases(primary.EndpointsConfig); !reflect.DeepEqual(got, tt.primary) {
+			t.Errorf("%s: primary aliases = %v, want %v", tt.name, got, tt.primary)
+		}
+		if got := endpointAliases(extra); !reflect.DeepEqual(got, tt.extra) {
+			t.Errorf("%s: extra aliases = %v, want %v", tt.name, got, tt.extra)
+		}
+		for name, ep := range extra {
+			if ep.IPAMConfig != tt.networks[name].IPAMConfig {
+				t.Errorf("%s: network %s lost its ipam config", tt.name, name)
+			}
+		}
+	}
+}
+
+func TestComposeNetworkingWithoutSettings(t *testing.T) {
+	cfg := dockertypes.ContainerJSON{
+		ContainerJSONBase: &dockertypes.ContainerJSONBase{
+			ID:         "a1cafe0db123456789abcdef",
+			HostConfig: &container.HostConfig{},
+		},
+	}
+
+	primary, extra := composeNetworking(cfg)
+	if len(primary.EndpointsConfig) != 0 || len(extra) != 0 {
+		t.Errorf("composeNetworking = %v, %v, want no networks", primary.EndpointsConfig, extra)
+	}
+}
+
+func endpointAliases(endpoints map[string]*network.EndpointSettings) map[string][]string {
+	aliases := map[string][]string{}
+	for name, ep := range endpoints {
+		aliases[name] = ep.Aliases
+	}
+
+	return aliases
+}
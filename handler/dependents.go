@@ -0,0 +1,297 @@
+package handler
+
+import (
+	"context"
+	"path"
+	"strings"
+
+	"github.com/Sirupsen/logrus"
+	dockertypes "github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+)
+
+// replacement is a container replaced during a deploy.  Containers that
+// depend on the old container are recreated to use the new one.
+type replacement struct {
+	Engine  string
+	OldID   string
+	OldName string
+	NewID   string
+}
+
+// replacement returns the replacement of the rotated target
+func (t *deployTarget) replacement() replacement {
+	return replacement{
+		Engine:  t.Engine.Name,
+		OldID:   t.Container.ID,
+		OldName: strings.TrimPrefix(t.Info.Name, "/"),
+		NewID:   t.NewID,
+	}
+}
+
+// containerDependencies returns the containers the host config refers to:
+// the containers whose network, ipc or pid namespace is shared, whose
+// volumes are mounted and the legacy links
+func containerDependencies(hc *container.HostConfig) []string {
+	if hc == nil {
+		return nil
+	}
+
+	refs := []string{}
+	for _, mode := range []string{string(hc.NetworkMode), string(hc.IpcMode), string(hc.PidMode)} {
+		if strings.HasPrefix(mode, "container:") {
+			refs = append(refs, strings.TrimPrefix(mode, "container:"))
+		}
+	}
+	for _, from := range hc.VolumesFrom {
+		refs = append(refs, strings.SplitN(from, ":", 2)[0])
+	}
+	for _, link := range hc.Links {
+		refs = append(refs, linkContainer(link))
+	}
+
+	return refs
+}
+
+// linkContainer returns the linked container of a link in the name:alias
+// form or as reported by inspect (i.e. "/db:/web/db")
+func linkContainer(link string) string {
+	return strings.TrimPrefix(strings.SplitN(link, ":", 2)[0], "/")
+}
+
+// linkAlias returns the alias of a link
+func linkAlias(link string) string {
+	parts := strings.SplitN(link, ":", 2)
+	if len(parts) == 1 {
+		return linkContainer(link)
+	}
+
+	return path.Base(parts[1])
+}
+
+// refersTo reports whether the reference is the name, id or id prefix of
+// the container
+func refersTo(ref, id, name string) bool {
+	ref = strings.TrimPrefix(ref, "/")
+	if ref == "" {
+		return false
+	}
+	if ref == strings.TrimPrefix(name, "/") {
+		return true
+	}
+
+	return strings.Trim(ref, "0123456789abcdef") == "" && strings.HasPrefix(id, ref)
+}
+
+// replacedBy returns the new container of the replaced container the
+// reference refers to on the engine
+func replacedBy(replaced []replacement, engine, ref string) (string, bool) {
+	for _, r := range replaced {
+		if r.Engine == engine && refersTo(ref, r.OldID, r.OldName) {
+			return r.NewID, true
+		}
+	}
+
+	return "", false
+}
+
+// rewriteDependencies returns a copy of the host config with the
+// references to replaced containers pointing at their new containers
+func rewriteDependencies(hc *container.HostConfig, engine string, replaced []replacement) *container.HostConfig {
+	if hc == nil || len(replaced) == 0 {
+		return hc
+	}
+
+	rewritten := *hc
+
+	if mode := string(hc.NetworkMode); strings.HasPrefix(mode, "container:") {
+		if id, ok := replacedBy(replaced, engine, strings.TrimPrefix(mode, "container:")); ok {
+			rewritten.NetworkMode = container.NetworkMode("container:" + id)
+		}
+	}
+	if mode := string(hc.IpcMode); strings.HasPrefix(mode, "container:") {
+		if id, ok := replacedBy(replaced, engine, strings.TrimPrefix(mode, "container:")); ok {
+			rewritten.IpcMode = container.IpcMode("container:" + id)
+		}
+	}
+	if mode := string(hc.PidMode); strings.HasPrefix(mode, "container:") {
+		if id, ok := replacedBy(replaced, engine, strings.TrimPrefix(mode, "container:")); ok {
+			rewritten.PidMode = container.PidMode("container:" + id)
+		}
+	}
+
+	rewritten.VolumesFrom = []string{}
+	for _, from := range hc.VolumesFrom {
+		parts := strings.SplitN(from, ":", 2)
+		if id, ok := replacedBy(replaced, engine, parts[0]); ok {
+			parts[0] = id
+		}
+		rewritten.VolumesFrom = append(rewritten.VolumesFrom, strings.Join(parts, ":"))
+	}
+
+	rewritten.Links = []string{}
+	for _, link := range hc.Links {
+		if id, ok := replacedBy(replaced, engine, linkContainer(link)); ok {
+			link = id + ":" + linkAlias(link)
+		}
+		rewritten.Links = append(rewritten.Links, link)
+	}
+
+	return &rewritten
+}
+
+// dependencyDepth returns the number of targets on the same engine that
+// must be rotated before the target because it depends on them
+func dependencyDepth(targets []*deployTarget) func(t *deployTarget) int {
+	depth := map[*deployTarget]int{}
+
+	var targetDepth func(t *deployTarget, seen map[*deployTarget]bool) int
+	targetDepth = func(t *deployTarget, seen map[*deployTarget]bool) int {
+		if d, ok := depth[t]; ok {
+			return d
+		}
+		if seen[t] {
+			// dependency cycle; docker rejects most but do not loop
+			return 0
+		}
+		seen[t] = true
+
+		d := 0
+		for _, ref := range containerDependencies(t.Info.HostConfig) {
+			for _, dep := range targets {
+				if dep == t || dep.Engine != t.Engine || !refersTo(ref, dep.Container.ID, dep.Info.Name) {
+					continue
+				}
+				if n := targetDepth(dep, seen) + 1; n > d {
+					d = n
+				}
+			}
+		}
+
+		depth[t] = d
+		return d
+	}
+
+	return func(t *deployTarget) int {
+		return targetDepth(t, map[*deployTarget]bool{})
+	}
+}
+
+// rotateDependents recreates the containers that depend on the rotated
+// target, and in turn their dependents, so they use the replacement.
+// Dependents that are targets of the deploy are rotated in order instead.
+// The recreated dependents and the updated replacements are returned.
+func (h *Handler) rotateDependents(ctx context.Context, t *deployTarget, targets []*deployTarget, replaced []replacement) ([]*deployTarget, []replacement, error) {
+	rotated := []*deployTarget{}
+	queue := []*deployTarget{t}
+	for len(queue) > 0 {
+		p := queue[0]
+		queue = queue[1:]
+
+		dependents, err := h.dependentTargets(ctx, p, targets, replaced)
+		if err != nil {
+			return rotated, replaced, err
+		}
+
+		for _, d := range dependents {
+			logrus.WithFields(logrus.Fields{
+				"container": shortID(d.Container.ID),
+				"engine":    d.Engine.Name,
+				"depends":   shortID(p.Container.ID),
+			}).Info("recreating dependent container")
+
+			d.DeploymentID = t.DeploymentID
+			d.DeferRetire = t.DeferRetire
+			d.Replaced = replaced
+			if err := h.rotate(ctx, d); err != nil {
+				return rotated, replaced, err
+			}
+
+			replaced = append(replaced, d.replacement())
+			rotated = append(rotated, d)
+			queue = append(queue, d)
+		}
+	}
+
+	return rotated, replaced, nil
+}
+
+// dependentTargets returns the containers to recreate because they depend
+// on the rotated target.  Targets of the deploy, containers created by the
+// deploy and previous containers kept for rollback are skipped.
+func (h *Handler) dependentTargets(ctx context.Context, t *deployTarget, targets []*deployTarget, replaced []replacement) ([]*deployTarget, error) {
+	e := t.Engine
+
+	containers, err := e.inventory.dependents(t.Container.ID, t.Info.Name)
+	if err != nil {
+		return nil, err
+	}
+
+	dependents := []*deployTarget{}
+	for _, c := range containers {
+		if isTarget(targets, e, c.ID) || isReplacement(replaced, e, c.ID) || h.isRetained(c) {
+			continue
+		}
+
+		if !h.isEnabled(c) {
+			logrus.WithFields(logrus.Fields{
+				"container": shortID(c.ID),
+				"depends":   shortID(t.Container.ID),
+			}).Warn("dependent container is not enabled for conduit; not recreating")
+			continue
+		}
+
+		info, err := e.client.ContainerInspect(ctx, c.ID)
+		if err != nil {
+			return nil, err
+		}
+
+		repo, _ := parseImage(c.Image)
+		opts, err := h.containerOptions(repo, info.Config)
+		if err != nil {
+			return nil, err
+		}
+
+		dependents = append(dependents, &deployTarget{
+			Engine:    e,
+			Container: c,
+			Info:      info,
+			Options:   opts,
+			Image:     h.currentImage(ctx, e, info),
+		})
+	}
+
+	return dependents, nil
+}
+
+// currentImage returns the image to recreate the container with so that
+// it keeps running the same image.  The image the container was created
+// with is used unless its tag has since moved to another image.
+func (h *Handler) currentImage(ctx context.Context, e *engine, info dockertypes.ContainerJSON) string {
+	img, _, err := e.client.ImageInspectWithRaw(ctx, info.Config.Image)
+	if err == nil && img.ID == info.Image {
+		return info.Config.Image
+	}
+
+	return info.Image
+}
+
+func isTarget(targets []*deployTarget, e *engine, id string) bool {
+	for _, t := range targets {
+		if t.Engine == e && t.Container.ID == id {
+			return true
+		}
+	}
+
+	return false
+}
+
+func isReplacement(replaced []replacement, e *engine, id string) bool {
+	for _, r := range replaced {
+		if r.Engine == e.Name && r.NewID == id {
+			return true
+		}
+	}
+
+	return false
+}
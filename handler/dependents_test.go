@@ -0,0 +1,176 @@
+package handler
+
+import (
+	"reflect"
+	"testing"
+
+	dockertypes "github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+)
+
+func TestContainerDependencies(t *testing.T) {
+	tests := []struct {
+		hc   *container.HostConfig
+		want []string
+	}{
+		{nil, nil},
+		{&container.HostConfig{NetworkMode: "bridge"}, []string{}},
+		{
+			&container.HostConfig{
+				NetworkMode: "container:db",
+				IpcMode:     "container:0123abcd",
+				PidMode:     "host",
+				VolumesFrom: []string{"data:ro", "logs"},
+				Links:       []string{"/cache:/web/cache", "queue:q"},
+			},
+			[]string{"db", "0123abcd", "data", "logs", "cache", "queue"},
+		},
+	}
+
+	for _, tt := range tests {
+		if got := containerDependencies(tt.hc); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("containerDependencies(%+v) = %v, want %v", tt.hc, got, tt.want)
+		}
+	}
+}
+
+func TestRefersTo(t *testing.T) {
+	id := "0123456789abcdef0123456789abcdef"
+	tests := []struct {
+		ref  string
+		want bool
+	}{
+		{"db", true},
+		{"/db", true},
+		{"0123456789ab", true},
+		{id, true},
+		{"0123x", false},
+		{"abcdef", false},
+		{"web", false},
+		{"", false},
+	}
+
+	for _, tt := range tests {
+		if got := refersTo(tt.ref, id, "/db"); got != tt.want {
+			t.Errorf("refersTo(%q) = %t, want %t", tt.ref, got, tt.want)
+		}
+	}
+}
+
+func TestRewriteDependencies(t *testing.T) {
+	replaced := []replacement{
+		{Engine: "local", OldID: "aaaa0000", OldName: "db", NewID: "bbbb1111"},
+		{Engine: "remote", OldID: "cccc0000", OldName: "cache", NewID: "dddd1111"},
+	}
+
+	tests := []struct {
+		name string
+		hc   *container.HostConfig
+		want *container.HostConfig
+	}{
+		{
+			name: "namespaces by name and id",
+			hc: &container.HostConfig{
+				NetworkMode: "container:db",
+				IpcMode:     "container:aaaa",
+				PidMode:     "container:other",
+			},
+			want: &container.HostConfig{
+				NetworkMode: "container:bbbb1111",
+				IpcMode:     "container:bbbb1111",
+				PidMode:     "container:other",
+				VolumesFrom: []string{},
+				Links:       []string{},
+			},
+		},
+		{
+			name: "volumes and links keep their options",
+			hc: &container.HostConfig{
+				NetworkMode: "bridge",
+				VolumesFrom: []string{"db:ro", "other"},
+				Links:       []string{"/db:/web/database", "other:o"},
+			},
+			want: &container.HostConfig{
+				NetworkMode: "bridge",
+				VolumesFrom: []string{"bbbb1111:ro", "other"},
+				Links:       []string{"bbbb1111:database", "other:o"},
+			},
+		},
+		{
+			name: "replacements on other engines are ignored",
+			hc: &container.HostConfig{
+				NetworkMode: "container:cache",
+			},
+			want: &container.HostConfig{
+				NetworkMode: "container:cache",
+				VolumesFrom: []string{},
+				Links:       []string{},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		got := rewriteDependencies(tt.hc, "local", replaced)
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: rewriteDependencies = %+v, want %+v", tt.name, got, tt.want)
+		}
+	}
+
+	hc := &container.HostConfig{NetworkMode: "container:db"}
+	if got := rewriteDependencies(hc, "local", nil); got != hc {
+		t.Error("rewriteDependencies without replacements did not return the host config")
+	}
+	if string(hc.NetworkMode) != "container:db" {
+		t.Error("rewriteDependencies changed the original host config")
+	}
+}
+
+func TestDependencyDepth(t *testing.T) {
+	local := &engine{Name: "local"}
+	remote := &engine{Name: "remote"}
+
+	target := func(e *engine, id, name string, hc container.HostConfig) *deployTarget {
+		return &deployTarget{
+			Engine:    e,
+			Container: dockertypes.Container{ID: id},
+			Info: dockertypes.ContainerJSON{
+				ContainerJSONBase: &dockertypes.ContainerJSONBase{
+					ID:         id,
+					Name:       "/" + name,
+					HostConfig: &hc,
+				},
+			},
+		}
+	}
+
+	db := target(local, "aaaa0000", "db", container.HostConfig{})
+	app := target(local, "bbbb0000", "app", container.HostConfig{NetworkMode: "container:db"})
+	sidecar := target(local, "cccc0000", "sidecar", container.HostConfig{VolumesFrom: []string{"app"}, Links: []string{"db:db"}})
+	other := target(remote, "dddd0000", "other", container.HostConfig{NetworkMode: "container:db"})
+	// a dependency cycle must not loop
+	ping := target(local, "eeee0000", "ping", container.HostConfig{NetworkMode: "container:pong"})
+	pong := target(local, "ffff0000", "pong", container.HostConfig{NetworkMode: "container:ping"})
+
+	depth := dependencyDepth([]*deployTarget{sidecar, app, db, other, ping, pong})
+
+	tests := []struct {
+		t    *deployTarget
+		want int
+	}{
+		{db, 0},
+		{app, 1},
+		{sidecar, 2},
+		{other, 0},
+	}
+	for _, tt := range tests {
+		if got := depth(tt.t); got != tt.want {
+			t.Errorf("dependencyDepth(%s) = %d, want %d", tt.t.Info.Name, got, tt.want)
+		}
+	}
+
+	for _, c := range []*deployTarget{ping, pong} {
+		if d := depth(c); d > 2 {
+			t.Errorf("dependencyDepth(%s) = %d in a cycle of two, want at most 2", c.Info.Name, d)
+		}
+	}
+}
@@ -0,0 +1,645 @@
+package handler
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	dockertypes "github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/network"
+	"github.com/docker/docker/client"
+	"github.com/ehazlett/conduit/notify"
+	"github.com/ehazlett/conduit/policy"
+	"github.com/ehazlett/conduit/types"
+)
+
+// deployTarget is a container selected for rotation along with the
+// options used to rotate it
+type deployTarget struct {
+	Engine    *engine
+	Container dockertypes.Container
+	// Info is the container as inspected when the deploy was planned
+	Info    dockertypes.ContainerJSON
+	Options *deployOptions
+	// Image is the image the container is replaced with
+	Image string
+	// KeepOld stops the old container instead of removing it so that it
+	// can be restored, i.e. when the replacement is a canary
+	KeepOld bool
+	// DeferRetire keeps the old container stopped until the deploy has
+	// rotated every container so that an aborted deploy can restore it
+	DeferRetire bool
+	// DeploymentID labels the replacement container
+	DeploymentID string
+	// NewID is set once the replacement container is created
+	NewID string
+	// Group is the container group the container is rotated with
+	Group string
+	// Replaced are the containers replaced earlier in the deploy; the
+	// references of the container to them are pointed at their new
+	// containers
+	Replaced []replacement
+	// Spec replaces the configuration of the old container when the
+	// container of a manifest service is reconciled
+	Spec *serviceContainer
+}
+
+// deploy rotates the containers for the repository on the engines of the
+// group (all engines when empty).  tag is the pushed tag; when empty
+// containers are redeployed with their current tag.  The replacement
+// containers are labeled with the deployment id.  When ctx is done the
+// current step is aborted and the containers already replaced are rolled
+// back.
+func (h *Handler) deploy(ctx context.Context, repo, tag, group, deploymentID string, dryRun bool) (plan *types.DeployPlan, err error) {
+	if !dryRun {
+		start := time.Now()
+		defer func() {
+			outcome := outcomeSuccess
+			if err != nil {
+				outcome = outcomeError
+			}
+			deployDuration.Observe(time.Since(start).Seconds(), repo, outcome)
+		}()
+	}
+
+	logrus.WithFields(logrus.Fields{
+		"name":    repo,
+		"tag":     tag,
+		"group":   group,
+		"dry_run": dryRun,
+	}).Info("deploying")
+
+	plan, targets, err := h.planDeploy(ctx, repo, tag, group)
+	if err != nil {
+		return nil, err
+	}
+	plan.DryRun = dryRun
+
+	if h.config.Preflight {
+		if err := h.preflight(ctx, plan, targets); err != nil {
+			if !dryRun {
+				return plan, err
+			}
+			plan.Preflight = err.Error()
+		}
+	}
+
+	if dryRun {
+		logrus.WithFields(logrus.Fields{
+			"name":       repo,
+			"images":     plan.Images,
+			"containers": len(plan.Containers),
+		}).Info("dry run; not deploying")
+		return plan, nil
+	}
+
+	if err := h.pullTargets(ctx, targets); err != nil {
+		return plan, err
+	}
+
+	canary := h.canaryConfig(repo)
+	done := []*deployTarget{}
+	replaced := []replacement{}
+	for i, unit := range deployUnits(targets) {
+		for _, t := range unit {
+			t.DeploymentID = deploymentID
+			t.DeferRetire = true
+		}
+
+		t := unit[0]
+		switch {
+		case t.Group != "":
+			replaced, err = h.rotateGroup(ctx, unit, replaced)
+		case i == 0 && canary != nil:
+			t.Replaced = replaced
+			err = h.rotateCanary(ctx, t, canary)
+		default:
+			t.Replaced = replaced
+			err = h.rotate(ctx, t)
+		}
+		if err == nil {
+			done = append(done, unit...)
+			if t.Group == "" {
+				replaced = append(replaced, t.replacement())
+			}
+
+			for _, u := range unit {
+				var dependents []*deployTarget
+				dependents, replaced, err = h.rotateDependents(ctx, u, targets, replaced)
+				done = append(done, dependents...)
+				if err != nil {
+					break
+				}
+			}
+		}
+		if err != nil {
+			if ctx.Err() != nil {
+				h.rollbackTargets(done)
+			} else {
+				h.retireTargets(done)
+			}
+			return plan, err
+		}
+	}
+
+	// every container is rotated so the old containers are taken out of
+	// service even if ctx is done by now
+	for _, t := range done {
+		if err := h.retireContainer(context.Background(), t); err != nil {
+			return plan, err
+		}
+	}
+
+	return plan, nil
+}
+
+// planDeploy selects the containers to rotate for the repository on the
+// engines of the group in the order they will be rotated.  It does not
+// change any containers.
+func (h *Handler) planDeploy(ctx context.Context, repo, pushedTag, group string) (*types.DeployPlan, []*deployTarget, error) {
+	p, err := h.policy(repo)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	engines := h.groupEngines(group)
+	if len(engines) == 0 {
+		return nil, nil, fmt.Errorf("no engines in group %s", group)
+	}
+
+	plan := &types.DeployPlan{
+		Repository: repo,
+		Engines:    []string{},
+		Images:     []string{},
+		Containers: []types.PlannedRotation{},
+	}
+	targets := []*deployTarget{}
+	for _, e := range engines {
+		plan.Engines = append(plan.Engines, e.Name)
+
+		engineTargets, err := h.engineTargets(ctx, e, repo, pushedTag, p)
+		if err != nil {
+			return nil, nil, fmt.Errorf("engine %s: %s", e.Name, err)
+		}
+
+		engineTargets, err = h.groupTargets(ctx, e, engineTargets)
+		if err != nil {
+			return nil, nil, fmt.Errorf("engine %s: %s", e.Name, err)
+		}
+
+		for _, t := range orderGroups(orderTargets(engineTargets)) {
+			cfg := t.Info
+			img, _, err := e.client.ImageInspectWithRaw(ctx, cfg.Image)
+			if err != nil {
+				return nil, nil, err
+			}
+
+			if !containsString(plan.Images, t.Image) {
+				plan.Images = append(plan.Images, t.Image)
+			}
+
+			plan.Containers = append(plan.Containers, types.PlannedRotation{
+				ID:        t.Container.ID,
+				Engine:    e.Name,
+				Name:      strings.TrimPrefix(cfg.Name, "/"),
+				Image:     t.Container.Image,
+				Target:    t.Image,
+				ImageID:   cfg.Image,
+				Digests:   img.RepoDigests,
+				Strategy:  t.Options.Strategy,
+				StopFirst: isStopFirst(t.Options, cfg.HostConfig),
+				Group:     t.Group,
+			})
+			targets = append(targets, t)
+		}
+	}
+
+	// container groups are not rotated as canaries
+	if h.canaryConfig(repo) != nil && len(plan.Containers) > 0 && plan.Containers[0].Group == "" {
+		plan.Containers[0].Canary = true
+	}
+
+	return plan, targets, nil
+}
+
+// engineTargets selects the containers of the engine to rotate
+func (h *Handler) engineTargets(ctx context.Context, e *engine, repo, pushedTag string, p policy.Policy) ([]*deployTarget, error) {
+	containers, err := e.inventory.repository(repo, false)
+	if err != nil {
+		return nil, fmt.Errorf("engine %s: %s", e.Name, err)
+	}
+
+	logrus.WithFields(logrus.Fields{
+		"name":      repo,
+		"engine":    e.Name,
+		"instances": len(containers),
+	}).Debugf("checking containers for repository")
+
+	targets := []*deployTarget{}
+	for _, c := range containers {
+		image := c.Image
+
+		logrus.WithFields(logrus.Fields{
+			"repo":  repo,
+			"image": image,
+		}).Debugf("checking image for repo")
+
+		imageRepo, tag := parseImage(image)
+		if imageRepo != repo {
+			logrus.WithFields(logrus.Fields{
+				"image": image,
+				"repo":  repo,
+			}).Debug("container image does not match repo")
+			continue
+		}
+
+		if !h.isEnabled(c) {
+			logrus.WithFields(logrus.Fields{
+				"container": c.ID[:10],
+				"image":     image,
+			}).Debug("container is not enabled for conduit")
+			continue
+		}
+
+		info, err := e.client.ContainerInspect(ctx, c.ID)
+		if err != nil {
+			// removed since the inventory was updated
+			if client.IsErrContainerNotFound(err) {
+				continue
+			}
+			return nil, err
+		}
+
+		opts, err := h.containerOptions(repo, info.Config)
+		if err != nil {
+			return nil, err
+		}
+
+		// a hook without a tag only redeploys the containers of the
+		// default tag unless the repository config allows more tags
+		if pushedTag == "" && tag != defaultTag && len(opts.Tags) == 0 && !h.allowsOtherTags(repo) {
+			logrus.WithFields(logrus.Fields{
+				"container": c.ID[:10],
+				"image":     image,
+			}).Debug("container tag does not match the default tag")
+			continue
+		}
+
+		if len(opts.Tags) > 0 && !containsString(opts.Tags, tag) {
+			logrus.WithFields(logrus.Fields{
+				"container": c.ID[:10],
+				"image":     image,
+				"tags":      opts.Tags,
+			}).Debug("container tag is not enabled for deploy")
+			continue
+		}
+
+		target := image
+		if pushedTag != "" {
+			if !p.Match(tag, pushedTag) {
+				logrus.WithFields(logrus.Fields{
+					"container": c.ID[:10],
+					"image":     image,
+					"pushed":    pushedTag,
+				}).Debug("pushed tag does not match update policy")
+				continue
+			}
+			target = repo + ":" + pushedTag
+		}
+
+		targets = append(targets, &deployTarget{
+			Engine:    e,
+			Container: c,
+			Info:      info,
+			Options:   opts,
+			Image:     target,
+		})
+	}
+
+	return targets, nil
+}
+
+// isStopFirst reports whether the old container must be removed before
+// the new container is started
+func isStopFirst(opts *deployOptions, hostConfig *container.HostConfig) bool {
+	switch opts.Strategy {
+	case StrategyStopFirst:
+		return true
+	case StrategyAuto:
+		// check for port bindings; if exist, stop/remove container first
+		// so new container can bind to specified ports; otherwise
+		// allow the container to start first and allocate random ports
+		return len(hostConfig.PortBindings) > 0
+	}
+
+	return false
+}
+
+// rotate replaces the container with a new one created from the same
+// configuration using the target image.  The image must already have been
+// pulled by pullTargets.  The old container is restored when ctx is done
+// before the rotation completes.
+func (h *Handler) rotate(ctx context.Context, t *deployTarget) (err error) {
+	e := t.Engine
+	c := t.Container
+	opts := t.Options
+	image := t.Image
+
+	logrus.WithFields(logrus.Fields{
+		"image":    image,
+		"strategy": opts.Strategy,
+	}).Debug("deploying")
+
+	cID := c.ID[:10]
+	logrus.WithFields(logrus.Fields{
+		"container": cID,
+		"engine":    e.Name,
+	}).Info("deploying new image for container")
+
+	logrus.WithFields(logrus.Fields{
+		"container": cID,
+	}).Debug("creating new container")
+
+	cfg, err := e.client.ContainerInspect(ctx, c.ID)
+	if err != nil {
+		return err
+	}
+
+	// reset hostname to get new id
+	cfg.Config.Hostname = ""
+
+	// compose containers keep their name, labels and networks so that
+	// compose continues to recognize the replacement as the service
+	name := ""
+	var networkingConfig *network.NetworkingConfig
+	extraNetworks := map[string]*network.EndpointSettings{}
+	compose := isCompose(cfg.Config.Labels)
+	if compose {
+		name = strings.TrimPrefix(cfg.Name, "/")
+		networkingConfig, extraNetworks = composeNetworking(cfg)
+	}
+
+	rot := &rotation{
+		ID:               newID(),
+		Engine:           e.Name,
+		OldID:            c.ID,
+		Name:             strings.TrimPrefix(cfg.Name, "/"),
+		Compose:          compose,
+		ImageID:          cfg.Image,
+		Config:           cfg.Config,
+		HostConfig:       cfg.HostConfig,
+		NetworkingConfig: networkingConfig,
+		ExtraNetworks:    extraNetworks,
+		StopTimeout:      opts.StopTimeout,
+		StopSignal:       opts.StopSignal,
+		KeepVolumes:      opts.KeepVolumes,
+		Started:          time.Now(),
+	}
+	if err := h.writeJournal(rot, stepBegin); err != nil {
+		return err
+	}
+	defer func() {
+		h.endRotation(rot, err, ctx.Err() != nil)
+	}()
+
+	if compose {
+		logrus.WithFields(logrus.Fields{
+			"container": cID,
+			"project":   cfg.Config.Labels[composeProjectLabel],
+			"service":   cfg.Config.Labels[composeServiceLabel],
+		}).Debug("renaming compose container for replacement")
+		if err := e.client.ContainerRename(ctx, c.ID, name+composeOldSuffix); err != nil {
+			return err
+		}
+	}
+
+	// restoreName gives the compose container its name back when the
+	// replacement fails and the old container is kept
+	restoreName := func() {
+		if !compose {
+			return
+		}
+		if err := e.client.ContainerRename(context.Background(), c.ID, name); err != nil {
+			logrus.Error(err)
+		}
+	}
+
+	// the replacement uses the target image which may be a different tag
+	// than the old container was created with
+	config := *cfg.Config
+	config.Image = image
+	config.Labels = replacementLabels(cfg, t.DeploymentID)
+
+	hostConfig := cfg.HostConfig
+	if t.Spec != nil {
+		config = *t.Spec.Config
+		config.Labels = specLabels(t.Spec, cfg, t.DeploymentID)
+		hostConfig = t.Spec.HostConfig
+		extraNetworks = t.Spec.Networks
+	} else if opts.ReattachVolumes {
+		hostConfig, err = h.reattachVolumes(ctx, e, cfg)
+		if err != nil {
+			restoreName()
+			return err
+		}
+	}
+	config.Labels[labelRotation] = rot.ID
+	hostConfig = rewriteDependencies(hostConfig, e.Name, t.Replaced)
+	if hostConfig.NetworkMode.IsContainer() {
+		// the network settings belong to the container whose network
+		// namespace is shared
+		config.ExposedPorts = nil
+		config.MacAddress = ""
+	}
+
+	resp, err := e.client.ContainerCreate(ctx, &config, hostConfig, networkingConfig, name)
+	if err != nil {
+		restoreName()
+		return err
+	}
+
+	rot.NewID = resp.ID
+	t.NewID = resp.ID
+	if err := h.writeJournal(rot, stepCreated); err != nil {
+		return err
+	}
+
+	if err := h.connectNetworks(ctx, e, resp.ID, extraNetworks); err != nil {
+		if rErr := h.removeContainer(context.Background(), e, resp.ID, opts); rErr != nil {
+			logrus.Error(rErr)
+		}
+		restoreName()
+		return err
+	}
+
+	stopFirst := isStopFirst(opts, cfg.HostConfig)
+
+	// retire takes the old container out of service
+	retire := func() error {
+		if t.KeepOld || t.DeferRetire {
+			return h.stopContainer(ctx, e, c.ID, opts)
+		}
+		return h.retireContainer(ctx, t)
+	}
+
+	if stopFirst {
+		if err := retire(); err != nil {
+			return err
+		}
+		if err := h.writeJournal(rot, stepOldRemoved); err != nil {
+			return err
+		}
+	}
+
+	if err := e.client.ContainerStart(ctx, resp.ID, dockertypes.ContainerStartOptions{}); err != nil {
+		return err
+	}
+	if err := h.writeJournal(rot, stepStarted); err != nil {
+		return err
+	}
+
+	if err := h.waitForHealthy(ctx, e, resp.ID, opts.HealthTimeout); err != nil {
+		// the old container is still running so discard the new one
+		if !stopFirst {
+			repo, _ := parseImage(image)
+			rollbacks.Inc(repo)
+			h.notifier.Send(notify.NewEvent(notify.EventRollback, repo, fmt.Sprintf("container %s was kept running: %s", cID, err)))
+
+			if rErr := h.removeContainer(context.Background(), e, resp.ID, opts); rErr != nil {
+				logrus.Error(rErr)
+			}
+			restoreName()
+		}
+
+		return err
+	}
+
+	if !stopFirst {
+		if err := retire(); err != nil {
+			return err
+		}
+	}
+
+	logrus.WithFields(logrus.Fields{
+		"container": resp.ID[:10],
+	}).Info("started new container")
+
+	return nil
+}
+
+// waitForHealthy waits up to timeout for the container to report healthy.
+// Containers without a healthcheck only need to be running.  A zero
+// timeout disables the check.
+func (h *Handler) waitForHealthy(ctx context.Context, e *engine, id string, timeout time.Duration) error {
+	if timeout == 0 {
+		return nil
+	}
+
+	cID := id[:10]
+	deadline := time.Now().Add(timeout)
+
+	logrus.WithFields(logrus.Fields{
+		"container": cID,
+		"timeout":   timeout,
+	}).Debug("waiting for container to become healthy")
+
+	for {
+		cfg, err := e.client.ContainerInspect(ctx, id)
+		if err != nil {
+			return err
+		}
+
+		state := cfg.State
+		if !state.Running {
+			return fmt.Errorf("container %s exited with code %d", cID, state.ExitCode)
+		}
+
+		if state.Health == nil {
+			return nil
+		}
+
+		switch state.Health.Status {
+		case dockertypes.Healthy:
+			return nil
+		case dockertypes.Unhealthy:
+			return fmt.Errorf("container %s is unhealthy", cID)
+		}
+
+		if time.Now().After(deadline) {
+			return fmt.Errorf("timeout waiting for container %s to become healthy", cID)
+		}
+
+		select {
+		case <-time.After(time.Second):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// stopContainer stops the container.  Without a stop signal override the
+// engine sends the container's own stop signal and kills it after the
+// stop timeout.
+func (h *Handler) stopContainer(ctx context.Context, e *engine, id string, opts *deployOptions) error {
+	cID := id[:10]
+	timeout := opts.StopTimeout
+
+	logrus.WithFields(logrus.Fields{
+		"container": cID,
+		"timeout":   timeout,
+		"signal":    opts.StopSignal,
+	}).Debug("stopping container")
+
+	if opts.StopSignal == "" {
+		return e.client.ContainerStop(ctx, id, &timeout)
+	}
+
+	cfg, err := e.client.ContainerInspect(ctx, id)
+	if err != nil {
+		return err
+	}
+	if !cfg.State.Running {
+		return nil
+	}
+
+	if err := e.client.ContainerKill(ctx, id, opts.StopSignal); err != nil {
+		return err
+	}
+
+	wctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	if _, err := e.client.ContainerWait(wctx, id); err == nil {
+		return nil
+	}
+
+	logrus.WithFields(logrus.Fields{
+		"container": cID,
+	}).Warn("container did not stop after signal; killing")
+
+	kill := time.Duration(0)
+	return e.client.ContainerStop(ctx, id, &kill)
+}
+
+func (h *Handler) removeContainer(ctx context.Context, e *engine, id string, opts *deployOptions) error {
+	cID := id[:10]
+
+	if err := h.stopContainer(ctx, e, id, opts); err != nil {
+		return err
+	}
+
+	logrus.WithFields(logrus.Fields{
+		"container":    cID,
+		"keep_volumes": opts.KeepVolumes,
+	}).Debug("removing container")
+	if err := e.client.ContainerRemove(ctx, id, dockertypes.ContainerRemoveOptions{
+		RemoveVolumes: !opts.KeepVolumes,
+		Force:         true,
+	}); err != nil {
+		return err
+	}
+
+	return nil
+}
@@ -0,0 +1,158 @@
+package handler
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/docker/docker/client"
+	"github.com/docker/go-connections/tlsconfig"
+	"github.com/ehazlett/conduit/types"
+)
+
+const (
+	// defaultEngineName is the name of the engine configured from the
+	// environment when no engines are configured
+	defaultEngineName = "local"
+)
+
+// engine is a Docker engine conduit deploys to.  Engines are grouped so
+// that a deploy can be promoted from one group (i.e. staging) to the
+// next (i.e. production).
+type engine struct {
+	Name  string
+	Group string
+	// Host is the url of the engine
+	Host      string
+	client    *instrumentedClient
+	inventory *inventory
+}
+
+// newEngine returns the engine with the client wrapped for metrics and
+// container changes reported to its inventory
+func newEngine(name, group, host string, cli client.APIClient) *engine {
+	e := &engine{
+		Name:      name,
+		Group:     group,
+		Host:      host,
+		inventory: newInventory(),
+	}
+	e.client = &instrumentedClient{
+		APIClient: cli,
+		changed:   e.refreshContainer,
+	}
+
+	return e
+}
+
+// newEngines connects to the configured engines.  When none are
+// configured a single engine is used from the environment (DOCKER_HOST).
+func newEngines(configs []types.EngineConfig) ([]*engine, error) {
+	if len(configs) == 0 {
+		cli, err := client.NewEnvClient()
+		if err != nil {
+			return nil, err
+		}
+
+		host := os.Getenv("DOCKER_HOST")
+		if host == "" {
+			host = client.DefaultDockerHost
+		}
+
+		return []*engine{newEngine(defaultEngineName, "", host, cli)}, nil
+	}
+
+	engines := []*engine{}
+	seen := map[string]bool{}
+	for _, cfg := range configs {
+		if cfg.Name == "" {
+			return nil, fmt.Errorf("engine %s must have a name", cfg.URL)
+		}
+		if seen[cfg.Name] {
+			return nil, fmt.Errorf("duplicate engine %s", cfg.Name)
+		}
+		seen[cfg.Name] = true
+
+		cli, err := newEngineClient(cfg)
+		if err != nil {
+			return nil, fmt.Errorf("error connecting to engine %s: %s", cfg.Name, err)
+		}
+
+		engines = append(engines, newEngine(cfg.Name, cfg.Group, engineHost(cfg), cli))
+	}
+
+	return engines, nil
+}
+
+func engineHost(cfg types.EngineConfig) string {
+	if cfg.URL == "" {
+		return client.DefaultDockerHost
+	}
+
+	return cfg.URL
+}
+
+func newEngineClient(cfg types.EngineConfig) (*client.Client, error) {
+	host := engineHost(cfg)
+
+	var httpClient *http.Client
+	if cfg.CertPath != "" {
+		tlsc, err := tlsconfig.Client(tlsconfig.Options{
+			CAFile:             filepath.Join(cfg.CertPath, "ca.pem"),
+			CertFile:           filepath.Join(cfg.CertPath, "cert.pem"),
+			KeyFile:            filepath.Join(cfg.CertPath, "key.pem"),
+			InsecureSkipVerify: !cfg.TLSVerify,
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		httpClient = &http.Client{
+			Transport: &http.Transport{
+				TLSClientConfig: tlsc,
+			},
+		}
+	}
+
+	return client.NewClient(host, client.DefaultVersion, httpClient, nil)
+}
+
+// isLocal reports whether the engine runs on the conduit host
+func (e *engine) isLocal() bool {
+	return strings.HasPrefix(e.Host, "unix://")
+}
+
+// engine returns the engine by name.  The first engine is returned for an
+// empty name which is used by state persisted before engines were named.
+func (h *Handler) engine(name string) (*engine, error) {
+	if name == "" {
+		return h.engines[0], nil
+	}
+
+	for _, e := range h.engines {
+		if e.Name == name {
+			return e, nil
+		}
+	}
+
+	return nil, fmt.Errorf("unknown engine %s", name)
+}
+
+// groupEngines returns the engines of the group.  All engines are returned
+// for an empty group.
+func (h *Handler) groupEngines(group string) []*engine {
+	if group == "" {
+		return h.engines
+	}
+
+	engines := []*engine{}
+	for _, e := range h.engines {
+		if e.Group == group {
+			engines = append(engines, e)
+		}
+	}
+
+	return engines
+}
@@ -0,0 +1,187 @@
+package handler
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/docker/docker/client"
+	"github.com/ehazlett/conduit/notify"
+)
+
+// groupTargets adds the other running members of the container groups of
+// the targets on the engine.  Members of other repositories are redeployed
+// with their current image.
+func (h *Handler) groupTargets(ctx context.Context, e *engine, targets []*deployTarget) ([]*deployTarget, error) {
+	groups := []string{}
+	for _, t := range targets {
+		t.Group = t.Container.Labels[labelGroup]
+		if t.Group != "" && !containsString(groups, t.Group) {
+			groups = append(groups, t.Group)
+		}
+	}
+	if len(groups) == 0 {
+		return targets, nil
+	}
+
+	containers, err := e.inventory.list(false)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, c := range containers {
+		group := c.Labels[labelGroup]
+		if !containsString(groups, group) || isTarget(targets, e, c.ID) || h.isRetained(c) || !h.isEnabled(c) {
+			continue
+		}
+
+		info, err := e.client.ContainerInspect(ctx, c.ID)
+		if err != nil {
+			if client.IsErrContainerNotFound(err) {
+				continue
+			}
+			return nil, err
+		}
+
+		repo, _ := parseImage(c.Image)
+		opts, err := h.containerOptions(repo, info.Config)
+		if err != nil {
+			return nil, err
+		}
+
+		logrus.WithFields(logrus.Fields{
+			"container": shortID(c.ID),
+			"engine":    e.Name,
+			"group":     group,
+			"image":     c.Image,
+		}).Debug("adding container group member")
+
+		targets = append(targets, &deployTarget{
+			Engine:    e,
+			Container: c,
+			Info:      info,
+			Options:   opts,
+			Image:     c.Image,
+			Group:     group,
+		})
+	}
+
+	return targets, nil
+}
+
+func groupOrder(labels map[string]string) int {
+	n, err := strconv.Atoi(labels[labelGroupOrder])
+	if err != nil {
+		return 0
+	}
+
+	return n
+}
+
+// orderGroups moves the members of each container group next to each
+// other at the position of the first member, ordered by their group order
+func orderGroups(targets []*deployTarget) []*deployTarget {
+	ordered := []*deployTarget{}
+	added := map[string]bool{}
+	for _, t := range targets {
+		if t.Group == "" {
+			ordered = append(ordered, t)
+			continue
+		}
+		if added[t.Group] {
+			continue
+		}
+		added[t.Group] = true
+
+		members := []*deployTarget{}
+		for _, m := range targets {
+			if m.Group == t.Group {
+				members = append(members, m)
+			}
+		}
+		sort.SliceStable(members, func(i, j int) bool {
+			return groupOrder(members[i].Container.Labels) < groupOrder(members[j].Container.Labels)
+		})
+		ordered = append(ordered, members...)
+	}
+
+	return ordered
+}
+
+// deployUnits splits the ordered targets into the units that are rotated
+// together: the members of a container group on an engine or a single
+// container
+func deployUnits(targets []*deployTarget) [][]*deployTarget {
+	units := [][]*deployTarget{}
+	for _, t := range targets {
+		if n := len(units); n > 0 && t.Group != "" {
+			last := units[n-1]
+			if last[0].Group == t.Group && last[0].Engine == t.Engine {
+				units[n-1] = append(last, t)
+				continue
+			}
+		}
+		units = append(units, []*deployTarget{t})
+	}
+
+	return units
+}
+
+// rotateGroup rotates the members of a container group in order.  The old
+// containers are kept stopped until every member is healthy; when a member
+// fails the members already rotated are rolled back so the group keeps
+// running matching versions.
+func (h *Handler) rotateGroup(ctx context.Context, members []*deployTarget, replaced []replacement) ([]replacement, error) {
+	group := members[0].Group
+	e := members[0].Engine
+
+	logrus.WithFields(logrus.Fields{
+		"group":   group,
+		"engine":  e.Name,
+		"members": len(members),
+	}).Info("rotating container group")
+
+	rotated := []*deployTarget{}
+	for _, t := range members {
+		t.KeepOld = true
+		t.Replaced = replaced
+		if err := h.rotate(ctx, t); err != nil {
+			h.rollbackGroup(group, rotated, err)
+			return replaced, fmt.Errorf("container group %s: %s", group, err)
+		}
+
+		rotated = append(rotated, t)
+		replaced = append(replaced, t.replacement())
+	}
+
+	// every member is healthy so the old containers are taken out of
+	// service
+	for _, t := range rotated {
+		if err := h.retireRotated(ctx, t); err != nil {
+			return replaced, fmt.Errorf("container group %s: %s", group, err)
+		}
+	}
+
+	return replaced, nil
+}
+
+// rollbackGroup removes the replacements of the rotated members and
+// restarts their old containers in reverse order
+func (h *Handler) rollbackGroup(group string, rotated []*deployTarget, cause error) {
+	for i := len(rotated) - 1; i >= 0; i-- {
+		t := rotated[i]
+
+		repo, _ := parseImage(t.Image)
+		rollbacks.Inc(repo)
+		h.notifier.Send(notify.NewEvent(notify.EventRollback, repo, fmt.Sprintf("container %s of group %s was rolled back: %s", shortID(t.Container.ID), group, cause)))
+
+		if err := h.rollbackRotation(t); err != nil {
+			logrus.WithFields(logrus.Fields{
+				"container": shortID(t.Container.ID),
+				"group":     group,
+			}).Errorf("error restoring container of group: %s", err)
+		}
+	}
+}
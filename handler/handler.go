@@ -1,23 +1,92 @@
 package handler
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
 	"strings"
+	"sync"
+	"syscall"
 	"time"
 
 	"github.com/Sirupsen/logrus"
-	"github.com/docker/docker/client"
+	"github.com/ehazlett/conduit/metrics"
+	"github.com/ehazlett/conduit/notify"
+	"github.com/ehazlett/conduit/policy"
+	"github.com/ehazlett/conduit/schedule"
 	"github.com/ehazlett/conduit/types"
 	"github.com/ehazlett/conduit/version"
 	"github.com/gorilla/mux"
 )
 
 type HandlerConfig struct {
-	ListenAddr   string
-	Repositories []string
-	Token        string
+	ListenAddr    string
+	Repositories  []string
+	Token         string
+	Tags          []string
+	LabelEnable   bool
+	Strategy      string
+	HealthTimeout time.Duration
+	StopTimeout   time.Duration
+	// DeployTimeout is the deadline of a deploy (0 for none)
+	DeployTimeout time.Duration
+	// KeepVolumes keeps the volumes of removed containers
+	KeepVolumes bool
+	// KeepPrevious is the number of previous containers of each service
+	// kept stopped for rollback
+	KeepPrevious int
+	// ImageCleanup removes unused images of a repository after it is
+	// deployed
+	ImageCleanup bool
+	// KeepImages is the number of unused images of each repository kept
+	// for rollback
+	KeepImages int
+	// PruneInterval is how often unused images of all repositories are
+	// pruned (0 to disable)
+	PruneInterval time.Duration
+	// PruneDryRun only reports the images the periodic prune would remove
+	PruneDryRun bool
+	// Preflight checks the disk space and memory of the engines before
+	// containers are rotated
+	Preflight bool
+	// MinFreeSpace is the disk space in bytes that must remain free after
+	// the images are pulled
+	MinFreeSpace int64
+	// PullConcurrency is the number of images pulled at once
+	PullConcurrency int
+	// EnginePullConcurrency is the number of images pulled at once on a
+	// single engine
+	EnginePullConcurrency int
+	Notifiers             []types.NotifierConfig
+	// CallbackTimeout is the timeout for a single callback request
+	CallbackTimeout time.Duration
+	// CallbackRetries is the number of times a failed callback is retried
+	CallbackRetries int
+	// StateDir is where conduit persists state across restarts
+	StateDir string
+	// ShutdownTimeout is how long to wait for a running deploy on shutdown
+	ShutdownTimeout time.Duration
+	// DryRun resolves deploy plans without changing any containers
+	DryRun bool
+	// RepositoryConfig holds per repository settings by repository name
+	RepositoryConfig map[string]*types.RepositoryConfig
+	// ExternalURL is the url conduit is reachable at and is used for
+	// links in notifications
+	ExternalURL string
+	// Engines are the Docker engines to deploy to.  The engine from the
+	// environment is used when empty.
+	Engines []types.EngineConfig
+	// Manifest is the desired state of the services conduit reconciles
+	// the engines to
+	Manifest *types.Manifest
+	// ReconcileInterval is how often the engines are reconciled to the
+	// manifest (0 to only reconcile on start and on request)
+	ReconcileInterval time.Duration
 }
 
 type info struct {
@@ -26,19 +95,166 @@ type info struct {
 }
 
 type Handler struct {
-	config *HandlerConfig
-	client client.APIClient
+	config   *HandlerConfig
+	engines  []*engine
+	queue    *jobQueue
+	notifier *notify.Dispatcher
+	// callbackClient is used to deliver webhook callbacks and callbacks
+	// tracks the deliveries in progress
+	callbackClient *http.Client
+	callbacks      sync.WaitGroup
+	// registry looks up image sizes for the preflight checks
+	registry *registryClient
+	// policies are the update policies by repository
+	policies map[string]policy.Policy
+	// schedules are the deployment schedules by repository
+	schedules    map[string]*schedule.Schedule
+	freezeLock   sync.Mutex
+	freezes      map[string][]types.Freeze
+	deferredLock sync.Mutex
+	deferred     []*job
+	approvalLock sync.Mutex
+	approvals    map[string]*pendingApproval
+	historyLock  sync.Mutex
+	deployments  []*types.Deployment
+	previousLock sync.Mutex
+	previous     []*retained
+	pruneLock    sync.Mutex
+	lastPrune    *types.PruneReport
+	// services are the manifest services and serviceTags the tags
+	// deploys have moved them to
+	services      []*service
+	serviceLock   sync.Mutex
+	serviceTags   map[string]*serviceTag
+	reconcileLock sync.Mutex
+	lastReconcile *types.ReconcileReport
+	// running is the deploy in progress so that it can be cancelled
+	runningLock sync.Mutex
+	running     *runningDeploy
+	// saverStop stops the persisting of waiting jobs on shutdown
+	saverStop chan struct{}
+	saverDone chan struct{}
 }
 
 func New(cfg *HandlerConfig) (*Handler, error) {
-	cli, err := client.NewEnvClient()
+	if cfg.Strategy != "" && !validStrategy(cfg.Strategy) {
+		return nil, fmt.Errorf("invalid strategy: %s", cfg.Strategy)
+	}
+
+	engines, err := newEngines(cfg.Engines)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := os.MkdirAll(cfg.StateDir, 0700); err != nil {
+		return nil, err
+	}
+
+	policies := map[string]policy.Policy{}
+	for repo, rc := range cfg.RepositoryConfig {
+		p, err := policy.New(rc.Policy)
+		if err != nil {
+			return nil, fmt.Errorf("invalid policy for %s: %s", repo, err)
+		}
+		policies[repo] = p
+	}
+
+	services, err := newServices(cfg.Manifest)
+	if err != nil {
+		return nil, err
+	}
+	for _, s := range services {
+		if !containsString(cfg.Repositories, s.repo) {
+			cfg.Repositories = append(cfg.Repositories, s.repo)
+		}
+		// the service policy applies to pushes of the repository unless
+		// the repository sets its own
+		if _, ok := policies[s.repo]; !ok && s.spec.Policy != nil {
+			policies[s.repo] = s.policy
+		}
+	}
+
+	serviceTags, err := loadServiceTags(filepath.Join(cfg.StateDir, servicesFile))
+	if err != nil {
+		return nil, err
+	}
+
+	schedules, err := buildSchedules(cfg.RepositoryConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	freezes, err := loadFreezes(filepath.Join(cfg.StateDir, freezesFile))
+	if err != nil {
+		return nil, err
+	}
+
+	for repo, rc := range cfg.RepositoryConfig {
+		if rc == nil {
+			continue
+		}
+		if rc.Approval != nil && rc.Approval.Expire != "" {
+			if _, err := time.ParseDuration(rc.Approval.Expire); err != nil {
+				return nil, fmt.Errorf("invalid approval expire for %s: %s", repo, err)
+			}
+		}
+		if rc.StopTimeout != "" {
+			if _, err := time.ParseDuration(rc.StopTimeout); err != nil {
+				return nil, fmt.Errorf("invalid stop timeout for %s: %s", repo, err)
+			}
+		}
+		if rc.DeployTimeout != "" {
+			if _, err := time.ParseDuration(rc.DeployTimeout); err != nil {
+				return nil, fmt.Errorf("invalid deploy timeout for %s: %s", repo, err)
+			}
+		}
+	}
+
+	approvals, err := loadApprovals(filepath.Join(cfg.StateDir, approvalsFile))
+	if err != nil {
+		return nil, err
+	}
+
+	if err := validatePromotions(cfg.RepositoryConfig, engines); err != nil {
+		return nil, err
+	}
+
+	if err := validateCanaries(cfg.RepositoryConfig); err != nil {
+		return nil, err
+	}
+
+	deployments, err := loadDeployments(filepath.Join(cfg.StateDir, deploymentsFile))
+	if err != nil {
+		return nil, err
+	}
+
+	previous, err := loadPrevious(filepath.Join(cfg.StateDir, previousFile))
+	if err != nil {
+		return nil, err
+	}
+
+	notifier, err := notify.NewDispatcher(cfg.Notifiers)
 	if err != nil {
 		return nil, err
 	}
 
 	return &Handler{
-		config: cfg,
-		client: cli,
+		config:         cfg,
+		engines:        engines,
+		notifier:       notifier,
+		callbackClient: newCallbackClient(cfg.CallbackTimeout),
+		registry:       newRegistryClient(),
+		queue:          newJobQueue(),
+		policies:       policies,
+		schedules:      schedules,
+		freezes:        freezes,
+		approvals:      approvals,
+		deployments:    deployments,
+		previous:       previous,
+		services:       services,
+		serviceTags:    serviceTags,
+		saverStop:      make(chan struct{}),
+		saverDone:      make(chan struct{}),
 	}, nil
 }
 
@@ -58,6 +274,7 @@ func (h *Handler) handleHook(w http.ResponseWriter, r *http.Request) {
 	var hook *types.Webhook
 	if err := json.NewDecoder(r.Body).Decode(&hook); err != nil {
 		logrus.Errorf("error decoding webhook: %s", err)
+		webhooksReceived.Inc("", outcomeInvalid)
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
@@ -69,21 +286,13 @@ func (h *Handler) handleHook(w http.ResponseWriter, r *http.Request) {
 		"name":      repoName,
 	}).Debug("webhook received")
 
-	responsePayload := &types.CallbackPayload{
-		TargetURL: "",
-	}
-
+	// rejected hooks never get a callback so that conduit cannot be made
+	// to post to arbitrary urls.  Their repository is not used as a metric
+	// label so that unauthenticated callers cannot create series.
 	if token != h.config.Token {
+		webhooksReceived.Inc("", outcomeUnauthorized)
+		authFailures.Inc()
 		rErr := fmt.Errorf("invalid token %s", token)
-		responsePayload.State = "error"
-		responsePayload.Description = rErr.Error()
-
-		if hook.CallbackURL != "" {
-			if err := h.sendResponse(responsePayload, hook.CallbackURL); err != nil {
-				logrus.Error(err)
-			}
-		}
-
 		http.Error(w, rErr.Error(), http.StatusUnauthorized)
 		logrus.Error(rErr)
 
@@ -92,50 +301,56 @@ func (h *Handler) handleHook(w http.ResponseWriter, r *http.Request) {
 	}
 
 	if !h.isValidRepository(repoName) {
+		webhooksReceived.Inc("", outcomeRejected)
 		rErr := fmt.Errorf("%s is not in whitelist", repoName)
-
-		responsePayload.State = "error"
-		responsePayload.Description = rErr.Error()
-		if hook.CallbackURL != "" {
-			if err := h.sendResponse(responsePayload, hook.CallbackURL); err != nil {
-				logrus.Error(err)
-			}
-		}
-
 		http.Error(w, rErr.Error(), http.StatusUnauthorized)
 		logrus.Error(rErr)
 
 		return
 	}
 
-	logrus.Debugf("deploying %s", repoName)
-
-	// TODO: deploy
-	if err := h.deploy(repoName); err != nil {
-		rErr := fmt.Errorf("error deploying %s: %s", repoName, err)
-
-		responsePayload.State = "error"
-		responsePayload.Description = rErr.Error()
-		if hook.CallbackURL != "" {
-			if err := h.sendResponse(responsePayload, hook.CallbackURL); err != nil {
-				logrus.Error(err)
-			}
+	dryRun := h.config.DryRun
+	if v := r.URL.Query().Get("dry_run"); v != "" {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("invalid dry_run value %q", v), http.StatusBadRequest)
+			return
 		}
+		// the global dry run setting cannot be disabled per request
+		dryRun = dryRun || b
+	}
 
-		http.Error(w, rErr.Error(), http.StatusUnauthorized)
-		logrus.Error(rErr)
-
+	j := newJob(repoName, hook.PushData.Tag, hook.CallbackURL, dryRun)
+	result := j.result
+	if !dryRun {
+		// the hook is answered once the deploy is queued; its outcome is
+		// reported to the callback and the deployment history
+		j.result = nil
+	}
+	if err := h.queue.push(j); err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		logrus.Error(err)
 		return
 	}
 
-	responsePayload.State = "success"
-	responsePayload.Description = fmt.Sprintf("conduit deployed %s", repoName)
-	w.WriteHeader(http.StatusOK)
+	if !dryRun {
+		w.WriteHeader(http.StatusAccepted)
+		fmt.Fprintf(w, "deploy %s queued\n", j.ID)
+		return
+	}
 
-	if hook.CallbackURL != "" {
-		if err := h.sendResponse(responsePayload, hook.CallbackURL); err != nil {
-			logrus.Error(err)
+	if err := <-result; err != nil {
+		status := http.StatusUnauthorized
+		if err == errJobPersisted {
+			status = http.StatusServiceUnavailable
 		}
+		http.Error(w, err.Error(), status)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(j.Plan); err != nil {
+		logrus.Error(err)
 	}
 }
 
@@ -143,13 +358,162 @@ func (h *Handler) Run() error {
 	r := mux.NewRouter()
 
 	r.HandleFunc("/", h.info).Methods("GET")
+	r.Handle("/metrics", metrics.Handler()).Methods("GET")
 	r.HandleFunc("/", h.handleHook).Methods("POST")
-
-	http.Handle("/", r)
+	r.HandleFunc("/repositories/{name:.+}/plan", h.repositoryPlan).Methods("GET")
+	r.HandleFunc("/repositories/{name:.+}/freezes", h.listFreezes).Methods("GET")
+	r.HandleFunc("/repositories/{name:.+}/freezes", h.createFreeze).Methods("POST")
+	r.HandleFunc("/repositories/{name:.+}/freezes", h.deleteFreezes).Methods("DELETE")
+	r.HandleFunc("/repositories/{name:.+}/containers", h.getContainers).Methods("GET")
+	r.HandleFunc("/repositories/{name:.+}/previous", h.getPrevious).Methods("GET")
+	r.HandleFunc("/repositories/{name:.+}/rollback", h.rollbackRepository).Methods("POST")
+	r.HandleFunc("/approvals", h.getApprovals).Methods("GET")
+	r.HandleFunc("/approvals/{id}/approve", h.approveLink).Methods("GET")
+	r.HandleFunc("/approvals/{id}/approve", h.approveDeploy).Methods("POST")
+	r.HandleFunc("/approvals/{id}/reject", h.rejectDeploy).Methods("POST")
+	r.HandleFunc("/deployments", h.getDeployments).Methods("GET")
+	r.HandleFunc("/images/prune", h.getPruneReport).Methods("GET")
+	r.HandleFunc("/images/prune", h.prune).Methods("POST")
+	r.HandleFunc("/reconcile", h.getReconcileReport).Methods("GET")
+	r.HandleFunc("/reconcile", h.reconcileManifest).Methods("POST")
+	r.HandleFunc("/deployments/{id}", h.getDeployment).Methods("GET")
+	r.HandleFunc("/deployments/{id}/cancel", h.cancelDeploy).Methods("POST")
+
+	srv := &http.Server{
+		Addr:    h.config.ListenAddr,
+		Handler: r,
+	}
 
 	logrus.Infof("%s listening on %s", version.Name(), h.config.ListenAddr)
 	logrus.Infof("repositories: %s", strings.Join(h.config.Repositories, ", "))
+	if len(h.config.Tags) > 0 {
+		logrus.Infof("tags: %s", strings.Join(h.config.Tags, ", "))
+	}
+	if h.config.LabelEnable {
+		logrus.Infof("only deploying containers labeled %s=true", labelEnable)
+	}
+	if h.config.DryRun {
+		logrus.Info("dry run enabled; containers will not be changed")
+	}
+	for _, s := range h.services {
+		logrus.WithFields(logrus.Fields{
+			"service":  s.spec.Name,
+			"image":    h.serviceImage(s),
+			"replicas": s.replicas,
+		}).Info("reconciling manifest service")
+	}
+	for _, e := range h.engines {
+		logrus.WithFields(logrus.Fields{
+			"engine": e.Name,
+			"group":  e.Group,
+		}).Info("deploying to engine")
+	}
 
-	// TODO: TLS
-	return http.ListenAndServe(h.config.ListenAddr, nil)
+	// deploys are matched against the inventory so it is synced first
+	var wg sync.WaitGroup
+	for _, e := range h.engines {
+		wg.Add(1)
+		go h.watchEngine(e, wg.Done)
+	}
+	wg.Wait()
+
+	if err := h.recoverRotations(); err != nil {
+		logrus.Errorf("error recovering interrupted rotations: %s", err)
+	}
+
+	go h.runJobSaver()
+	go h.runQueue()
+	go h.runDeferred()
+	if h.config.PruneInterval > 0 {
+		go h.runPrune()
+	}
+	if len(h.services) > 0 {
+		go h.runReconcile()
+	}
+
+	if err := h.resumeJobs(); err != nil {
+		logrus.Errorf("error resuming queued deploys: %s", err)
+	}
+
+	errCh := make(chan error, 1)
+	go func() {
+		// TODO: TLS
+		errCh <- srv.ListenAndServe()
+	}()
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+
+	select {
+	case err := <-errCh:
+		return err
+	case sig := <-signals:
+		logrus.Infof("received %s; shutting down", sig)
+	}
+
+	return h.shutdown(srv)
+}
+
+// shutdown stops accepting hooks, persists queued deploys and waits for
+// the running deploy to complete until the shutdown timeout.  A deploy that
+// is still running then is cancelled and rolled back.
+func (h *Handler) shutdown(srv *http.Server) error {
+	ctx, cancel := context.WithTimeout(context.Background(), h.config.ShutdownTimeout)
+	defer cancel()
+
+	pending := append(h.queue.close(), h.takeDeferred()...)
+	close(h.saverStop)
+	<-h.saverDone
+	if err := h.persistJobs(pending); err != nil {
+		logrus.Errorf("error persisting queued deploys: %s", err)
+	}
+	for _, j := range pending {
+		logrus.WithFields(logrus.Fields{
+			"job":  j.ID,
+			"name": j.Repository,
+		}).Info("deploy queued for restart")
+		j.finish(errJobPersisted)
+	}
+
+	select {
+	case <-h.queue.done:
+	case <-ctx.Done():
+		if h.cancelRunning() {
+			logrus.Warn("timeout waiting for running deploy to complete; cancelling and rolling back")
+		}
+		<-h.queue.done
+	}
+
+	if err := srv.Shutdown(ctx); err != nil {
+		logrus.Warnf("error shutting down server: %s", err)
+		srv.Close()
+	}
+
+	// notifications and callbacks still retrying are abandoned once the
+	// shutdown timeout has passed
+	if !waitContext(ctx, h.notifier.Wait) {
+		logrus.Warn("timeout waiting for notifications to be sent")
+	}
+	if !waitContext(ctx, h.callbacks.Wait) {
+		logrus.Warn("timeout waiting for callbacks to be delivered")
+	}
+
+	return nil
+}
+
+// waitContext calls wait and reports whether it returned before ctx was
+// done
+func waitContext(ctx context.Context, wait func()) bool {
+	done := make(chan struct{})
+	go func() {
+		wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return true
+	case <-ctx.Done():
+		return false
+	}
 }
@@ -0,0 +1,202 @@
+package handler
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/ehazlett/conduit/types"
+)
+
+const (
+	deploymentsFile = "deployments.json"
+
+	// maxDeployments is the number of deployments kept in the history
+	maxDeployments = 100
+)
+
+// updateDeployment applies fn to the history of the deployment the job
+// belongs to and the stage the job deploys.  The deployment is created
+// for the first stage of a deploy.
+func (h *Handler) updateDeployment(j *job, fn func(d *types.Deployment, s *types.DeploymentStage)) {
+	h.historyLock.Lock()
+	defer h.historyLock.Unlock()
+
+	var d *types.Deployment
+	for _, v := range h.deployments {
+		if v.ID == j.DeploymentID {
+			d = v
+			break
+		}
+	}
+
+	if d == nil {
+		j.DeploymentID = j.ID
+		d = &types.Deployment{
+			ID:         j.ID,
+			Repository: j.Repository,
+			Tag:        j.Tag,
+			Status:     types.DeploymentPending,
+			Rollback:   j.Rollback,
+			Started:    time.Now(),
+			Stages:     []types.DeploymentStage{},
+		}
+		groups := h.stageGroups(j.Repository)
+		if len(groups) == 0 || j.Rollback {
+			groups = []string{""}
+		}
+		for _, g := range groups {
+			d.Stages = append(d.Stages, types.DeploymentStage{
+				Group:  g,
+				Status: types.DeploymentPending,
+			})
+		}
+
+		h.deployments = append(h.deployments, d)
+		if len(h.deployments) > maxDeployments {
+			h.deployments = h.deployments[len(h.deployments)-maxDeployments:]
+		}
+	}
+
+	if j.Stage >= len(d.Stages) {
+		// the promotion stages were changed since the deploy started
+		d.Stages = append(d.Stages, make([]types.DeploymentStage, j.Stage-len(d.Stages)+1)...)
+	}
+	fn(d, &d.Stages[j.Stage])
+
+	if err := h.saveDeployments(); err != nil {
+		logrus.Errorf("error saving deployment history: %s", err)
+	}
+}
+
+// listDeployments returns the deployments of the repository, newest
+// first.  All deployments are returned for an empty repository.
+func (h *Handler) listDeployments(repo string) []types.Deployment {
+	h.historyLock.Lock()
+	defer h.historyLock.Unlock()
+
+	deployments := []types.Deployment{}
+	for i := len(h.deployments) - 1; i >= 0; i-- {
+		d := h.deployments[i]
+		if repo != "" && d.Repository != repo {
+			continue
+		}
+		deployments = append(deployments, copyDeployment(d))
+	}
+
+	return deployments
+}
+
+// deployment returns the deployment by id
+func (h *Handler) deployment(id string) (types.Deployment, bool) {
+	h.historyLock.Lock()
+	defer h.historyLock.Unlock()
+
+	for _, d := range h.deployments {
+		if d.ID == id {
+			return copyDeployment(d), true
+		}
+	}
+
+	return types.Deployment{}, false
+}
+
+func copyDeployment(d *types.Deployment) types.Deployment {
+	c := *d
+	c.Stages = append([]types.DeploymentStage{}, d.Stages...)
+
+	return c
+}
+
+func (h *Handler) deploymentsPath() string {
+	return filepath.Join(h.config.StateDir, deploymentsFile)
+}
+
+// saveDeployments persists the deployment history.  The history lock
+// must be held.
+func (h *Handler) saveDeployments() error {
+	data, err := json.MarshalIndent(h.deployments, "", "    ")
+	if err != nil {
+		return err
+	}
+
+	tmp := h.deploymentsPath() + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, h.deploymentsPath())
+}
+
+// interruptDeployments marks the deployments that were left running or
+// soaking by the last run as interrupted.  Deployments with a persisted
+// job, i.e. the job that was running or a promotion waiting for its soak,
+// are resumed instead.
+func (h *Handler) interruptDeployments(jobs []*job) {
+	h.historyLock.Lock()
+	defer h.historyLock.Unlock()
+
+	resumed := map[string]bool{}
+	for _, j := range jobs {
+		if j.DeploymentID != "" {
+			resumed[j.DeploymentID] = true
+		}
+	}
+
+	changed := false
+	now := time.Now()
+	for _, d := range h.deployments {
+		if d.Status != types.DeploymentRunning && d.Status != types.DeploymentSoaking {
+			continue
+		}
+		if resumed[d.ID] {
+			continue
+		}
+
+		logrus.WithFields(logrus.Fields{
+			"deployment": d.ID,
+			"name":       d.Repository,
+			"status":     d.Status,
+		}).Warn("marking deployment as interrupted")
+
+		d.Status = types.DeploymentInterrupted
+		d.Finished = now
+		for i := range d.Stages {
+			s := &d.Stages[i]
+			if s.Status == types.DeploymentRunning || s.Status == types.DeploymentPending {
+				s.Status = types.DeploymentInterrupted
+				s.Finished = now
+			}
+		}
+		changed = true
+	}
+
+	if !changed {
+		return
+	}
+
+	if err := h.saveDeployments(); err != nil {
+		logrus.Errorf("error saving deployment history: %s", err)
+	}
+}
+
+func loadDeployments(path string) ([]*types.Deployment, error) {
+	deployments := []*types.Deployment{}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return deployments, nil
+		}
+		return nil, err
+	}
+
+	if err := json.Unmarshal(data, &deployments); err != nil {
+		return nil, err
+	}
+
+	return deployments, nil
+}
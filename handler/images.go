@@ -0,0 +1,189 @@
+package handler
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	dockertypes "github.com/docker/docker/api/types"
+	"github.com/docker/docker/client"
+	"github.com/ehazlett/conduit/types"
+)
+
+// keepImages returns the number of unused images of the repository kept
+// for rollback
+func (h *Handler) keepImages(repo string) int {
+	if n := h.repositoryConfig(repo).KeepImages; n > 0 {
+		return n
+	}
+
+	return h.config.KeepImages
+}
+
+// unusedImages returns the images of the repository on the engine that no
+// container uses, except for the newest keep images which are kept for
+// rollback
+func (h *Handler) unusedImages(e *engine, repo string, keep int) ([]types.PrunedImage, error) {
+	containers, err := e.inventory.list(true)
+	if err != nil {
+		return nil, err
+	}
+
+	used := map[string]bool{}
+	for _, c := range containers {
+		used[c.ImageID] = true
+	}
+
+	images, err := e.client.ImageList(context.Background(), dockertypes.ImageListOptions{})
+	if err != nil {
+		return nil, err
+	}
+
+	unused := []types.PrunedImage{}
+	for _, img := range images {
+		if used[img.ID] {
+			continue
+		}
+
+		refs := []string{}
+		for _, ref := range append(img.RepoTags, img.RepoDigests...) {
+			if r, _ := parseImage(ref); r == repo {
+				refs = append(refs, ref)
+			}
+		}
+		if len(refs) == 0 {
+			continue
+		}
+
+		unused = append(unused, types.PrunedImage{
+			Engine:     e.Name,
+			Repository: repo,
+			ID:         img.ID,
+			References: refs,
+			Created:    time.Unix(img.Created, 0),
+			Size:       img.Size,
+		})
+	}
+
+	sort.Slice(unused, func(i, j int) bool {
+		return unused[i].Created.After(unused[j].Created)
+	})
+	if len(unused) <= keep {
+		return nil, nil
+	}
+
+	return unused[keep:], nil
+}
+
+// pruneImages removes the unused images of the repositories from the
+// engines.  Only the references of the repositories are removed so images
+// that are also tagged for another repository are kept.
+func (h *Handler) pruneImages(engines []*engine, repos []string, dryRun bool) *types.PruneReport {
+	report := &types.PruneReport{
+		DryRun: dryRun,
+		Time:   time.Now(),
+		Images: []types.PrunedImage{},
+	}
+
+	for _, e := range engines {
+		for _, repo := range repos {
+			unused, err := h.unusedImages(e, repo, h.keepImages(repo))
+			if err != nil {
+				report.Errors = append(report.Errors, fmt.Sprintf("engine %s: %s: %s", e.Name, repo, err))
+				continue
+			}
+
+			for _, img := range unused {
+				if !dryRun {
+					if err := h.removeImage(e, img); err != nil {
+						report.Errors = append(report.Errors, fmt.Sprintf("engine %s: %s: %s", e.Name, shortID(img.ID), err))
+						continue
+					}
+				}
+
+				report.Images = append(report.Images, img)
+				report.Reclaimed += img.Size
+			}
+		}
+	}
+
+	logrus.WithFields(logrus.Fields{
+		"dry_run":   dryRun,
+		"images":    len(report.Images),
+		"reclaimed": report.Reclaimed,
+		"errors":    len(report.Errors),
+	}).Info("pruned images")
+
+	return report
+}
+
+func (h *Handler) removeImage(e *engine, img types.PrunedImage) error {
+	logrus.WithFields(logrus.Fields{
+		"engine": e.Name,
+		"image":  shortID(img.ID),
+		"refs":   img.References,
+	}).Debug("removing image")
+
+	for _, ref := range img.References {
+		if _, err := e.client.ImageRemove(context.Background(), ref, dockertypes.ImageRemoveOptions{
+			PruneChildren: true,
+		}); err != nil {
+			// removing the last reference may already have removed the
+			// image.  The remove of the docker client does not return a
+			// typed not found error so the image is inspected instead.
+			if _, _, ierr := e.client.ImageInspectWithRaw(context.Background(), ref); client.IsErrImageNotFound(ierr) {
+				continue
+			}
+			return err
+		}
+	}
+
+	imagesRemoved.Inc(img.Repository)
+
+	return nil
+}
+
+// setPruneReport keeps the report of the last prune
+func (h *Handler) setPruneReport(r *types.PruneReport) {
+	h.pruneLock.Lock()
+	defer h.pruneLock.Unlock()
+
+	h.lastPrune = r
+}
+
+func (h *Handler) pruneReport() *types.PruneReport {
+	h.pruneLock.Lock()
+	defer h.pruneLock.Unlock()
+
+	return h.lastPrune
+}
+
+// newPruneJob returns a job that prunes the images of all repositories
+func newPruneJob(dryRun bool) *job {
+	j := newJob("", "", "", dryRun)
+	j.Prune = true
+
+	return j
+}
+
+// runPrune periodically queues an image prune until the queue is done
+func (h *Handler) runPrune() {
+	t := time.NewTicker(h.config.PruneInterval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-t.C:
+			j := newPruneJob(h.config.PruneDryRun || h.config.DryRun)
+			// nobody waits for the result of a periodic prune
+			j.result = nil
+			if err := h.queue.push(j); err != nil {
+				logrus.Errorf("error queueing image prune: %s", err)
+			}
+		case <-h.queue.done:
+			return
+		}
+	}
+}
@@ -0,0 +1,458 @@
+package handler
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	dockertypes "github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/events"
+	"github.com/docker/docker/api/types/filters"
+	"github.com/ehazlett/conduit/types"
+)
+
+const (
+	// inventoryRetry is how long to wait before reconnecting to the
+	// events of an engine
+	inventoryRetry = time.Second * 5
+)
+
+// lifecycleEvents are the container events that change the inventory.
+// Other events such as exec or attach are frequent and change nothing.
+var lifecycleEvents = []string{
+	"create",
+	"start",
+	"die",
+	"stop",
+	"kill",
+	"pause",
+	"unpause",
+	"rename",
+	"update",
+	"destroy",
+}
+
+// inventory is the index of the containers of an engine by image
+// repository.  It is built from a full container list and kept current
+// from the engine events so a deploy only looks at the containers of the
+// repository.
+type inventory struct {
+	mu         sync.RWMutex
+	synced     bool
+	containers map[string]*inventoryItem
+	byRepo     map[string]map[string]struct{}
+}
+
+// inventoryItem is a container with the references of its image, the
+// containers it depends on and its memory limit
+type inventoryItem struct {
+	container dockertypes.Container
+	refs      []string
+	deps      []string
+	memory    int64
+}
+
+func newInventory() *inventory {
+	return &inventory{
+		containers: map[string]*inventoryItem{},
+		byRepo:     map[string]map[string]struct{}{},
+	}
+}
+
+// repositories returns the repositories the item is indexed by
+func (it *inventoryItem) repositories() []string {
+	repos := []string{}
+	for _, ref := range it.refs {
+		if repo, _ := parseImage(ref); !containsString(repos, repo) {
+			repos = append(repos, repo)
+		}
+	}
+
+	return repos
+}
+
+// set adds or updates the container.  The lock must be held.
+func (i *inventory) set(it *inventoryItem) {
+	id := it.container.ID
+	i.remove(id)
+
+	for _, repo := range it.repositories() {
+		if i.byRepo[repo] == nil {
+			i.byRepo[repo] = map[string]struct{}{}
+		}
+		i.byRepo[repo][id] = struct{}{}
+	}
+	i.containers[id] = it
+}
+
+// remove removes the container.  The lock must be held.
+func (i *inventory) remove(id string) {
+	it, ok := i.containers[id]
+	if !ok {
+		return
+	}
+
+	for _, repo := range it.repositories() {
+		delete(i.byRepo[repo], id)
+		if len(i.byRepo[repo]) == 0 {
+			delete(i.byRepo, repo)
+		}
+	}
+	delete(i.containers, id)
+}
+
+// reset replaces the index with the containers
+func (i *inventory) reset(items []*inventoryItem) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	i.containers = map[string]*inventoryItem{}
+	i.byRepo = map[string]map[string]struct{}{}
+	for _, it := range items {
+		i.set(it)
+	}
+	i.synced = true
+}
+
+func (i *inventory) setSynced(synced bool) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	i.synced = synced
+}
+
+// repository returns the containers of the repository, newest first, with
+// the image set to the reference in the repository.  Stopped containers
+// are only returned when all is set.
+func (i *inventory) repository(repo string, all bool) ([]dockertypes.Container, error) {
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+
+	if !i.synced {
+		return nil, fmt.Errorf("container inventory is not available")
+	}
+
+	containers := []dockertypes.Container{}
+	for id := range i.byRepo[repo] {
+		it := i.containers[id]
+		if !all && !isRunningState(it.container.State) {
+			continue
+		}
+
+		c := it.container
+		if ref, ok := repositoryImage(it.refs, repo); ok {
+			c.Image = ref
+		}
+		containers = append(containers, c)
+	}
+	sortContainers(containers)
+
+	return containers, nil
+}
+
+// list returns all containers, newest first.  Stopped containers are only
+// returned when all is set.
+func (i *inventory) list(all bool) ([]dockertypes.Container, error) {
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+
+	if !i.synced {
+		return nil, fmt.Errorf("container inventory is not available")
+	}
+
+	containers := []dockertypes.Container{}
+	for _, it := range i.containers {
+		if !all && !isRunningState(it.container.State) {
+			continue
+		}
+
+		c := it.container
+		c.Image = it.refs[0]
+		containers = append(containers, c)
+	}
+	sortContainers(containers)
+
+	return containers, nil
+}
+
+func sortContainers(containers []dockertypes.Container) {
+	sort.Slice(containers, func(a, b int) bool {
+		if containers[a].Created == containers[b].Created {
+			return containers[a].ID < containers[b].ID
+		}
+		return containers[a].Created > containers[b].Created
+	})
+}
+
+// isRunningState reports whether a container in the state is listed
+// without listing all containers
+func isRunningState(state string) bool {
+	switch state {
+	case "running", "paused", "restarting":
+		return true
+	}
+
+	return false
+}
+
+// syncInventory rebuilds the inventory of the engine
+func (e *engine) syncInventory() error {
+	containers, err := e.client.ContainerList(context.Background(), dockertypes.ContainerListOptions{
+		All: true,
+	})
+	if err != nil {
+		return err
+	}
+
+	items := []*inventoryItem{}
+	for _, c := range containers {
+		items = append(items, e.inventoryItem(c))
+	}
+	e.inventory.reset(items)
+
+	logrus.WithFields(logrus.Fields{
+		"engine":     e.Name,
+		"containers": len(containers),
+	}).Debug("container inventory synced")
+
+	return nil
+}
+
+// inventoryItem inspects the container for the references of its image,
+// its dependencies and its memory limit.  A container that cannot be
+// inspected is indexed by its reported image only.
+func (e *engine) inventoryItem(c dockertypes.Container) *inventoryItem {
+	it := &inventoryItem{
+		container: c,
+	}
+
+	cfg, err := e.client.ContainerInspect(context.Background(), c.ID)
+	if err != nil {
+		it.refs = e.imageLineage(c, nil)
+		return it
+	}
+
+	it.refs = e.imageLineage(c, &cfg)
+	it.deps = containerDependencies(cfg.HostConfig)
+	if cfg.HostConfig != nil {
+		it.memory = cfg.HostConfig.Memory
+	}
+
+	return it
+}
+
+// reservedMemory returns the sum of the memory limits of the running
+// containers
+func (i *inventory) reservedMemory() (int64, error) {
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+
+	if !i.synced {
+		return 0, fmt.Errorf("container inventory is not available")
+	}
+
+	var reserved int64
+	for _, it := range i.containers {
+		if isRunningState(it.container.State) {
+			reserved += it.memory
+		}
+	}
+
+	return reserved, nil
+}
+
+// dependents returns the containers that depend on the container with the
+// id and name
+func (i *inventory) dependents(id, name string) ([]dockertypes.Container, error) {
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+
+	if !i.synced {
+		return nil, fmt.Errorf("container inventory is not available")
+	}
+
+	containers := []dockertypes.Container{}
+	for _, it := range i.containers {
+		if it.container.ID == id {
+			continue
+		}
+		for _, ref := range it.deps {
+			if refersTo(ref, id, name) {
+				c := it.container
+				c.Image = it.refs[0]
+				containers = append(containers, c)
+				break
+			}
+		}
+	}
+	sortContainers(containers)
+
+	return containers, nil
+}
+
+// refreshContainer updates the container in the inventory of the engine
+func (e *engine) refreshContainer(id string) {
+	if id == "" || e.inventory == nil {
+		return
+	}
+
+	args := filters.NewArgs()
+	args.Add("id", id)
+	containers, err := e.client.ContainerList(context.Background(), dockertypes.ContainerListOptions{
+		All:     true,
+		Filters: args,
+	})
+	if err != nil {
+		logrus.WithFields(logrus.Fields{
+			"engine":    e.Name,
+			"container": shortID(id),
+		}).Errorf("error refreshing container inventory: %s", err)
+		return
+	}
+
+	// the filter matches id prefixes so only matching containers are kept
+	items := []*inventoryItem{}
+	for _, c := range containers {
+		if strings.HasPrefix(c.ID, id) {
+			items = append(items, e.inventoryItem(c))
+		}
+	}
+
+	e.inventory.mu.Lock()
+	defer e.inventory.mu.Unlock()
+
+	e.inventory.removeMatching(id)
+	for _, it := range items {
+		e.inventory.set(it)
+	}
+}
+
+// removeMatching removes the container with the id or id prefix.  The
+// lock must be held.
+func (i *inventory) removeMatching(id string) {
+	for cid := range i.containers {
+		if strings.HasPrefix(cid, id) {
+			i.remove(cid)
+		}
+	}
+}
+
+// watchEngine keeps the inventory of the engine current from its events
+// until the queue is done.  The inventory is rebuilt whenever the events
+// are reconnected so that no change is missed.  ready is called after the
+// first sync whether or not it succeeded.
+func (h *Handler) watchEngine(e *engine, ready func()) {
+	var once sync.Once
+	for {
+		ctx, cancel := context.WithCancel(context.Background())
+
+		args := filters.NewArgs()
+		args.Add("type", events.ContainerEventType)
+		for _, action := range lifecycleEvents {
+			args.Add("event", action)
+		}
+		msgs, errs := e.client.Events(ctx, dockertypes.EventsOptions{
+			Filters: args,
+		})
+
+		// sync after subscribing so changes during the sync are applied
+		if err := e.syncInventory(); err != nil {
+			logrus.WithFields(logrus.Fields{
+				"engine": e.Name,
+			}).Errorf("error syncing container inventory: %s", err)
+			once.Do(ready)
+			cancel()
+		} else {
+			once.Do(ready)
+			h.handleEvents(e, msgs, errs)
+			cancel()
+		}
+
+		e.inventory.setSynced(false)
+
+		select {
+		case <-time.After(inventoryRetry):
+		case <-h.queue.done:
+			return
+		}
+	}
+}
+
+// handleEvents applies the container events to the inventory until the
+// event stream fails or the queue is done
+func (h *Handler) handleEvents(e *engine, msgs <-chan events.Message, errs <-chan error) {
+	for {
+		select {
+		case m := <-msgs:
+			// the events are filtered to the lifecycle actions but are
+			// checked again in case the engine does not apply the filter
+			if !containsString(lifecycleEvents, m.Action) {
+				continue
+			}
+
+			id := m.Actor.ID
+			if id == "" {
+				id = m.ID
+			}
+
+			logrus.WithFields(logrus.Fields{
+				"engine":    e.Name,
+				"container": shortID(id),
+				"action":    m.Action,
+			}).Debug("container event")
+
+			if m.Action == "destroy" {
+				e.inventory.mu.Lock()
+				e.inventory.remove(id)
+				e.inventory.mu.Unlock()
+				continue
+			}
+			e.refreshContainer(id)
+		case err := <-errs:
+			observeDockerError("events", err)
+			logrus.WithFields(logrus.Fields{
+				"engine": e.Name,
+			}).Errorf("container events stopped: %s", err)
+			return
+		case <-h.queue.done:
+			return
+		}
+	}
+}
+
+// repositoryContainers returns the status of the containers of the
+// repository on all engines
+func (h *Handler) repositoryContainers(repo string) ([]types.ContainerStatus, error) {
+	status := []types.ContainerStatus{}
+	for _, e := range h.engines {
+		containers, err := e.inventory.repository(repo, true)
+		if err != nil {
+			return nil, fmt.Errorf("engine %s: %s", e.Name, err)
+		}
+
+		for _, c := range containers {
+			name := ""
+			if len(c.Names) > 0 {
+				name = strings.TrimPrefix(c.Names[0], "/")
+			}
+
+			status = append(status, types.ContainerStatus{
+				Engine:   e.Name,
+				ID:       c.ID,
+				Name:     name,
+				Image:    c.Image,
+				ImageID:  c.ImageID,
+				State:    c.State,
+				Status:   c.Status,
+				Created:  time.Unix(c.Created, 0),
+				Retained: h.isRetained(c),
+			})
+		}
+	}
+
+	return status, nil
+}
@@ -0,0 +1,70 @@
+package handler
+
+import (
+	"context"
+	"testing"
+
+	dockertypes "github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+)
+
+func TestReservedMemory(t *testing.T) {
+	i := newInventory()
+	if _, err := i.reservedMemory(); err == nil {
+		t.Error("reservedMemory of an unsynced inventory = nil error, want error")
+	}
+
+	i.reset([]*inventoryItem{
+		{container: dockertypes.Container{ID: "a", State: "running"}, refs: []string{"app"}, memory: 256},
+		{container: dockertypes.Container{ID: "b", State: "paused"}, refs: []string{"app"}, memory: 128},
+		{container: dockertypes.Container{ID: "c", State: "exited"}, refs: []string{"app"}, memory: 1024},
+		{container: dockertypes.Container{ID: "d", State: "running"}, refs: []string{"db"}},
+	})
+
+	reserved, err := i.reservedMemory()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reserved != 384 {
+		t.Errorf("reservedMemory = %d, want 384", reserved)
+	}
+}
+
+func TestPreflightMemory(t *testing.T) {
+	h := &Handler{}
+	e := &engine{Name: "local", inventory: newInventory()}
+	e.inventory.reset([]*inventoryItem{
+		{container: dockertypes.Container{ID: "a", State: "running"}, refs: []string{"app"}, memory: 600},
+	})
+
+	target := func(memory int64, strategy string) *deployTarget {
+		return &deployTarget{
+			Info: dockertypes.ContainerJSON{
+				ContainerJSONBase: &dockertypes.ContainerJSONBase{
+					HostConfig: &container.HostConfig{Resources: container.Resources{Memory: memory}},
+				},
+			},
+			Options: &deployOptions{Strategy: strategy},
+		}
+	}
+
+	tests := []struct {
+		name    string
+		total   int64
+		targets []*deployTarget
+		fail    bool
+	}{
+		{"fits", 1000, []*deployTarget{target(400, StrategyStartFirst)}, false},
+		{"does not fit", 1000, []*deployTarget{target(401, StrategyStartFirst)}, true},
+		{"stop first", 1000, []*deployTarget{target(800, StrategyStopFirst)}, false},
+		{"no limit", 1000, []*deployTarget{target(0, StrategyStartFirst)}, false},
+		{"unknown memory", 0, []*deployTarget{target(800, StrategyStartFirst)}, false},
+	}
+
+	for _, tt := range tests {
+		err := h.preflightMemory(context.Background(), e, dockertypes.Info{InfoBase: &dockertypes.InfoBase{MemTotal: tt.total}}, tt.targets)
+		if (err != nil) != tt.fail {
+			t.Errorf("%s: preflightMemory error = %v, want failure %t", tt.name, err, tt.fail)
+		}
+	}
+}
@@ -0,0 +1,353 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	dockertypes "github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/filters"
+	"github.com/docker/docker/api/types/network"
+	"github.com/docker/docker/client"
+)
+
+const (
+	journalDir = "journal"
+
+	stepBegin      = "begin"
+	stepCreated    = "created"
+	stepOldRemoved = "old-removed"
+	stepStarted    = "started"
+)
+
+// rotation is the write-ahead journal record for a single container
+// rotation.  It is written before each step that changes containers and
+// removed once the rotation is complete so a record left on disk means
+// the rotation was interrupted.
+type rotation struct {
+	ID   string `json:"id"`
+	Step string `json:"step"`
+	// Engine is the name of the engine the rotation runs on
+	Engine string `json:"engine"`
+	OldID  string `json:"old_id"`
+	NewID  string `json:"new_id"`
+	// Name is the name of the old container
+	Name string `json:"name"`
+	// Compose is set when the new container reuses the old name
+	Compose bool `json:"compose"`
+	// ImageID is the image the old container was running
+	ImageID          string                               `json:"image_id"`
+	Config           *container.Config                    `json:"config"`
+	HostConfig       *container.HostConfig                `json:"host_config"`
+	NetworkingConfig *network.NetworkingConfig            `json:"networking_config"`
+	ExtraNetworks    map[string]*network.EndpointSettings `json:"extra_networks"`
+	StopTimeout      time.Duration                        `json:"stop_timeout"`
+	StopSignal       string                               `json:"stop_signal"`
+	KeepVolumes      bool                                 `json:"keep_volumes"`
+	Started          time.Time                            `json:"started"`
+}
+
+// stopOptions are the options used to stop the containers of the rotation
+func (r *rotation) stopOptions() *deployOptions {
+	return &deployOptions{
+		StopTimeout: r.StopTimeout,
+		StopSignal:  r.StopSignal,
+		KeepVolumes: r.KeepVolumes,
+	}
+}
+
+func (h *Handler) journalPath(id string) string {
+	return filepath.Join(h.config.StateDir, journalDir, id+".json")
+}
+
+// writeJournal records the rotation step
+func (h *Handler) writeJournal(r *rotation, step string) error {
+	r.Step = step
+
+	if err := os.MkdirAll(filepath.Join(h.config.StateDir, journalDir), 0700); err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+
+	p := h.journalPath(r.ID)
+	tmp := p + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, p)
+}
+
+func (h *Handler) removeJournal(r *rotation) {
+	if err := os.Remove(h.journalPath(r.ID)); err != nil && !os.IsNotExist(err) {
+		logrus.Errorf("error removing rotation journal: %s", err)
+	}
+}
+
+// endRotation completes the journal for the rotation.  When the rotation
+// failed the containers are first returned to a consistent state; the
+// journal is kept if that is not possible so it is retried on start.
+// rollback restores the old container even if the replacement is healthy.
+func (h *Handler) endRotation(r *rotation, err error, rollback bool) {
+	if err != nil {
+		if rErr := h.recoverRotation(r, rollback); rErr != nil {
+			logrus.WithFields(logrus.Fields{
+				"rotation": r.ID,
+			}).Errorf("error recovering rotation: %s", rErr)
+			return
+		}
+	}
+
+	h.removeJournal(r)
+}
+
+// recoverRotations recovers rotations interrupted by a crash or restart
+func (h *Handler) recoverRotations() error {
+	paths, err := filepath.Glob(filepath.Join(h.config.StateDir, journalDir, "*.json"))
+	if err != nil {
+		return err
+	}
+
+	for _, p := range paths {
+		data, err := ioutil.ReadFile(p)
+		if err != nil {
+			return err
+		}
+
+		var r *rotation
+		if err := json.Unmarshal(data, &r); err != nil {
+			logrus.Errorf("invalid rotation journal %s: %s", p, err)
+			continue
+		}
+
+		logrus.WithFields(logrus.Fields{
+			"rotation":  r.ID,
+			"step":      r.Step,
+			"engine":    r.Engine,
+			"container": shortID(r.OldID),
+		}).Warn("recovering interrupted rotation")
+
+		if err := h.recoverRotation(r, false); err != nil {
+			logrus.WithFields(logrus.Fields{
+				"rotation": r.ID,
+			}).Errorf("error recovering rotation: %s", err)
+			continue
+		}
+
+		h.removeJournal(r)
+	}
+
+	return nil
+}
+
+// inspectIfExists returns nil when the container does not exist
+func (h *Handler) inspectIfExists(e *engine, id string) (*dockertypes.ContainerJSON, error) {
+	if id == "" {
+		return nil, nil
+	}
+
+	cfg, err := e.client.ContainerInspect(context.Background(), id)
+	if err != nil {
+		if client.IsErrContainerNotFound(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	return &cfg, nil
+}
+
+// findReplacement returns the id of the replacement created by the
+// rotation using its rotation label.  The replacement may have been created
+// before its id was journaled.
+func (h *Handler) findReplacement(e *engine, r *rotation) (string, error) {
+	args := filters.NewArgs()
+	args.Add("label", labelRotation+"="+r.ID)
+	containers, err := e.client.ContainerList(context.Background(), dockertypes.ContainerListOptions{
+		All:     true,
+		Filters: args,
+	})
+	if err != nil {
+		return "", err
+	}
+
+	for _, c := range containers {
+		if c.ID != r.OldID {
+			return c.ID, nil
+		}
+	}
+
+	return "", nil
+}
+
+// recoverRotation brings the containers of the rotation to a consistent
+// state.  A replacement that is running and healthy is kept and the old
+// container removed unless rollback is set; otherwise the old container is
+// restored.
+func (h *Handler) recoverRotation(r *rotation, rollback bool) error {
+	e, err := h.engine(r.Engine)
+	if err != nil {
+		return err
+	}
+
+	old, err := h.inspectIfExists(e, r.OldID)
+	if err != nil {
+		return err
+	}
+
+	newID := r.NewID
+	if newID == "" {
+		if newID, err = h.findReplacement(e, r); err != nil {
+			return err
+		}
+	}
+
+	replacement, err := h.inspectIfExists(e, newID)
+	if err != nil {
+		return err
+	}
+
+	if old != nil {
+		// the old container was already retired and kept for rollback
+		if prev := h.retainedContainer(old.ID); prev != nil {
+			if !rollback && replacement != nil && isRunningHealthy(replacement) {
+				return nil
+			}
+
+			if replacement != nil {
+				if err := h.removeContainer(context.Background(), e, replacement.ID, r.stopOptions()); err != nil {
+					return err
+				}
+			}
+
+			return h.restorePrevious(prev)
+		}
+
+		if !rollback && replacement != nil && isRunningHealthy(replacement) {
+			logrus.WithFields(logrus.Fields{
+				"rotation":  r.ID,
+				"container": shortID(replacement.ID),
+			}).Info("finishing rotation")
+			return h.removeContainer(context.Background(), e, old.ID, r.stopOptions())
+		}
+
+		logrus.WithFields(logrus.Fields{
+			"rotation":  r.ID,
+			"container": shortID(old.ID),
+		}).Info("restoring previous container")
+
+		if replacement != nil {
+			if err := h.removeContainer(context.Background(), e, replacement.ID, r.stopOptions()); err != nil {
+				return err
+			}
+		}
+
+		if r.Compose && strings.TrimPrefix(old.Name, "/") != r.Name {
+			if err := e.client.ContainerRename(context.Background(), old.ID, r.Name); err != nil {
+				return err
+			}
+		}
+
+		if !old.State.Running {
+			return e.client.ContainerStart(context.Background(), old.ID, dockertypes.ContainerStartOptions{})
+		}
+
+		return nil
+	}
+
+	if replacement != nil {
+		if replacement.State.Running {
+			return nil
+		}
+
+		logrus.WithFields(logrus.Fields{
+			"rotation":  r.ID,
+			"container": shortID(replacement.ID),
+		}).Info("starting replacement container")
+		err := e.client.ContainerStart(context.Background(), replacement.ID, dockertypes.ContainerStartOptions{})
+		if err == nil {
+			return nil
+		}
+
+		logrus.WithFields(logrus.Fields{
+			"rotation":  r.ID,
+			"container": shortID(replacement.ID),
+		}).Errorf("error starting replacement container: %s", err)
+		if err := h.removeContainer(context.Background(), e, replacement.ID, r.stopOptions()); err != nil {
+			return err
+		}
+	}
+
+	return h.restoreContainer(e, r)
+}
+
+// restoreContainer recreates the removed old container from the journal
+// using the image it was running
+func (h *Handler) restoreContainer(e *engine, r *rotation) error {
+	if r.Config == nil || r.HostConfig == nil {
+		return fmt.Errorf("rotation %s has no container configuration to restore", r.ID)
+	}
+
+	logrus.WithFields(logrus.Fields{
+		"rotation": r.ID,
+		"name":     r.Name,
+		"image":    r.ImageID,
+	}).Info("recreating previous container")
+
+	cfg := *r.Config
+	if r.ImageID != "" {
+		cfg.Image = r.ImageID
+	}
+
+	resp, err := e.client.ContainerCreate(context.Background(), &cfg, r.HostConfig, r.NetworkingConfig, r.Name)
+	if err != nil {
+		return err
+	}
+
+	// discard removes the recreated container so that the restore can be
+	// retried with the same name
+	discard := func() {
+		if err := h.removeContainer(context.Background(), e, resp.ID, r.stopOptions()); err != nil {
+			logrus.Error(err)
+		}
+	}
+
+	if err := h.connectNetworks(context.Background(), e, resp.ID, r.ExtraNetworks); err != nil {
+		discard()
+		return err
+	}
+
+	if err := e.client.ContainerStart(context.Background(), resp.ID, dockertypes.ContainerStartOptions{}); err != nil {
+		discard()
+		return err
+	}
+
+	return nil
+}
+
+func isRunningHealthy(c *dockertypes.ContainerJSON) bool {
+	if c.State == nil || !c.State.Running {
+		return false
+	}
+
+	return c.State.Health == nil || c.State.Health.Status == dockertypes.Healthy
+}
+
+func shortID(id string) string {
+	if len(id) > 10 {
+		return id[:10]
+	}
+
+	return id
+}
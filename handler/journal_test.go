@@ -0,0 +1,240 @@
+package handler
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	dockertypes "github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+)
+
+func TestRecoverRotation(t *testing.T) {
+	tests := []struct {
+		name string
+		// setup adds the containers and returns the rotation to recover
+		setup    func(f *fakeEngine, h *Handler) *rotation
+		rollback bool
+		calls    []string
+	}{
+		{
+			name: "healthy replacement is kept",
+			setup: func(f *fakeEngine, h *Handler) *rotation {
+				old := f.add("old", "app", true, nil)
+				repl := f.add("new", "app-new", true, nil)
+				return &rotation{ID: "r1", OldID: old.ID, NewID: repl.ID}
+			},
+			calls: []string{"stop app", "remove app"},
+		},
+		{
+			name: "healthy replacement is removed on rollback",
+			setup: func(f *fakeEngine, h *Handler) *rotation {
+				old := f.add("old", "app", false, nil)
+				repl := f.add("new", "app-new", true, nil)
+				return &rotation{ID: "r1", OldID: old.ID, NewID: repl.ID}
+			},
+			rollback: true,
+			calls:    []string{"stop app-new", "remove app-new", "start app"},
+		},
+		{
+			name: "stopped replacement is removed and the compose name restored",
+			setup: func(f *fakeEngine, h *Handler) *rotation {
+				old := f.add("old", "app_web_1"+composeOldSuffix, false, nil)
+				repl := f.add("new", "app_web_1", false, nil)
+				return &rotation{ID: "r1", OldID: old.ID, NewID: repl.ID, Name: "app_web_1", Compose: true}
+			},
+			calls: []string{
+				"stop app_web_1",
+				"remove app_web_1",
+				"rename app_web_1" + composeOldSuffix + " app_web_1",
+				"start app_web_1",
+			},
+		},
+		{
+			name: "replacement created before it was journaled",
+			setup: func(f *fakeEngine, h *Handler) *rotation {
+				old := f.add("old", "app", true, nil)
+				f.add("new", "", true, map[string]string{labelRotation: "r1"})
+				return &rotation{ID: "r1", OldID: old.ID}
+			},
+			calls: []string{"stop app", "remove app"},
+		},
+		{
+			name: "retained old container with a healthy replacement",
+			setup: func(f *fakeEngine, h *Handler) *rotation {
+				old := f.add("old", "app-previous", false, nil)
+				repl := f.add("new", "app", true, nil)
+				h.previous = []*retained{{ID: old.ID, Engine: "local", Service: "svc", Name: "app"}}
+				return &rotation{ID: "r1", OldID: old.ID, NewID: repl.ID}
+			},
+			calls: []string{},
+		},
+		{
+			name: "retained old container is restored",
+			setup: func(f *fakeEngine, h *Handler) *rotation {
+				old := f.add("old", "app-previous", false, nil)
+				h.previous = []*retained{{ID: old.ID, Engine: "local", Service: "svc", Name: "app"}}
+				return &rotation{ID: "r1", OldID: old.ID}
+			},
+			calls: []string{"rename app-previous app", "start app"},
+		},
+		{
+			name: "replacement is started when the old container is gone",
+			setup: func(f *fakeEngine, h *Handler) *rotation {
+				repl := f.add("new", "app", false, nil)
+				return &rotation{ID: "r1", OldID: "gone", NewID: repl.ID}
+			},
+			calls: []string{"start app"},
+		},
+		{
+			name: "running replacement is kept when the old container is gone",
+			setup: func(f *fakeEngine, h *Handler) *rotation {
+				repl := f.add("new", "app", true, nil)
+				return &rotation{ID: "r1", OldID: "gone", NewID: repl.ID}
+			},
+			calls: []string{},
+		},
+		{
+			name: "old container is recreated when the replacement does not start",
+			setup: func(f *fakeEngine, h *Handler) *rotation {
+				repl := f.add("new", "app-new", false, nil)
+				f.failStart[repl.ID] = true
+				return &rotation{
+					ID:         "r1",
+					OldID:      "gone",
+					NewID:      repl.ID,
+					Name:       "app",
+					ImageID:    "sha256:old",
+					Config:     &container.Config{Image: "app:1"},
+					HostConfig: &container.HostConfig{},
+				}
+			},
+			calls: []string{
+				"start app-new",
+				"stop app-new",
+				"remove app-new",
+				"create sha256:old",
+				"start app",
+			},
+		},
+		{
+			name: "old container is recreated when neither container exists",
+			setup: func(f *fakeEngine, h *Handler) *rotation {
+				return &rotation{
+					ID:         "r1",
+					OldID:      "gone",
+					Name:       "app",
+					ImageID:    "sha256:old",
+					Config:     &container.Config{Image: "app:1"},
+					HostConfig: &container.HostConfig{},
+				}
+			},
+			calls: []string{"create sha256:old", "start app"},
+		},
+	}
+
+	for _, tt := range tests {
+		h, f := newFakeHandler(t)
+		r := tt.setup(f, h)
+		r.Engine = "local"
+
+		if err := h.recoverRotation(r, tt.rollback); err != nil {
+			t.Errorf("%s: recoverRotation error: %s", tt.name, err)
+			continue
+		}
+		if got := f.recorded(""); !reflect.DeepEqual(got, tt.calls) {
+			t.Errorf("%s: calls = %v, want %v", tt.name, got, tt.calls)
+		}
+	}
+}
+
+func TestRecoverRotationWithoutConfig(t *testing.T) {
+	h, _ := newFakeHandler(t)
+
+	r := &rotation{ID: "r1", Engine: "local", OldID: "gone", Started: time.Now()}
+	if err := h.recoverRotation(r, false); err == nil {
+		t.Error("recoverRotation = nil error, want error for a rotation without a configuration")
+	}
+}
+
+func TestIsRunningHealthy(t *testing.T) {
+	tests := []struct {
+		state *dockertypes.ContainerState
+		want  bool
+	}{
+		{&dockertypes.ContainerState{Running: true}, true},
+		{&dockertypes.ContainerState{Running: false}, false},
+		{&dockertypes.ContainerState{Running: true, Health: &dockertypes.Health{Status: dockertypes.Healthy}}, true},
+		{&dockertypes.ContainerState{Running: true, Health: &dockertypes.Health{Status: dockertypes.Starting}}, false},
+		{&dockertypes.ContainerState{Running: true, Health: &dockertypes.Health{Status: dockertypes.Unhealthy}}, false},
+	}
+
+	for _, tt := range tests {
+		c := &dockertypes.ContainerJSON{ContainerJSONBase: &dockertypes.ContainerJSONBase{State: tt.state}}
+		if got := isRunningHealthy(c); got != tt.want {
+			t.Errorf("isRunningHealthy(%+v) = %t, want %t", tt.state, got, tt.want)
+		}
+	}
+}
+
+func TestRecoverRotations(t *testing.T) {
+	h, f := newFakeHandler(t)
+	old := f.add("old", "app", true, nil)
+	f.add("new", "", true, map[string]string{labelRotation: "r1"})
+
+	r := &rotation{ID: "r1", Engine: "local", OldID: old.ID}
+	if err := h.writeJournal(r, stepBegin); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := h.recoverRotations(); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := f.recorded(""), []string{"stop app", "remove app"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("calls = %v, want %v", got, want)
+	}
+	if _, err := os.Stat(h.journalPath(r.ID)); !os.IsNotExist(err) {
+		t.Errorf("journal of the recovered rotation was not removed: %v", err)
+	}
+}
+
+func TestRotateLabelsReplacement(t *testing.T) {
+	h, f := newFakeHandler(t)
+	old := f.add("old", "app", true, map[string]string{"owner": "web"})
+	old.Config.Image = "app:1"
+
+	e, _ := h.engine("local")
+	target := &deployTarget{
+		Engine:    e,
+		Container: dockertypes.Container{ID: old.ID, Image: "app:1"},
+		Options:   &deployOptions{Strategy: StrategyStartFirst},
+		Image:     "app:2",
+	}
+	if err := h.rotate(context.Background(), target); err != nil {
+		t.Fatal(err)
+	}
+
+	f.mu.Lock()
+	repl := f.containers[target.NewID]
+	f.mu.Unlock()
+	if repl == nil {
+		t.Fatal("replacement was not created")
+	}
+	if repl.Config.Labels[labelRotation] == "" {
+		t.Error("replacement is not labeled with its rotation")
+	}
+	if repl.Config.Labels["owner"] != "web" {
+		t.Error("replacement did not keep the labels of the old container")
+	}
+
+	journals, err := filepath.Glob(filepath.Join(h.config.StateDir, journalDir, "*.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(journals) != 0 {
+		t.Errorf("journals left after the rotation: %v", journals)
+	}
+}
@@ -0,0 +1,212 @@
+package handler
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	dockertypes "github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+)
+
+const (
+	// labelEnable opts a container in (or out) of conduit management
+	labelEnable = "conduit.enable"
+	// labelStrategy overrides the rotation strategy for a container
+	labelStrategy = "conduit.strategy"
+	// labelHealthTimeout overrides how long to wait for the new container
+	// to report healthy
+	labelHealthTimeout = "conduit.health-timeout"
+	// labelStopTimeout overrides how long to wait for the old container
+	// to stop before it is killed
+	labelStopTimeout = "conduit.stop-timeout"
+	// labelTags overrides the comma separated list of tags to deploy
+	labelTags = "conduit.tags"
+	// labelStopSignal overrides the signal sent to stop the old container
+	labelStopSignal = "conduit.stop-signal"
+	// labelKeepVolumes keeps the volumes of the old container when it is
+	// removed
+	labelKeepVolumes = "conduit.keep-volumes"
+	// labelReattachVolumes attaches the anonymous volumes of the old
+	// container to the replacement
+	labelReattachVolumes = "conduit.reattach-volumes"
+	// labelService identifies a container across rotations and is set by
+	// conduit on replacement containers
+	labelService = "conduit.service"
+	// labelDeployment is the deployment that created the container and is
+	// set by conduit on replacement containers
+	labelDeployment = "conduit.deployment"
+	// labelRotation is the journaled rotation that created the container
+	// and is set by conduit on replacement containers so that a
+	// replacement created before it was journaled can be found
+	labelRotation = "conduit.rotation"
+	// labelGroup names the group of containers that are rotated together
+	// when any of them is deployed
+	labelGroup = "conduit.group"
+	// labelGroupOrder is the position of the container in its group;
+	// lower orders are rotated first
+	labelGroupOrder = "conduit.group-order"
+)
+
+const (
+	// StrategyAuto stops the old container first only when it publishes
+	// host ports; otherwise the new container is started first
+	StrategyAuto = "auto"
+	// StrategyStopFirst always stops the old container before starting
+	// the new one
+	StrategyStopFirst = "stop-first"
+	// StrategyStartFirst always starts the new container before stopping
+	// the old one
+	StrategyStartFirst = "start-first"
+)
+
+// deployOptions are the effective settings used to rotate a single
+// container after the container labels have been applied on top of
+// the handler configuration
+type deployOptions struct {
+	Strategy      string
+	HealthTimeout time.Duration
+	StopTimeout   time.Duration
+	// StopSignal is sent to stop the old container instead of its own
+	// stop signal when set
+	StopSignal      string
+	KeepVolumes     bool
+	ReattachVolumes bool
+	// KeepPrevious is the number of previous containers kept stopped for
+	// rollback
+	KeepPrevious int
+	Tags         []string
+}
+
+func validStrategy(s string) bool {
+	switch s {
+	case StrategyAuto, StrategyStopFirst, StrategyStartFirst:
+		return true
+	}
+
+	return false
+}
+
+// isEnabled reports whether the container should be managed by conduit.
+// A container can always opt out with conduit.enable=false; when label
+// mode is enabled it must also opt in with conduit.enable=true.  An
+// invalid value is treated as an opt out.
+func (h *Handler) isEnabled(c dockertypes.Container) bool {
+	v, ok := c.Labels[labelEnable]
+	if !ok {
+		return !h.config.LabelEnable
+	}
+
+	enabled, err := strconv.ParseBool(v)
+	if err != nil {
+		logrus.WithFields(logrus.Fields{
+			"container": shortID(c.ID),
+			"names":     strings.Join(c.Names, ", "),
+			"value":     v,
+		}).Warnf("invalid %s label; not deploying container", labelEnable)
+		return false
+	}
+
+	return enabled
+}
+
+// containerOptions returns the settings used to rotate the container.
+// Container labels take precedence over the repository configuration
+// which takes precedence over the container's own stop timeout and the
+// handler configuration.
+func (h *Handler) containerOptions(repo string, config *container.Config) (*deployOptions, error) {
+	labels := config.Labels
+	opts := &deployOptions{
+		Strategy:      h.config.Strategy,
+		HealthTimeout: h.config.HealthTimeout,
+		StopTimeout:   h.config.StopTimeout,
+		KeepVolumes:   h.config.KeepVolumes,
+		KeepPrevious:  h.config.KeepPrevious,
+		Tags:          h.config.Tags,
+	}
+
+	if opts.Strategy == "" {
+		opts.Strategy = StrategyAuto
+	}
+
+	if config.StopTimeout != nil {
+		opts.StopTimeout = time.Duration(*config.StopTimeout) * time.Second
+	}
+
+	rc := h.repositoryConfig(repo)
+	if rc.StopTimeout != "" {
+		d, err := time.ParseDuration(rc.StopTimeout)
+		if err != nil {
+			return nil, fmt.Errorf("invalid stop timeout for %s: %s", repo, err)
+		}
+		opts.StopTimeout = d
+	}
+	if rc.StopSignal != "" {
+		opts.StopSignal = rc.StopSignal
+	}
+	opts.KeepVolumes = opts.KeepVolumes || rc.KeepVolumes
+	opts.ReattachVolumes = rc.ReattachVolumes
+	if rc.KeepPrevious > 0 {
+		opts.KeepPrevious = rc.KeepPrevious
+	}
+
+	if v, ok := labels[labelStrategy]; ok {
+		if !validStrategy(v) {
+			return nil, fmt.Errorf("invalid %s label: %s", labelStrategy, v)
+		}
+		opts.Strategy = v
+	}
+
+	if v, ok := labels[labelHealthTimeout]; ok {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s label: %s", labelHealthTimeout, err)
+		}
+		opts.HealthTimeout = d
+	}
+
+	if v, ok := labels[labelStopTimeout]; ok {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s label: %s", labelStopTimeout, err)
+		}
+		opts.StopTimeout = d
+	}
+
+	if v, ok := labels[labelStopSignal]; ok {
+		opts.StopSignal = v
+	}
+
+	for label, opt := range map[string]*bool{
+		labelKeepVolumes:     &opts.KeepVolumes,
+		labelReattachVolumes: &opts.ReattachVolumes,
+	} {
+		v, ok := labels[label]
+		if !ok {
+			continue
+		}
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s label: %s", label, v)
+		}
+		*opt = b
+	}
+
+	// reattached volumes are still in use so they cannot be removed
+	if opts.ReattachVolumes {
+		opts.KeepVolumes = true
+	}
+
+	if v, ok := labels[labelTags]; ok {
+		opts.Tags = []string{}
+		for _, t := range strings.Split(v, ",") {
+			if t = strings.TrimSpace(t); t != "" {
+				opts.Tags = append(opts.Tags, t)
+			}
+		}
+	}
+
+	return opts, nil
+}
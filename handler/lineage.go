@@ -0,0 +1,79 @@
+package handler
+
+import (
+	"context"
+	"strings"
+
+	"github.com/Sirupsen/logrus"
+	dockertypes "github.com/docker/docker/api/types"
+)
+
+// isImageID reports whether the image of a container is reported as the
+// image id rather than a reference.  The engine does this when the tag the
+// container was created from has since been moved to another image.
+func isImageID(image, imageID string) bool {
+	if strings.HasPrefix(image, "sha256:") {
+		return true
+	}
+
+	if len(image) < 12 || strings.Trim(image, "0123456789abcdef") != "" {
+		return false
+	}
+
+	return strings.HasPrefix(strings.TrimPrefix(imageID, "sha256:"), image)
+}
+
+// imageLineage returns the references the container image is known by.
+// The reported image is used when it is a reference; otherwise the image
+// the container was created with (from cfg when the container could be
+// inspected) and the tags and digests of its image are resolved from the
+// engine.
+func (e *engine) imageLineage(c dockertypes.Container, cfg *dockertypes.ContainerJSON) []string {
+	if !isImageID(c.Image, c.ImageID) {
+		return []string{c.Image}
+	}
+
+	refs := []string{}
+	add := func(ref string) {
+		if ref != "" && !isImageID(ref, c.ImageID) && !containsString(refs, ref) {
+			refs = append(refs, ref)
+		}
+	}
+
+	if cfg != nil && cfg.Config != nil {
+		add(cfg.Config.Image)
+	}
+
+	if img, _, err := e.client.ImageInspectWithRaw(context.Background(), c.ImageID); err == nil {
+		for _, ref := range img.RepoTags {
+			add(ref)
+		}
+		for _, ref := range img.RepoDigests {
+			add(ref)
+		}
+	}
+
+	if len(refs) == 0 {
+		return []string{c.Image}
+	}
+
+	logrus.WithFields(logrus.Fields{
+		"engine":    e.Name,
+		"container": shortID(c.ID),
+		"image":     c.Image,
+		"refs":      strings.Join(refs, ", "),
+	}).Debug("resolved container image lineage")
+
+	return refs
+}
+
+// repositoryImage returns the first of the references in the repository
+func repositoryImage(refs []string, repo string) (string, bool) {
+	for _, ref := range refs {
+		if r, _ := parseImage(ref); r == repo {
+			return ref, true
+		}
+	}
+
+	return "", false
+}
@@ -0,0 +1,337 @@
+package handler
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/Sirupsen/logrus"
+	dockertypes "github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/network"
+	"github.com/docker/go-connections/nat"
+	"github.com/ehazlett/conduit/policy"
+	"github.com/ehazlett/conduit/types"
+)
+
+const (
+	servicesFile = "services.json"
+
+	// labelManifestService is the manifest service of a container created
+	// by a reconcile
+	labelManifestService = "conduit.manifest-service"
+	// labelManifestReplica is the replica number of the container in its
+	// manifest service
+	labelManifestReplica = "conduit.manifest-replica"
+	// labelManifestHash is the hash of the service spec the container was
+	// created from and is used to detect drift
+	labelManifestHash = "conduit.manifest-hash"
+
+	defaultRestart = "unless-stopped"
+)
+
+// service is a manifest service with its parsed settings
+type service struct {
+	spec     types.ServiceSpec
+	repo     string
+	tag      string
+	replicas int
+	policy   policy.Policy
+	exposed  nat.PortSet
+	bindings nat.PortMap
+	restart  container.RestartPolicy
+	hash     string
+}
+
+// serviceTag is the tag a manifest service was moved to by a deploy.  Image
+// is the manifest image at that time so that a changed manifest image
+// takes precedence over the pushed tag.
+type serviceTag struct {
+	Image string `json:"image"`
+	Tag   string `json:"tag"`
+}
+
+// serviceContainer is the configuration of a container of a manifest
+// service.  Networks are connected after the container is created on the
+// first network of the service.
+type serviceContainer struct {
+	Config     *container.Config
+	HostConfig *container.HostConfig
+	Networks   map[string]*network.EndpointSettings
+}
+
+// newServices validates the manifest and returns its services
+func newServices(m *types.Manifest) ([]*service, error) {
+	if m == nil {
+		return nil, nil
+	}
+
+	services := []*service{}
+	seen := map[string]bool{}
+	for _, spec := range m.Services {
+		if spec.Name == "" {
+			return nil, fmt.Errorf("manifest service without a name")
+		}
+		if seen[spec.Name] {
+			return nil, fmt.Errorf("duplicate manifest service %s", spec.Name)
+		}
+		seen[spec.Name] = true
+
+		if spec.Image == "" {
+			return nil, fmt.Errorf("manifest service %s has no image", spec.Name)
+		}
+		if spec.Replicas < 0 {
+			return nil, fmt.Errorf("invalid replicas for manifest service %s: %d", spec.Name, spec.Replicas)
+		}
+
+		p, err := policy.New(spec.Policy)
+		if err != nil {
+			return nil, fmt.Errorf("invalid policy for manifest service %s: %s", spec.Name, err)
+		}
+
+		exposed, bindings, err := nat.ParsePortSpecs(spec.Ports)
+		if err != nil {
+			return nil, fmt.Errorf("invalid ports for manifest service %s: %s", spec.Name, err)
+		}
+
+		restart, err := parseRestartPolicy(spec.Restart)
+		if err != nil {
+			return nil, fmt.Errorf("invalid restart policy for manifest service %s: %s", spec.Name, err)
+		}
+
+		s := &service{
+			spec:     spec,
+			replicas: spec.Replicas,
+			policy:   p,
+			exposed:  exposed,
+			bindings: bindings,
+			restart:  restart,
+		}
+		s.repo, s.tag = parseImage(spec.Image)
+		if s.replicas == 0 {
+			s.replicas = 1
+		}
+		s.hash = specHash(s)
+
+		services = append(services, s)
+	}
+
+	return services, nil
+}
+
+// parseRestartPolicy parses a restart policy in the docker run format
+// (i.e. "on-failure:3")
+func parseRestartPolicy(v string) (container.RestartPolicy, error) {
+	if v == "" {
+		v = defaultRestart
+	}
+
+	parts := strings.SplitN(v, ":", 2)
+	p := container.RestartPolicy{Name: parts[0]}
+	switch p.Name {
+	case "no", "always", "unless-stopped":
+		if len(parts) > 1 {
+			return p, fmt.Errorf("%s does not take a retry count", p.Name)
+		}
+	case "on-failure":
+		if len(parts) > 1 {
+			n, err := strconv.Atoi(parts[1])
+			if err != nil || n < 0 {
+				return p, fmt.Errorf("invalid retry count %q", parts[1])
+			}
+			p.MaximumRetryCount = n
+		}
+	default:
+		return p, fmt.Errorf("unknown restart policy %q", v)
+	}
+
+	return p, nil
+}
+
+// specHash returns the hash of the settings of the service its containers
+// are created with.  The tag is excluded so that a service moved to a new
+// tag by a deploy is not considered drifted; the replicas and group only
+// decide how many containers run where.
+func specHash(s *service) string {
+	data, _ := json.Marshal(struct {
+		Repository string
+		Env        []string
+		Ports      []string
+		Networks   []string
+		Volumes    []string
+		Labels     map[string]string
+		Restart    container.RestartPolicy
+	}{
+		Repository: s.repo,
+		Env:        s.spec.Env,
+		Ports:      s.spec.Ports,
+		Networks:   s.spec.Networks,
+		Volumes:    s.spec.Volumes,
+		Labels:     s.spec.Labels,
+		Restart:    s.restart,
+	})
+
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])[:12]
+}
+
+// containerSpec returns the configuration of a replica of the service
+// running the image
+func (s *service) containerSpec(replica int, image string) *serviceContainer {
+	labels := map[string]string{}
+	for k, v := range s.spec.Labels {
+		labels[k] = v
+	}
+	labels[labelManifestService] = s.spec.Name
+	labels[labelManifestReplica] = strconv.Itoa(replica)
+	labels[labelManifestHash] = s.hash
+
+	spec := &serviceContainer{
+		Config: &container.Config{
+			Image:  image,
+			Env:    s.spec.Env,
+			Labels: labels,
+		},
+		HostConfig: &container.HostConfig{
+			Binds:         s.spec.Volumes,
+			RestartPolicy: s.restart,
+		},
+		Networks: map[string]*network.EndpointSettings{},
+	}
+
+	// the container types use the copy of nat vendored with the docker
+	// client so the ports are converted through their api form
+	convertPorts(s.exposed, &spec.Config.ExposedPorts)
+	convertPorts(s.bindings, &spec.HostConfig.PortBindings)
+
+	for i, name := range s.spec.Networks {
+		if i == 0 {
+			spec.HostConfig.NetworkMode = container.NetworkMode(name)
+			continue
+		}
+		spec.Networks[name] = &network.EndpointSettings{}
+	}
+
+	return spec
+}
+
+func convertPorts(from, to interface{}) {
+	data, err := json.Marshal(from)
+	if err != nil {
+		return
+	}
+
+	json.Unmarshal(data, to)
+}
+
+// specLabels returns the labels of a replacement created from the service
+// container spec of the old container
+func specLabels(spec *serviceContainer, cfg dockertypes.ContainerJSON, deploymentID string) map[string]string {
+	labels := map[string]string{}
+	for k, v := range spec.Config.Labels {
+		labels[k] = v
+	}
+
+	labels[labelService] = serviceKey(cfg)
+	if deploymentID != "" {
+		labels[labelDeployment] = deploymentID
+	}
+
+	return labels
+}
+
+// serviceImage returns the image the service should run.  This is the
+// manifest image unless a deploy has since moved the service to a pushed
+// tag.
+func (h *Handler) serviceImage(s *service) string {
+	h.serviceLock.Lock()
+	defer h.serviceLock.Unlock()
+
+	if st, ok := h.serviceTags[s.spec.Name]; ok && st.Image == s.spec.Image {
+		return s.repo + ":" + st.Tag
+	}
+
+	return s.repo + ":" + s.tag
+}
+
+// updateServiceTags moves the manifest services of the repository to the
+// deployed tag when it matches their update policy.  A rollback moves them
+// to the restored tag regardless of the policy.
+func (h *Handler) updateServiceTags(repo, tag string, rollback bool) {
+	if tag == "" {
+		return
+	}
+
+	changed := false
+	for _, s := range h.services {
+		if s.repo != repo {
+			continue
+		}
+
+		_, current := parseImage(h.serviceImage(s))
+		if current == tag || (!rollback && !s.policy.Match(current, tag)) {
+			continue
+		}
+
+		h.serviceLock.Lock()
+		h.serviceTags[s.spec.Name] = &serviceTag{
+			Image: s.spec.Image,
+			Tag:   tag,
+		}
+		h.serviceLock.Unlock()
+		changed = true
+	}
+
+	if !changed {
+		return
+	}
+
+	if err := h.saveServiceTags(); err != nil {
+		logrus.Errorf("error saving service tags: %s", err)
+	}
+}
+
+func (h *Handler) serviceTagsPath() string {
+	return filepath.Join(h.config.StateDir, servicesFile)
+}
+
+// saveServiceTags persists the tags the manifest services were moved to
+func (h *Handler) saveServiceTags() error {
+	h.serviceLock.Lock()
+	data, err := json.MarshalIndent(h.serviceTags, "", "    ")
+	h.serviceLock.Unlock()
+	if err != nil {
+		return err
+	}
+
+	tmp := h.serviceTagsPath() + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, h.serviceTagsPath())
+}
+
+func loadServiceTags(path string) (map[string]*serviceTag, error) {
+	tags := map[string]*serviceTag{}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return tags, nil
+		}
+		return nil, err
+	}
+
+	if err := json.Unmarshal(data, &tags); err != nil {
+		return nil, err
+	}
+
+	return tags, nil
+}
@@ -0,0 +1,70 @@
+package handler
+
+import (
+	"github.com/ehazlett/conduit/metrics"
+)
+
+var (
+	webhooksReceived = metrics.NewCounterVec(
+		"conduit_webhooks_received_total",
+		"Webhooks received by repository and outcome",
+		"repository", "outcome",
+	)
+	authFailures = metrics.NewCounter(
+		"conduit_auth_failures_total",
+		"Webhooks rejected because of an invalid token",
+	)
+	deployDuration = metrics.NewHistogramVec(
+		"conduit_deploy_duration_seconds",
+		"Time taken to deploy a repository",
+		metrics.DefaultBuckets,
+		"repository", "outcome",
+	)
+	pullDuration = metrics.NewHistogramVec(
+		"conduit_image_pull_duration_seconds",
+		"Time taken to pull an image",
+		metrics.DefaultBuckets,
+		"repository",
+	)
+	rollbacks = metrics.NewCounterVec(
+		"conduit_rollbacks_total",
+		"Rotations that were rolled back to the previous container",
+		"repository",
+	)
+	queueDepth = metrics.NewGauge(
+		"conduit_queue_depth",
+		"Deploys waiting or in progress",
+	)
+	callbackDeliveries = metrics.NewCounterVec(
+		"conduit_callback_deliveries_total",
+		"Webhook callback deliveries by outcome",
+		"outcome",
+	)
+	callbackRetries = metrics.NewCounter(
+		"conduit_callback_retries_total",
+		"Webhook callback delivery attempts that were retried",
+	)
+	imagesRemoved = metrics.NewCounterVec(
+		"conduit_images_removed_total",
+		"Unused images removed by repository",
+		"repository",
+	)
+	reconcileActions = metrics.NewCounterVec(
+		"conduit_reconcile_actions_total",
+		"Containers created, replaced or removed to match the manifest",
+		"service", "action",
+	)
+	dockerErrors = metrics.NewCounterVec(
+		"conduit_docker_api_errors_total",
+		"Docker API errors by operation",
+		"operation",
+	)
+)
+
+const (
+	outcomeSuccess      = "success"
+	outcomeError        = "error"
+	outcomeUnauthorized = "unauthorized"
+	outcomeRejected     = "rejected"
+	outcomeInvalid      = "invalid"
+)
@@ -0,0 +1,205 @@
+package handler
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/Sirupsen/logrus"
+	dockertypes "github.com/docker/docker/api/types"
+	"github.com/docker/go-units"
+	"github.com/ehazlett/conduit/types"
+)
+
+const (
+	// pullExpansion estimates the disk space used by an image from its
+	// compressed size in the registry
+	pullExpansion = 2
+)
+
+// preflight verifies each engine has the disk space to pull the target
+// images and the memory to start the replacement containers before any
+// container is rotated.  Images whose size is unknown are recorded in the
+// plan.
+func (h *Handler) preflight(ctx context.Context, plan *types.DeployPlan, targets []*deployTarget) error {
+	engines := []*engine{}
+	byEngine := map[*engine][]*deployTarget{}
+	for _, t := range targets {
+		if _, ok := byEngine[t.Engine]; !ok {
+			engines = append(engines, t.Engine)
+		}
+		byEngine[t.Engine] = append(byEngine[t.Engine], t)
+	}
+
+	errs := []string{}
+	for _, e := range engines {
+		info, err := e.client.Info(ctx)
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("engine %s: %s", e.Name, err))
+			continue
+		}
+
+		unknown, err := h.preflightDisk(ctx, e, info, byEngine[e])
+		if err != nil {
+			errs = append(errs, err.Error())
+		}
+		for _, image := range unknown {
+			if !containsString(plan.SizeUnknown, image) {
+				plan.SizeUnknown = append(plan.SizeUnknown, image)
+			}
+		}
+		if err := h.preflightMemory(ctx, e, info, byEngine[e]); err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+
+	if len(errs) > 0 {
+		return fmt.Errorf("preflight failed: %s", strings.Join(errs, "; "))
+	}
+
+	return nil
+}
+
+// preflightDisk checks the free space of the engine against the size of
+// the images that are not yet on the engine.  It returns the images whose
+// size could not be looked up.
+func (h *Handler) preflightDisk(ctx context.Context, e *engine, info dockertypes.Info, targets []*deployTarget) ([]string, error) {
+	free, ok := engineFreeSpace(e, info)
+	if !ok {
+		logrus.WithFields(logrus.Fields{
+			"engine": e.Name,
+		}).Debug("free space of engine is unknown; skipping disk preflight")
+		return nil, nil
+	}
+
+	required := h.config.MinFreeSpace
+	images := []string{}
+	unknown := []string{}
+	for _, t := range targets {
+		if containsString(images, t.Image) {
+			continue
+		}
+		images = append(images, t.Image)
+
+		size, err := h.registry.imageSize(ctx, t.Image, info.OSType, platformArch(info.Architecture))
+		if err != nil {
+			logrus.WithFields(logrus.Fields{
+				"engine": e.Name,
+				"image":  t.Image,
+			}).Warnf("unable to get image size for preflight: %s", err)
+			unknown = append(unknown, t.Image)
+			continue
+		}
+
+		if h.hasDigest(ctx, e, t.Image, size.Digest) {
+			continue
+		}
+		required += size.Size * pullExpansion
+	}
+
+	logrus.WithFields(logrus.Fields{
+		"engine":   e.Name,
+		"free":     units.BytesSize(float64(free)),
+		"required": units.BytesSize(float64(required)),
+	}).Debug("disk preflight")
+
+	if free < required {
+		return unknown, fmt.Errorf("engine %s has %s free but %s is required to pull %s",
+			e.Name, units.BytesSize(float64(free)), units.BytesSize(float64(required)), strings.Join(images, ", "))
+	}
+
+	return unknown, nil
+}
+
+// hasDigest reports whether the image with the manifest digest is already
+// on the engine
+func (h *Handler) hasDigest(ctx context.Context, e *engine, image, digest string) bool {
+	if digest == "" {
+		return false
+	}
+
+	img, _, err := e.client.ImageInspectWithRaw(ctx, image)
+	if err != nil {
+		return false
+	}
+
+	repo, _ := parseImage(image)
+	return containsString(img.RepoDigests, repo+"@"+digest)
+}
+
+// preflightMemory checks that a replacement started before the old
+// container is stopped fits in the memory not reserved by the limits of
+// the running containers
+func (h *Handler) preflightMemory(ctx context.Context, e *engine, info dockertypes.Info, targets []*deployTarget) error {
+	if info.MemTotal == 0 {
+		return nil
+	}
+
+	// containers are rotated one at a time so only one replacement runs
+	// next to its old container
+	var needed int64
+	for _, t := range targets {
+		if t.Info.HostConfig == nil || isStopFirst(t.Options, t.Info.HostConfig) {
+			continue
+		}
+		if m := t.Info.HostConfig.Memory; m > needed {
+			needed = m
+		}
+	}
+	if needed == 0 {
+		return nil
+	}
+
+	// the limits are kept in the inventory and refreshed by the update
+	// events of the containers
+	reserved, err := e.inventory.reservedMemory()
+	if err != nil {
+		return fmt.Errorf("engine %s: %s", e.Name, err)
+	}
+
+	if reserved+needed > info.MemTotal {
+		return fmt.Errorf("engine %s has %s of %s memory reserved by running containers but %s is required to start a replacement",
+			e.Name, units.BytesSize(float64(reserved)), units.BytesSize(float64(info.MemTotal)), units.BytesSize(float64(needed)))
+	}
+
+	return nil
+}
+
+// engineFreeSpace returns the space available for images on the engine.
+// It is reported by the devicemapper storage driver; for other drivers it
+// is only known when the engine root directory is on the conduit host.
+func engineFreeSpace(e *engine, info dockertypes.Info) (int64, bool) {
+	for _, kv := range info.DriverStatus {
+		if kv[0] != "Data Space Available" {
+			continue
+		}
+		n, err := units.FromHumanSize(kv[1])
+		if err != nil {
+			return 0, false
+		}
+		return n, true
+	}
+
+	if !e.isLocal() || info.DockerRootDir == "" {
+		return 0, false
+	}
+
+	return diskFree(info.DockerRootDir)
+}
+
+// platformArch converts the kernel architecture reported by the engine to
+// the architecture used by image manifests
+func platformArch(arch string) string {
+	switch arch {
+	case "x86_64":
+		return "amd64"
+	case "aarch64":
+		return "arm64"
+	case "armv7l", "armv6l":
+		return "arm"
+	case "i386", "i686":
+		return "386"
+	}
+
+	return arch
+}
@@ -0,0 +1,14 @@
+package handler
+
+import "syscall"
+
+// diskFree returns the space available to unprivileged users on the
+// filesystem of the path
+func diskFree(path string) (int64, bool) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(path, &st); err != nil {
+		return 0, false
+	}
+
+	return int64(st.Bavail) * int64(st.Bsize), true
+}
@@ -0,0 +1,9 @@
+//go:build !linux
+// +build !linux
+
+package handler
+
+// diskFree is not supported on this platform
+func diskFree(path string) (int64, bool) {
+	return 0, false
+}
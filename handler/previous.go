@@ -0,0 +1,439 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	dockertypes "github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/filters"
+	"github.com/docker/docker/client"
+	"github.com/ehazlett/conduit/types"
+)
+
+const (
+	previousFile = "previous.json"
+
+	// previousSuffix is added to the name of a previous container that
+	// is kept for rollback.  Docker cannot change the labels of an
+	// existing container so the name marks it as retained.
+	previousSuffix = "_conduit-prev-"
+)
+
+// retained is a previous container that was stopped rather than removed
+// so a rollback can restart it
+type retained struct {
+	ID         string `json:"id"`
+	Engine     string `json:"engine"`
+	Repository string `json:"repository"`
+	// Service identifies the containers that replaced each other
+	Service string `json:"service"`
+	// Name is the name of the container before it was retained
+	Name         string                  `json:"name"`
+	Image        string                  `json:"image"`
+	DeploymentID string                  `json:"deployment_id"`
+	Restart      container.RestartPolicy `json:"restart_policy"`
+	Retired      time.Time               `json:"retired"`
+}
+
+func (r *retained) info() types.PreviousContainer {
+	return types.PreviousContainer{
+		ID:           r.ID,
+		Engine:       r.Engine,
+		Name:         r.Name,
+		Image:        r.Image,
+		DeploymentID: r.DeploymentID,
+		Retired:      r.Retired,
+	}
+}
+
+// serviceKey identifies the container across rotations.  It is kept in
+// the conduit.service label of replacements and is the container name for
+// containers that conduit has not rotated before.
+func serviceKey(cfg dockertypes.ContainerJSON) string {
+	if v := cfg.Config.Labels[labelService]; v != "" {
+		return v
+	}
+
+	return strings.TrimSuffix(strings.TrimPrefix(cfg.Name, "/"), composeOldSuffix)
+}
+
+// replacementLabels returns the labels of the replacement of the container
+func replacementLabels(cfg dockertypes.ContainerJSON, deploymentID string) map[string]string {
+	labels := map[string]string{}
+	for k, v := range cfg.Config.Labels {
+		labels[k] = v
+	}
+
+	labels[labelService] = serviceKey(cfg)
+	if deploymentID != "" {
+		labels[labelDeployment] = deploymentID
+	}
+
+	return labels
+}
+
+// retireContainer takes the old container of the target out of service.
+// It is kept stopped for rollback when previous containers are kept and
+// removed otherwise.
+func (h *Handler) retireContainer(ctx context.Context, t *deployTarget) error {
+	if t.Options.KeepPrevious <= 0 {
+		return h.removeContainer(ctx, t.Engine, t.Container.ID, t.Options)
+	}
+
+	return h.retainContainer(ctx, t)
+}
+
+// retireRotated takes the old container of the rotated target out of
+// service unless the deploy retires it once every container is rotated
+func (h *Handler) retireRotated(ctx context.Context, t *deployTarget) error {
+	if t.DeferRetire {
+		return nil
+	}
+
+	return h.retireContainer(ctx, t)
+}
+
+// retainContainer stops and renames the old container of the target and
+// removes the previous containers of the service beyond the retention
+func (h *Handler) retainContainer(ctx context.Context, t *deployTarget) error {
+	e := t.Engine
+	id := t.Container.ID
+
+	if err := h.stopContainer(ctx, e, id, t.Options); err != nil {
+		return err
+	}
+
+	cfg, err := e.client.ContainerInspect(ctx, id)
+	if err != nil {
+		return err
+	}
+
+	// the engine must not restart the previous container
+	restart := cfg.HostConfig.RestartPolicy
+	if !restart.IsNone() {
+		if _, err := e.client.ContainerUpdate(ctx, id, container.UpdateConfig{
+			RestartPolicy: container.RestartPolicy{Name: "no"},
+		}); err != nil {
+			return err
+		}
+	}
+
+	name := strings.TrimSuffix(strings.TrimPrefix(cfg.Name, "/"), composeOldSuffix)
+	if err := e.client.ContainerRename(ctx, id, name+previousSuffix+shortID(id)); err != nil {
+		return err
+	}
+
+	repo, _ := parseImage(t.Container.Image)
+	r := &retained{
+		ID:           id,
+		Engine:       e.Name,
+		Repository:   repo,
+		Service:      serviceKey(cfg),
+		Name:         name,
+		Image:        t.Container.Image,
+		DeploymentID: t.DeploymentID,
+		Restart:      restart,
+		Retired:      time.Now(),
+	}
+
+	logrus.WithFields(logrus.Fields{
+		"container": shortID(id),
+		"service":   r.Service,
+	}).Info("keeping previous container for rollback")
+
+	h.previousLock.Lock()
+	h.previous = append(h.previous, r)
+	expired := h.expiredPrevious(e.Name, r.Service, t.Options.KeepPrevious)
+	h.savePrevious()
+	h.previousLock.Unlock()
+
+	for _, x := range expired {
+		logrus.WithFields(logrus.Fields{
+			"container": shortID(x.ID),
+			"service":   x.Service,
+		}).Info("removing expired previous container")
+
+		if err := h.removeContainer(context.Background(), e, x.ID, t.Options); err != nil && !client.IsErrContainerNotFound(err) {
+			logrus.Errorf("error removing previous container %s: %s", shortID(x.ID), err)
+		}
+	}
+
+	return nil
+}
+
+// expiredPrevious removes and returns the oldest previous containers of
+// the service beyond keep.  The previous lock must be held.
+func (h *Handler) expiredPrevious(engine, service string, keep int) []*retained {
+	kept := []*retained{}
+	matched := []*retained{}
+	for _, r := range h.previous {
+		if r.Engine == engine && r.Service == service {
+			matched = append(matched, r)
+			continue
+		}
+		kept = append(kept, r)
+	}
+
+	sort.Slice(matched, func(i, j int) bool {
+		return matched[i].Retired.After(matched[j].Retired)
+	})
+	if len(matched) <= keep {
+		return nil
+	}
+
+	h.previous = append(kept, matched[:keep]...)
+
+	return matched[keep:]
+}
+
+// isRetained reports whether the container is a previous container kept
+// for rollback.  The name is checked as well so that retained containers
+// are recognized when the retained state was lost.
+func (h *Handler) isRetained(c dockertypes.Container) bool {
+	if isRetainedName(c.Names) {
+		return true
+	}
+
+	return h.retainedContainer(c.ID) != nil
+}
+
+// isRetainedName reports whether the container names carry the suffix of
+// a retained container
+func isRetainedName(names []string) bool {
+	for _, n := range names {
+		if strings.Contains(n, previousSuffix) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// retainedContainer returns the previous container kept for rollback with
+// the id or nil
+func (h *Handler) retainedContainer(id string) *retained {
+	h.previousLock.Lock()
+	defer h.previousLock.Unlock()
+
+	for _, r := range h.previous {
+		if r.ID == id {
+			return r
+		}
+	}
+
+	return nil
+}
+
+// listPrevious returns the previous containers of the repository, newest
+// first
+func (h *Handler) listPrevious(repo string) []types.PreviousContainer {
+	h.previousLock.Lock()
+	defer h.previousLock.Unlock()
+
+	previous := []types.PreviousContainer{}
+	for _, r := range h.latestPrevious(repo, false) {
+		previous = append(previous, r.info())
+	}
+
+	return previous
+}
+
+// latestPrevious returns the previous containers of the repository,
+// newest first.  When latest is set only the newest container of each
+// service is returned.  The previous lock must be held.
+func (h *Handler) latestPrevious(repo string, latest bool) []*retained {
+	matched := []*retained{}
+	for _, r := range h.previous {
+		if r.Repository == repo {
+			matched = append(matched, r)
+		}
+	}
+	sort.Slice(matched, func(i, j int) bool {
+		return matched[i].Retired.After(matched[j].Retired)
+	})
+
+	if !latest {
+		return matched
+	}
+
+	seen := map[string]bool{}
+	services := []*retained{}
+	for _, r := range matched {
+		key := r.Engine + "/" + r.Service
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+		services = append(services, r)
+	}
+
+	return services
+}
+
+// rollbackPlan returns the previous containers a rollback of the
+// repository would restore
+func (h *Handler) rollbackPlan(repo string) *types.RollbackPlan {
+	h.previousLock.Lock()
+	defer h.previousLock.Unlock()
+
+	plan := &types.RollbackPlan{
+		Repository: repo,
+		DryRun:     true,
+		Containers: []types.PreviousContainer{},
+	}
+	for _, r := range h.latestPrevious(repo, true) {
+		plan.Containers = append(plan.Containers, r.info())
+	}
+
+	return plan
+}
+
+// rollback restarts the newest previous container of each service of the
+// repository in place of the running container
+func (h *Handler) rollback(repo string) (int, error) {
+	h.previousLock.Lock()
+	previous := h.latestPrevious(repo, true)
+	h.previousLock.Unlock()
+
+	if len(previous) == 0 {
+		return 0, fmt.Errorf("no previous containers of %s to roll back to", repo)
+	}
+
+	for _, r := range previous {
+		if err := h.restorePrevious(r); err != nil {
+			return 0, fmt.Errorf("error rolling back %s: %s", r.Name, err)
+		}
+
+		// the manifest services must not be reconciled forward again
+		if imgRepo, tag := parseImage(r.Image); imgRepo == repo {
+			h.updateServiceTags(repo, tag, true)
+		}
+	}
+
+	return len(previous), nil
+}
+
+// restorePrevious replaces the running containers of the service with the
+// previous container
+func (h *Handler) restorePrevious(r *retained) error {
+	e, err := h.engine(r.Engine)
+	if err != nil {
+		return err
+	}
+
+	args := filters.NewArgs()
+	args.Add("label", labelService+"="+r.Service)
+	current, err := e.client.ContainerList(context.Background(), dockertypes.ContainerListOptions{
+		Filters: args,
+	})
+	if err != nil {
+		return err
+	}
+
+	prev, err := e.client.ContainerInspect(context.Background(), r.ID)
+	if err != nil {
+		return err
+	}
+
+	opts, err := h.containerOptions(r.Repository, prev.Config)
+	if err != nil {
+		return err
+	}
+
+	for _, c := range current {
+		logrus.WithFields(logrus.Fields{
+			"container": shortID(c.ID),
+			"service":   r.Service,
+		}).Info("removing container for rollback")
+
+		if err := h.removeContainer(context.Background(), e, c.ID, opts); err != nil {
+			return err
+		}
+	}
+
+	if err := e.client.ContainerRename(context.Background(), r.ID, r.Name); err != nil {
+		return err
+	}
+
+	if !r.Restart.IsNone() {
+		if _, err := e.client.ContainerUpdate(context.Background(), r.ID, container.UpdateConfig{
+			RestartPolicy: r.Restart,
+		}); err != nil {
+			return err
+		}
+	}
+
+	logrus.WithFields(logrus.Fields{
+		"container": shortID(r.ID),
+		"service":   r.Service,
+		"image":     r.Image,
+	}).Info("restarting previous container")
+
+	if err := e.client.ContainerStart(context.Background(), r.ID, dockertypes.ContainerStartOptions{}); err != nil {
+		return err
+	}
+
+	h.previousLock.Lock()
+	kept := []*retained{}
+	for _, x := range h.previous {
+		if x.ID != r.ID {
+			kept = append(kept, x)
+		}
+	}
+	h.previous = kept
+	h.savePrevious()
+	h.previousLock.Unlock()
+
+	return h.waitForHealthy(context.Background(), e, r.ID, opts.HealthTimeout)
+}
+
+func (h *Handler) previousPath() string {
+	return filepath.Join(h.config.StateDir, previousFile)
+}
+
+// savePrevious persists the previous containers.  The previous lock must
+// be held.
+func (h *Handler) savePrevious() {
+	data, err := json.MarshalIndent(h.previous, "", "    ")
+	if err != nil {
+		logrus.Errorf("error saving previous containers: %s", err)
+		return
+	}
+
+	tmp := h.previousPath() + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+		logrus.Errorf("error saving previous containers: %s", err)
+		return
+	}
+
+	if err := os.Rename(tmp, h.previousPath()); err != nil {
+		logrus.Errorf("error saving previous containers: %s", err)
+	}
+}
+
+func loadPrevious(path string) ([]*retained, error) {
+	previous := []*retained{}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return previous, nil
+		}
+		return nil, err
+	}
+
+	if err := json.Unmarshal(data, &previous); err != nil {
+		return nil, err
+	}
+
+	return previous, nil
+}
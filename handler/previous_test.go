@@ -0,0 +1,60 @@
+package handler
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	dockertypes "github.com/docker/docker/api/types"
+)
+
+func TestIsRetained(t *testing.T) {
+	h := &Handler{
+		previous: []*retained{{ID: "kept"}},
+	}
+
+	tests := []struct {
+		c    dockertypes.Container
+		want bool
+	}{
+		{dockertypes.Container{ID: "kept", Names: []string{"/app"}}, true},
+		{dockertypes.Container{ID: "lost", Names: []string{"/app" + previousSuffix + "0123456789"}}, true},
+		{dockertypes.Container{ID: "running", Names: []string{"/app"}}, false},
+		{dockertypes.Container{ID: "unnamed"}, false},
+	}
+
+	for _, tt := range tests {
+		if got := h.isRetained(tt.c); got != tt.want {
+			t.Errorf("isRetained(%s %v) = %t, want %t", tt.c.ID, tt.c.Names, got, tt.want)
+		}
+	}
+}
+
+func TestRetainContainer(t *testing.T) {
+	h, f := newFakeHandler(t)
+	old := f.add("old", "app", true, map[string]string{labelDeployment: "d1"})
+
+	e, _ := h.engine("local")
+	target := &deployTarget{
+		Engine:       e,
+		Container:    dockertypes.Container{ID: old.ID, Image: "app:1"},
+		Options:      &deployOptions{KeepPrevious: 1},
+		DeploymentID: "d2",
+	}
+	if err := h.retainContainer(context.Background(), target); err != nil {
+		t.Fatal(err)
+	}
+
+	r := h.retainedContainer(old.ID)
+	if r == nil {
+		t.Fatal("container was not retained")
+	}
+	if r.DeploymentID != "d2" {
+		t.Errorf("retained deployment = %q, want the retiring deployment d2", r.DeploymentID)
+	}
+
+	want := []string{"stop app", "rename app app" + previousSuffix + shortID(old.ID)}
+	if got := f.recorded(""); !reflect.DeepEqual(got, want) {
+		t.Errorf("calls = %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,198 @@
+package handler
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	dockertypes "github.com/docker/docker/api/types"
+	"github.com/ehazlett/conduit/types"
+)
+
+// stageGroups returns the engine groups the repository is promoted
+// through.  It is empty when the repository is deployed to all engines
+// at once.
+func (h *Handler) stageGroups(repo string) []string {
+	p := h.repositoryConfig(repo).Promotion
+	if p == nil {
+		return nil
+	}
+
+	groups := []string{}
+	for _, s := range p.Stages {
+		groups = append(groups, s.Group)
+	}
+
+	return groups
+}
+
+// stageGroup returns the engine group deployed by the stage
+func (h *Handler) stageGroup(repo string, stage int) string {
+	groups := h.stageGroups(repo)
+	if stage >= len(groups) {
+		return ""
+	}
+
+	return groups[stage]
+}
+
+// stageSoak returns how long the stage must stay healthy before the
+// deploy is promoted to the next stage
+func (h *Handler) stageSoak(repo string, stage int) time.Duration {
+	p := h.repositoryConfig(repo).Promotion
+	if p == nil || stage >= len(p.Stages) || p.Stages[stage].Soak == "" {
+		return 0
+	}
+
+	d, err := time.ParseDuration(p.Stages[stage].Soak)
+	if err != nil {
+		return 0
+	}
+
+	return d
+}
+
+// promote defers the deploy of the next stage until the soak period of
+// the completed stage has elapsed.  It returns false when the job
+// deployed the last stage.
+func (h *Handler) promote(j *job) (time.Time, bool) {
+	if j.Stage+1 >= len(h.stageGroups(j.Repository)) {
+		return time.Time{}, false
+	}
+
+	notBefore := time.Now().Add(h.stageSoak(j.Repository, j.Stage))
+	next := &job{
+		ID:           newID(),
+		Repository:   j.Repository,
+		Tag:          j.Tag,
+		Approved:     true,
+		Received:     time.Now(),
+		Stage:        j.Stage + 1,
+		DeploymentID: j.DeploymentID,
+		NotBefore:    notBefore,
+	}
+
+	logrus.WithFields(logrus.Fields{
+		"job":        next.ID,
+		"deployment": j.DeploymentID,
+		"name":       j.Repository,
+		"group":      h.stageGroup(j.Repository, next.Stage),
+		"not_before": notBefore,
+	}).Info("promotion scheduled")
+
+	h.deferJob(next)
+
+	return notBefore, true
+}
+
+// soakContainer is a deployed container inspected for the soak check
+type soakContainer struct {
+	engine string
+	info   dockertypes.ContainerJSON
+}
+
+// soakContainers returns the containers of the repository deployed to the
+// group by id
+func (h *Handler) soakContainers(repo, tag, group string) (map[string]*soakContainer, error) {
+	found := map[string]*soakContainer{}
+	for _, e := range h.groupEngines(group) {
+		containers, err := e.inventory.repository(repo, true)
+		if err != nil {
+			return nil, fmt.Errorf("engine %s: %s", e.Name, err)
+		}
+
+		for _, c := range containers {
+			imageRepo, imageTag := parseImage(c.Image)
+			if imageRepo != repo || (tag != "" && imageTag != tag) || !h.isEnabled(c) || h.isRetained(c) {
+				continue
+			}
+
+			info, err := e.client.ContainerInspect(context.Background(), c.ID)
+			if err != nil {
+				return nil, fmt.Errorf("engine %s: %s", e.Name, err)
+			}
+			found[c.ID] = &soakContainer{engine: e.Name, info: info}
+		}
+	}
+
+	return found, nil
+}
+
+// soakRestarts returns the restart count of the containers of the
+// repository deployed to the group by id.  It is the baseline checkSoak
+// compares against so that containers which crashed and were restarted
+// during the soak fail the promotion even when they are healthy again.
+func (h *Handler) soakRestarts(repo, tag, group string) (map[string]int, error) {
+	containers, err := h.soakContainers(repo, tag, group)
+	if err != nil {
+		return nil, err
+	}
+
+	restarts := map[string]int{}
+	for id, c := range containers {
+		restarts[id] = c.info.RestartCount
+	}
+
+	return restarts, nil
+}
+
+// checkSoak verifies the containers of the repository deployed to the
+// group are still running and healthy and that the containers recorded in
+// restarts were neither restarted nor removed since
+func (h *Handler) checkSoak(repo, tag, group string, restarts map[string]int) error {
+	containers, err := h.soakContainers(repo, tag, group)
+	if err != nil {
+		return err
+	}
+
+	for id := range restarts {
+		if _, ok := containers[id]; !ok {
+			return fmt.Errorf("container %s was removed during the soak", shortID(id))
+		}
+	}
+
+	for id, c := range containers {
+		if !isRunningHealthy(&c.info) {
+			return fmt.Errorf("container %s on engine %s is not running and healthy", shortID(id), c.engine)
+		}
+		if n, ok := restarts[id]; ok && c.info.RestartCount > n {
+			return fmt.Errorf("container %s on engine %s restarted %d times during the soak", shortID(id), c.engine, c.info.RestartCount-n)
+		}
+	}
+
+	if len(containers) == 0 {
+		return fmt.Errorf("no containers of %s are running in group %s", repo, group)
+	}
+
+	return nil
+}
+
+// validatePromotions checks the promotion stages of the repositories
+// refer to configured engine groups
+func validatePromotions(configs map[string]*types.RepositoryConfig, engines []*engine) error {
+	groups := map[string]bool{}
+	for _, e := range engines {
+		groups[e.Group] = true
+	}
+
+	for repo, rc := range configs {
+		if rc == nil || rc.Promotion == nil {
+			continue
+		}
+
+		for _, s := range rc.Promotion.Stages {
+			if s.Group == "" || !groups[s.Group] {
+				return fmt.Errorf("invalid promotion for %s: no engines in group %q", repo, s.Group)
+			}
+			if s.Soak == "" {
+				continue
+			}
+			if _, err := time.ParseDuration(s.Soak); err != nil {
+				return fmt.Errorf("invalid promotion soak for %s: %s", repo, err)
+			}
+		}
+	}
+
+	return nil
+}
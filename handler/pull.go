@@ -0,0 +1,149 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+
+	dockertypes "github.com/docker/docker/api/types"
+)
+
+// pullMessage is a single message of the image pull progress stream
+type pullMessage struct {
+	Status string `json:"status"`
+	Error  string `json:"error"`
+}
+
+// pullImage pulls the image and waits for the pull to complete.  Errors
+// during the pull are reported in the progress stream rather than as
+// an API error.
+func (h *Handler) pullImage(ctx context.Context, e *engine, image string) error {
+	start := time.Now()
+	repo, _ := parseImage(image)
+	defer func() {
+		pullDuration.Observe(time.Since(start).Seconds(), repo)
+	}()
+
+	r, err := e.client.ImagePull(ctx, image, dockertypes.ImagePullOptions{})
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	dec := json.NewDecoder(r)
+	for {
+		var m pullMessage
+		if err := dec.Decode(&m); err != nil {
+			if err == io.EOF {
+				break
+			}
+			return err
+		}
+
+		if m.Error != "" {
+			dockerErrors.Inc("image_pull")
+			return fmt.Errorf("error pulling %s: %s", image, m.Error)
+		}
+	}
+
+	return nil
+}
+
+// pullTargets pulls the target images before any container is rotated so
+// a failed pull does not leave a deploy partially rotated.  Each image is
+// pulled once per engine; pulls run in parallel up to the pull concurrency
+// overall and the engine pull concurrency per engine.
+func (h *Handler) pullTargets(ctx context.Context, targets []*deployTarget) error {
+	type pull struct {
+		engine *engine
+		image  string
+	}
+
+	pulls := []pull{}
+	seen := map[string]bool{}
+	engineSem := map[string]chan struct{}{}
+	for _, t := range targets {
+		key := t.Engine.Name + " " + t.Image
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+		pulls = append(pulls, pull{engine: t.Engine, image: t.Image})
+
+		if _, ok := engineSem[t.Engine.Name]; !ok {
+			engineSem[t.Engine.Name] = make(chan struct{}, concurrency(h.config.EnginePullConcurrency))
+		}
+	}
+
+	sem := make(chan struct{}, concurrency(h.config.PullConcurrency))
+
+	var (
+		wg   sync.WaitGroup
+		mu   sync.Mutex
+		errs []string
+	)
+	for _, p := range pulls {
+		wg.Add(1)
+		go func(p pull) {
+			defer wg.Done()
+
+			// wait for the engine first so a busy engine does not hold
+			// pulls to other engines
+			es := engineSem[p.engine.Name]
+			if !acquire(ctx, es) {
+				return
+			}
+			defer func() { <-es }()
+			if !acquire(ctx, sem) {
+				return
+			}
+			defer func() { <-sem }()
+
+			logrus.WithFields(logrus.Fields{
+				"engine": p.engine.Name,
+				"image":  p.image,
+			}).Debug("pulling image")
+
+			if err := h.pullImage(ctx, p.engine, p.image); err != nil {
+				mu.Lock()
+				errs = append(errs, fmt.Sprintf("engine %s: %s", p.engine.Name, err))
+				mu.Unlock()
+			}
+		}(p)
+	}
+	wg.Wait()
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if len(errs) > 0 {
+		return errors.New(strings.Join(errs, "; "))
+	}
+
+	return nil
+}
+
+// acquire takes a slot of the semaphore unless ctx is done first
+func acquire(ctx context.Context, sem chan struct{}) bool {
+	select {
+	case sem <- struct{}{}:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+func concurrency(n int) int {
+	if n < 1 {
+		return 1
+	}
+
+	return n
+}
@@ -0,0 +1,635 @@
+package handler
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/ehazlett/conduit/notify"
+	"github.com/ehazlett/conduit/schedule"
+	"github.com/ehazlett/conduit/types"
+)
+
+const (
+	queueFile = "queue.json"
+)
+
+var (
+	errShuttingDown = errors.New("conduit is shutting down")
+	errJobPersisted = errors.New("conduit is shutting down; deploy has been queued for restart")
+)
+
+// job is a single deploy request.  Jobs that have not started when
+// conduit shuts down are persisted to the state directory and resumed
+// on the next start.
+type job struct {
+	ID          string    `json:"id"`
+	Repository  string    `json:"repository"`
+	CallbackURL string    `json:"callback_url"`
+	Tag         string    `json:"tag"`
+	DryRun      bool      `json:"dry_run"`
+	Approved    bool      `json:"approved"`
+	Received    time.Time `json:"received"`
+	// Stage is the promotion stage deployed by the job
+	Stage int `json:"stage"`
+	// DeploymentID is the deployment history record of the job.  It is
+	// shared by the jobs of all promotion stages of a deploy.
+	DeploymentID string `json:"deployment_id"`
+	// NotBefore holds a deferred job until the soak period of the
+	// previous stage has elapsed
+	NotBefore time.Time `json:"not_before"`
+	// Rollback restores the previous containers of the repository
+	// instead of deploying
+	Rollback bool `json:"rollback"`
+	// Prune removes the unused images of all repositories
+	Prune bool `json:"prune"`
+	// Reconcile makes the engines match the manifest
+	Reconcile bool `json:"reconcile"`
+
+	// Plan is set once the job has run
+	Plan *types.DeployPlan `json:"-"`
+	// Report is set once a prune job has run
+	Report *types.PruneReport `json:"-"`
+	// Reconciled is set once a reconcile job has run
+	Reconciled *types.ReconcileReport `json:"-"`
+	// result receives the outcome of the job when a client is waiting
+	result chan error
+}
+
+func newJob(repo, tag, callbackURL string, dryRun bool) *job {
+	return &job{
+		ID:          newID(),
+		Repository:  repo,
+		Tag:         tag,
+		CallbackURL: callbackURL,
+		DryRun:      dryRun,
+		Received:    time.Now(),
+		result:      make(chan error, 1),
+	}
+}
+
+// finish reports the result to the waiting client.  Only the first result
+// is reported; a deferred job finishes again once it has run.
+func (j *job) finish(err error) {
+	if j.result != nil {
+		j.result <- err
+		j.result = nil
+	}
+}
+
+func newID() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return fmt.Sprintf("%x", time.Now().UnixNano())
+	}
+
+	return hex.EncodeToString(b)
+}
+
+// jobQueue runs deploy jobs one at a time in the order they were received.
+// changed is signalled when the pending jobs change so they are persisted.
+type jobQueue struct {
+	mu      sync.Mutex
+	pending []*job
+	running *job
+	closed  bool
+	ready   chan struct{}
+	done    chan struct{}
+	changed chan struct{}
+}
+
+func newJobQueue() *jobQueue {
+	return &jobQueue{
+		ready:   make(chan struct{}, 1),
+		done:    make(chan struct{}),
+		changed: make(chan struct{}, 1),
+	}
+}
+
+// notifyChanged signals that the pending jobs have changed without
+// blocking
+func (q *jobQueue) notifyChanged() {
+	select {
+	case q.changed <- struct{}{}:
+	default:
+	}
+}
+
+// waiting returns the jobs that have not been started
+func (q *jobQueue) waiting() []*job {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	return append([]*job{}, q.pending...)
+}
+
+// unfinished returns the running job, if any, followed by the jobs that
+// have not been started
+func (q *jobQueue) unfinished() []*job {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	jobs := []*job{}
+	if q.running != nil {
+		jobs = append(jobs, q.running)
+	}
+
+	return append(jobs, q.pending...)
+}
+
+func (q *jobQueue) updateDepth() {
+	n := len(q.pending)
+	if q.running != nil {
+		n++
+	}
+	queueDepth.Set(float64(n))
+}
+
+// push adds the job to the queue.  An error is returned when the queue
+// has been closed for shutdown.
+func (q *jobQueue) push(j *job) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.closed {
+		return errShuttingDown
+	}
+
+	q.pending = append(q.pending, j)
+	q.updateDepth()
+	q.notifyChanged()
+
+	select {
+	case q.ready <- struct{}{}:
+	default:
+	}
+
+	return nil
+}
+
+// next blocks until a job is available and marks it as running.  nil is
+// returned once the queue has been closed.
+func (q *jobQueue) next() *job {
+	for {
+		q.mu.Lock()
+		if q.running != nil {
+			q.running = nil
+			q.notifyChanged()
+		}
+		if q.closed {
+			q.updateDepth()
+			q.mu.Unlock()
+			return nil
+		}
+		if len(q.pending) > 0 {
+			j := q.pending[0]
+			q.pending = q.pending[1:]
+			q.running = j
+			q.updateDepth()
+			q.notifyChanged()
+			q.mu.Unlock()
+			return j
+		}
+		q.updateDepth()
+		q.mu.Unlock()
+
+		<-q.ready
+	}
+}
+
+// close stops the queue from accepting and starting jobs and returns the
+// jobs that have not been started
+func (q *jobQueue) close() []*job {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.closed = true
+	pending := q.pending
+	q.pending = nil
+
+	select {
+	case q.ready <- struct{}{}:
+	default:
+	}
+
+	return pending
+}
+
+// runQueue processes jobs until the queue is closed
+func (h *Handler) runQueue() {
+	defer close(h.queue.done)
+
+	for {
+		j := h.queue.next()
+		if j == nil {
+			return
+		}
+
+		j.finish(h.process(j))
+	}
+}
+
+// process deploys the repository for the job and reports the result to
+// the notifiers and the webhook callback
+func (h *Handler) process(j *job) error {
+	repoName := j.Repository
+
+	logrus.WithFields(logrus.Fields{
+		"job":  j.ID,
+		"name": repoName,
+	}).Debugf("deploying %s", repoName)
+
+	responsePayload := &types.CallbackPayload{
+		TargetURL: "",
+	}
+
+	if j.Prune {
+		j.Report = h.pruneImages(h.engines, h.config.Repositories, j.DryRun)
+		h.setPruneReport(j.Report)
+		return nil
+	}
+
+	if j.Reconcile {
+		h.processReconcile(j)
+		return nil
+	}
+
+	if j.DryRun {
+		return h.processDryRun(j)
+	}
+
+	// rollbacks restore service and are not held by approvals or
+	// deployment windows
+	if j.Rollback {
+		return h.processRollback(j)
+	}
+
+	if !j.Approved && h.requiresApproval(repoName) {
+		if err := h.requestApproval(j); err != nil {
+			logrus.Error(err)
+			return fmt.Errorf("error requesting approval for %s: %s", repoName, err)
+		}
+		return &pendingError{id: j.ID}
+	}
+
+	if err := h.checkSchedule(repoName); err != nil {
+		blocked, ok := err.(*schedule.Blocked)
+		if !ok {
+			rErr := fmt.Errorf("error checking schedule of %s: %s", repoName, err)
+			webhooksReceived.Inc(repoName, outcomeError)
+			if j.Stage > 0 {
+				h.failStage(j, nil, rErr)
+			}
+
+			responsePayload.State = "error"
+			responsePayload.Description = rErr.Error()
+			h.sendCallback(responsePayload, j.CallbackURL)
+
+			logrus.Error(rErr)
+
+			return rErr
+		}
+		if blocked.Queue {
+			logrus.WithFields(logrus.Fields{
+				"job":    j.ID,
+				"name":   repoName,
+				"reason": blocked.Reason,
+			}).Info("deferring deploy")
+			h.deferJob(j)
+			return &deferredError{reason: blocked.Reason}
+		}
+
+		rErr := fmt.Errorf("not deploying %s: %s", repoName, blocked.Reason)
+		webhooksReceived.Inc(repoName, outcomeRejected)
+		if j.Stage > 0 {
+			h.failStage(j, nil, rErr)
+		}
+
+		responsePayload.State = "error"
+		responsePayload.Description = rErr.Error()
+		h.sendCallback(responsePayload, j.CallbackURL)
+
+		logrus.Error(rErr)
+
+		return rErr
+	}
+
+	group := h.stageGroup(repoName, j.Stage)
+	target := repoName
+	if group != "" {
+		target = fmt.Sprintf("%s to %s", repoName, group)
+	}
+
+	if j.Stage > 0 {
+		prev := h.stageGroup(repoName, j.Stage-1)
+		var restarts map[string]int
+		if d, ok := h.deployment(j.DeploymentID); ok && j.Stage-1 < len(d.Stages) {
+			restarts = d.Stages[j.Stage-1].Restarts
+		}
+		if err := h.checkSoak(repoName, j.Tag, prev, restarts); err != nil {
+			rErr := fmt.Errorf("not promoting %s: %s did not stay healthy: %s", target, prev, err)
+			webhooksReceived.Inc(repoName, outcomeError)
+			h.failStage(j, nil, rErr)
+			h.notifier.Send(notify.NewEvent(notify.EventFailure, repoName, rErr.Error()))
+			logrus.Error(rErr)
+			return rErr
+		}
+	}
+
+	h.updateDeployment(j, func(d *types.Deployment, s *types.DeploymentStage) {
+		d.Status = types.DeploymentRunning
+		s.Status = types.DeploymentRunning
+		s.Started = time.Now()
+	})
+
+	h.notifier.Send(notify.NewEvent(notify.EventStart, repoName, fmt.Sprintf("conduit is deploying %s", target)))
+
+	ctx, done := h.startDeploy(j)
+	plan, err := h.deploy(ctx, repoName, j.Tag, group, j.DeploymentID, false)
+	if err != nil {
+		err = h.deployError(ctx, repoName, err)
+	}
+	done()
+	j.Plan = plan
+	if err != nil {
+		webhooksReceived.Inc(repoName, outcomeError)
+		rErr := err
+		if _, ok := err.(*cancelledError); !ok {
+			rErr = fmt.Errorf("error deploying %s: %s", target, err)
+		}
+		h.failStage(j, plan, rErr)
+		h.notifier.Send(notify.NewEvent(notify.EventFailure, repoName, rErr.Error()))
+
+		responsePayload.State = "error"
+		responsePayload.Description = rErr.Error()
+		h.sendCallback(responsePayload, j.CallbackURL)
+
+		logrus.Error(rErr)
+
+		return rErr
+	}
+
+	// the restart count of the deployed containers is recorded before the
+	// next stage is scheduled so the soak check can compare against it
+	var restarts map[string]int
+	if j.Stage+1 < len(h.stageGroups(repoName)) {
+		if restarts, err = h.soakRestarts(repoName, j.Tag, group); err != nil {
+			logrus.Errorf("error recording restarts of %s: %s", target, err)
+		}
+	}
+
+	soakUntil, promoted := h.promote(j)
+	h.updateDeployment(j, func(d *types.Deployment, s *types.DeploymentStage) {
+		s.Status = types.DeploymentSucceeded
+		s.Finished = time.Now()
+		s.Containers = len(plan.Containers)
+		if promoted {
+			s.SoakUntil = soakUntil
+			s.Restarts = restarts
+			d.Status = types.DeploymentSoaking
+			return
+		}
+		d.Status = types.DeploymentSucceeded
+		d.Finished = time.Now()
+	})
+
+	// the manifest services move to the tag once every stage is deployed
+	if !promoted {
+		h.updateServiceTags(repoName, j.Tag, false)
+	}
+
+	if h.config.ImageCleanup {
+		report := h.pruneImages(h.groupEngines(group), []string{repoName}, false)
+		for _, err := range report.Errors {
+			logrus.WithFields(logrus.Fields{
+				"name": repoName,
+			}).Errorf("error cleaning up images: %s", err)
+		}
+	}
+
+	webhooksReceived.Inc(repoName, outcomeSuccess)
+	responsePayload.State = "success"
+	responsePayload.Description = fmt.Sprintf("conduit deployed %s", target)
+	if len(plan.SizeUnknown) > 0 {
+		responsePayload.Description += fmt.Sprintf("; disk preflight skipped %s (size unknown)", strings.Join(plan.SizeUnknown, ", "))
+	}
+	if promoted {
+		responsePayload.Description += fmt.Sprintf("; promoting to %s after %s", h.stageGroup(repoName, j.Stage+1), soakUntil.Format(time.RFC3339))
+	}
+	h.notifier.Send(notify.NewEvent(notify.EventSuccess, repoName, responsePayload.Description))
+
+	h.sendCallback(responsePayload, j.CallbackURL)
+
+	return nil
+}
+
+// processRollback restores the previous containers of the repository
+// and records the rollback in the deployment history
+func (h *Handler) processRollback(j *job) error {
+	h.updateDeployment(j, func(d *types.Deployment, s *types.DeploymentStage) {
+		d.Status = types.DeploymentRunning
+		s.Status = types.DeploymentRunning
+		s.Started = time.Now()
+	})
+
+	h.notifier.Send(notify.NewEvent(notify.EventStart, j.Repository, fmt.Sprintf("conduit is rolling back %s", j.Repository)))
+
+	n, err := h.rollback(j.Repository)
+	if err != nil {
+		rErr := fmt.Errorf("error rolling back %s: %s", j.Repository, err)
+		h.failStage(j, nil, rErr)
+		h.notifier.Send(notify.NewEvent(notify.EventFailure, j.Repository, rErr.Error()))
+		logrus.Error(rErr)
+		return rErr
+	}
+
+	rollbacks.Inc(j.Repository)
+	h.updateDeployment(j, func(d *types.Deployment, s *types.DeploymentStage) {
+		now := time.Now()
+		s.Status = types.DeploymentSucceeded
+		s.Finished = now
+		s.Containers = n
+		d.Status = types.DeploymentSucceeded
+		d.Finished = now
+	})
+
+	h.notifier.Send(notify.NewEvent(notify.EventRollback, j.Repository, fmt.Sprintf("conduit restored %d previous container(s) of %s", n, j.Repository)))
+
+	return nil
+}
+
+// failStage records the failure of the stage in the deployment history
+func (h *Handler) failStage(j *job, plan *types.DeployPlan, err error) {
+	h.updateDeployment(j, func(d *types.Deployment, s *types.DeploymentStage) {
+		now := time.Now()
+		s.Status = failedStatus(err)
+		s.Finished = now
+		s.Error = err.Error()
+		if plan != nil {
+			s.Containers = len(plan.Containers)
+		}
+		d.Status = failedStatus(err)
+		d.Finished = now
+	})
+}
+
+// processDryRun resolves the deploy plan for the job and reports it to
+// the webhook callback without changing any containers
+func (h *Handler) processDryRun(j *job) error {
+	responsePayload := &types.CallbackPayload{
+		TargetURL: "",
+	}
+
+	plan, err := h.deploy(context.Background(), j.Repository, j.Tag, h.stageGroup(j.Repository, j.Stage), "", true)
+	if err != nil {
+		rErr := fmt.Errorf("error planning deploy of %s: %s", j.Repository, err)
+
+		responsePayload.State = "error"
+		responsePayload.Description = rErr.Error()
+		h.sendCallback(responsePayload, j.CallbackURL)
+
+		logrus.Error(rErr)
+
+		return rErr
+	}
+
+	if err := h.checkSchedule(j.Repository); err != nil {
+		plan.Blocked = err.Error()
+	}
+
+	j.Plan = plan
+	responsePayload.State = "success"
+	responsePayload.Description = describePlan(plan)
+
+	h.sendCallback(responsePayload, j.CallbackURL)
+
+	return nil
+}
+
+// describePlan summarizes the plan for the callback description
+func describePlan(plan *types.DeployPlan) string {
+	if len(plan.Containers) == 0 {
+		return fmt.Sprintf("dry run: no containers would be deployed for %s", plan.Repository)
+	}
+
+	ids := []string{}
+	for _, c := range plan.Containers {
+		ids = append(ids, shortID(c.ID))
+	}
+
+	desc := fmt.Sprintf("dry run: conduit would pull %s and rotate %d container(s) for %s: %s",
+		strings.Join(plan.Images, ", "), len(plan.Containers), plan.Repository, strings.Join(ids, ", "))
+	if plan.Blocked != "" {
+		desc += fmt.Sprintf(" (currently blocked: %s)", plan.Blocked)
+	}
+	if plan.Preflight != "" {
+		desc += fmt.Sprintf(" (%s)", plan.Preflight)
+	}
+	if len(plan.SizeUnknown) > 0 {
+		desc += fmt.Sprintf(" (size unknown: %s)", strings.Join(plan.SizeUnknown, ", "))
+	}
+
+	return desc
+}
+
+func (h *Handler) queuePath() string {
+	return filepath.Join(h.config.StateDir, queueFile)
+}
+
+// persistJobs writes the jobs to the state directory so they can be
+// resumed on the next start
+func (h *Handler) persistJobs(jobs []*job) error {
+	if len(jobs) == 0 {
+		if err := os.Remove(h.queuePath()); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+
+	data, err := json.MarshalIndent(jobs, "", "    ")
+	if err != nil {
+		return err
+	}
+
+	tmp := h.queuePath() + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, h.queuePath())
+}
+
+// resumeJobs queues the jobs persisted by the last run.  Jobs held until a
+// soak period has elapsed are deferred again.  Deployments that were left
+// running or soaking without a persisted job are marked as interrupted.
+func (h *Handler) resumeJobs() error {
+	var jobs []*job
+	data, err := ioutil.ReadFile(h.queuePath())
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err == nil {
+		if err := json.Unmarshal(data, &jobs); err != nil {
+			return err
+		}
+	}
+
+	h.interruptDeployments(jobs)
+
+	now := time.Now()
+	for _, j := range jobs {
+		logrus.WithFields(logrus.Fields{
+			"job":  j.ID,
+			"name": j.Repository,
+		}).Info("resuming queued deploy")
+
+		if now.Before(j.NotBefore) {
+			h.deferJob(j)
+			continue
+		}
+
+		if err := h.queue.push(j); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// saveJobs persists the running job and the jobs waiting in the queue or
+// deferred.  The running job is kept until it has finished so that a
+// crash during a deploy runs it again on the next start.
+func (h *Handler) saveJobs() {
+	h.deferredLock.Lock()
+	deferred := append([]*job{}, h.deferred...)
+	h.deferredLock.Unlock()
+
+	if err := h.persistJobs(append(h.queue.unfinished(), deferred...)); err != nil {
+		logrus.Errorf("error persisting queued deploys: %s", err)
+	}
+}
+
+// runJobSaver persists the waiting jobs whenever they change so that they
+// are resumed after a crash, until it is stopped for shutdown
+func (h *Handler) runJobSaver() {
+	defer close(h.saverDone)
+
+	for {
+		select {
+		case <-h.queue.changed:
+			h.saveJobs()
+		case <-h.saverStop:
+			return
+		}
+	}
+}
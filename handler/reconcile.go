@@ -0,0 +1,437 @@
+package handler
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	dockertypes "github.com/docker/docker/api/types"
+	"github.com/ehazlett/conduit/types"
+)
+
+// reconcileStep is a change to make an engine match the manifest
+type reconcileStep struct {
+	action types.ReconcileAction
+	run    func(ctx context.Context) error
+}
+
+// reconcile makes the containers of the engines match the manifest.
+// Missing replicas are created, drifted containers are replaced with the
+// same rotation as a deploy and containers of services or replicas that
+// are no longer in the manifest are removed.
+func (h *Handler) reconcile(ctx context.Context, dryRun bool) *types.ReconcileReport {
+	report := &types.ReconcileReport{
+		DryRun:  dryRun,
+		Time:    time.Now(),
+		Actions: []types.ReconcileAction{},
+	}
+
+	for _, e := range h.engines {
+		steps, err := h.reconcileEngine(e)
+		if err != nil {
+			report.Errors = append(report.Errors, fmt.Sprintf("engine %s: %s", e.Name, err))
+			continue
+		}
+
+		for _, s := range steps {
+			if !dryRun {
+				logrus.WithFields(logrus.Fields{
+					"engine":  e.Name,
+					"service": s.action.Service,
+					"replica": s.action.Replica,
+					"reason":  s.action.Reason,
+				}).Infof("reconcile: %s container", s.action.Action)
+
+				if err := s.run(ctx); err != nil {
+					s.action.Error = err.Error()
+					report.Errors = append(report.Errors, fmt.Sprintf("engine %s: %s %s: %s", e.Name, s.action.Action, s.action.Service, err))
+				} else {
+					reconcileActions.Inc(s.action.Service, s.action.Action)
+				}
+			}
+
+			report.Actions = append(report.Actions, s.action)
+		}
+	}
+
+	logrus.WithFields(logrus.Fields{
+		"dry_run": dryRun,
+		"actions": len(report.Actions),
+		"errors":  len(report.Errors),
+	}).Info("reconciled manifest")
+
+	return report
+}
+
+// reconcileEngine returns the steps to make the engine match the manifest.
+// Removals come last so that replacements are running first.
+func (h *Handler) reconcileEngine(e *engine) ([]*reconcileStep, error) {
+	containers, err := e.inventory.list(true)
+	if err != nil {
+		return nil, err
+	}
+
+	managed := map[string][]dockertypes.Container{}
+	for _, c := range containers {
+		name := c.Labels[labelManifestService]
+		if name == "" || h.isRetained(c) {
+			continue
+		}
+		managed[name] = append(managed[name], c)
+	}
+
+	steps := []*reconcileStep{}
+	removals := []*reconcileStep{}
+	for _, s := range h.services {
+		current := managed[s.spec.Name]
+		delete(managed, s.spec.Name)
+
+		if s.spec.Group != "" && s.spec.Group != e.Group {
+			for _, c := range current {
+				removals = append(removals, h.removeStep(e, s, s.spec.Name, c, fmt.Sprintf("engine is not in group %s", s.spec.Group)))
+			}
+			continue
+		}
+
+		// a deploy in progress moves the containers to a new tag which
+		// only becomes the tag of the service once it has finished
+		if h.isDeploying(s.repo) {
+			logrus.WithFields(logrus.Fields{
+				"engine":  e.Name,
+				"service": s.spec.Name,
+			}).Debug("not reconciling service while its repository is being deployed")
+			continue
+		}
+
+		create, remove := h.serviceSteps(e, s, current)
+		steps = append(steps, create...)
+		removals = append(removals, remove...)
+	}
+
+	orphans := []string{}
+	for name := range managed {
+		orphans = append(orphans, name)
+	}
+	sort.Strings(orphans)
+	for _, name := range orphans {
+		for _, c := range managed[name] {
+			removals = append(removals, h.removeStep(e, nil, name, c, "service is not in the manifest"))
+		}
+	}
+
+	return append(steps, removals...), nil
+}
+
+// serviceSteps returns the steps to run the replicas of the service on the
+// engine.  The newest container of a replica is kept when there are
+// several.
+func (h *Handler) serviceSteps(e *engine, s *service, containers []dockertypes.Container) ([]*reconcileStep, []*reconcileStep) {
+	image := h.serviceImage(s)
+	steps := []*reconcileStep{}
+	removals := []*reconcileStep{}
+
+	replicas := map[int]dockertypes.Container{}
+	for _, c := range containers {
+		n, err := strconv.Atoi(c.Labels[labelManifestReplica])
+		if err != nil || n < 0 || n >= s.replicas {
+			removals = append(removals, h.removeStep(e, s, s.spec.Name, c, "replica is not in the manifest"))
+			continue
+		}
+		if _, ok := replicas[n]; ok {
+			removals = append(removals, h.removeStep(e, s, s.spec.Name, c, "duplicate replica"))
+			continue
+		}
+		replicas[n] = c
+	}
+
+	// replacements are deploys and follow the repository schedule
+	blocked := h.checkSchedule(s.repo)
+
+	for i := 0; i < s.replicas; i++ {
+		c, ok := replicas[i]
+		if !ok {
+			steps = append(steps, h.createStep(e, s, i, image))
+			continue
+		}
+
+		reason := s.drift(c, image)
+		if reason == "" {
+			continue
+		}
+		if blocked != nil {
+			logrus.WithFields(logrus.Fields{
+				"engine":    e.Name,
+				"service":   s.spec.Name,
+				"container": shortID(c.ID),
+			}).Debugf("not replacing drifted container: %s", blocked)
+			continue
+		}
+
+		steps = append(steps, h.replaceStep(e, s, i, c, image, reason))
+	}
+
+	return steps, removals
+}
+
+// drift returns why the container no longer matches the service or an
+// empty string when it does
+func (s *service) drift(c dockertypes.Container, image string) string {
+	if c.Labels[labelManifestHash] != s.hash {
+		return "service spec changed"
+	}
+
+	if repo, tag := parseImage(c.Image); repo+":"+tag != image {
+		return fmt.Sprintf("container runs %s", c.Image)
+	}
+
+	if !isRunningState(c.State) {
+		return fmt.Sprintf("container is %s", c.State)
+	}
+
+	return ""
+}
+
+func (h *Handler) createStep(e *engine, s *service, replica int, image string) *reconcileStep {
+	return &reconcileStep{
+		action: types.ReconcileAction{
+			Engine:  e.Name,
+			Service: s.spec.Name,
+			Replica: replica,
+			Action:  types.ReconcileCreate,
+			Image:   image,
+			Reason:  "replica is missing",
+		},
+		run: func(ctx context.Context) error {
+			return h.createServiceContainer(ctx, e, s, replica, image)
+		},
+	}
+}
+
+func (h *Handler) replaceStep(e *engine, s *service, replica int, c dockertypes.Container, image, reason string) *reconcileStep {
+	return &reconcileStep{
+		action: types.ReconcileAction{
+			Engine:    e.Name,
+			Service:   s.spec.Name,
+			Replica:   replica,
+			Action:    types.ReconcileReplace,
+			Container: shortID(c.ID),
+			Image:     image,
+			Reason:    reason,
+		},
+		run: func(ctx context.Context) error {
+			return h.replaceServiceContainer(ctx, e, s, replica, c, image)
+		},
+	}
+}
+
+// removeStep returns the step removing the container of the service.  s is
+// nil when the service is no longer in the manifest.
+func (h *Handler) removeStep(e *engine, s *service, name string, c dockertypes.Container, reason string) *reconcileStep {
+	replica, _ := strconv.Atoi(c.Labels[labelManifestReplica])
+	return &reconcileStep{
+		action: types.ReconcileAction{
+			Engine:    e.Name,
+			Service:   name,
+			Replica:   replica,
+			Action:    types.ReconcileRemove,
+			Container: shortID(c.ID),
+			Image:     c.Image,
+			Reason:    reason,
+		},
+		run: func(ctx context.Context) error {
+			info, err := e.client.ContainerInspect(ctx, c.ID)
+			if err != nil {
+				return err
+			}
+
+			// the listed image is an image id once its tag has moved so
+			// the repository is taken from the service or the config
+			repo, _ := parseImage(info.Config.Image)
+			if s != nil {
+				repo = s.repo
+			}
+
+			opts, err := h.containerOptions(repo, info.Config)
+			if err != nil {
+				return err
+			}
+
+			return h.removeContainer(ctx, e, c.ID, opts)
+		},
+	}
+}
+
+// createServiceContainer creates and starts a replica of the service.  The
+// container is removed when it does not become healthy.
+func (h *Handler) createServiceContainer(ctx context.Context, e *engine, s *service, replica int, image string) error {
+	spec := s.containerSpec(replica, image)
+	spec.Config.Labels[labelService] = fmt.Sprintf("%s-%d", s.spec.Name, replica)
+
+	opts, err := h.containerOptions(s.repo, spec.Config)
+	if err != nil {
+		return err
+	}
+
+	if err := h.pullImage(ctx, e, image); err != nil {
+		return err
+	}
+
+	resp, err := e.client.ContainerCreate(ctx, spec.Config, spec.HostConfig, nil, "")
+	if err != nil {
+		return err
+	}
+
+	discard := func() {
+		if err := h.removeContainer(context.Background(), e, resp.ID, opts); err != nil {
+			logrus.Error(err)
+		}
+	}
+
+	if err := h.connectNetworks(ctx, e, resp.ID, spec.Networks); err != nil {
+		discard()
+		return err
+	}
+
+	if err := e.client.ContainerStart(ctx, resp.ID, dockertypes.ContainerStartOptions{}); err != nil {
+		discard()
+		return err
+	}
+
+	if err := h.waitForHealthy(ctx, e, resp.ID, opts.HealthTimeout); err != nil {
+		discard()
+		return err
+	}
+
+	logrus.WithFields(logrus.Fields{
+		"container": shortID(resp.ID),
+		"engine":    e.Name,
+		"service":   s.spec.Name,
+	}).Info("started manifest service container")
+
+	return nil
+}
+
+// replaceServiceContainer rotates the drifted container to a container
+// created from the service and recreates the containers depending on it
+func (h *Handler) replaceServiceContainer(ctx context.Context, e *engine, s *service, replica int, c dockertypes.Container, image string) error {
+	info, err := e.client.ContainerInspect(ctx, c.ID)
+	if err != nil {
+		return err
+	}
+
+	opts, err := h.containerOptions(s.repo, info.Config)
+	if err != nil {
+		return err
+	}
+
+	if err := h.pullImage(ctx, e, image); err != nil {
+		return err
+	}
+
+	t := &deployTarget{
+		Engine:    e,
+		Container: c,
+		Info:      info,
+		Options:   opts,
+		Image:     image,
+		Spec:      s.containerSpec(replica, image),
+	}
+	if err := h.rotate(ctx, t); err != nil {
+		return err
+	}
+
+	_, _, err = h.rotateDependents(ctx, t, []*deployTarget{t}, []replacement{t.replacement()})
+	return err
+}
+
+// isDeploying reports whether a deploy of the repository is running or has
+// stages waiting to be promoted.  It is decided from the running deploy and
+// the waiting jobs rather than the deployment history so that deployments
+// left running by a crash do not block the reconcile.
+func (h *Handler) isDeploying(repo string) bool {
+	h.runningLock.Lock()
+	running := h.running
+	h.runningLock.Unlock()
+
+	if running != nil && running.Repository == repo {
+		return true
+	}
+
+	h.deferredLock.Lock()
+	jobs := append(h.queue.waiting(), h.deferred...)
+	h.deferredLock.Unlock()
+
+	for _, j := range jobs {
+		if j.Repository == repo && j.Stage > 0 {
+			return true
+		}
+	}
+
+	return false
+}
+
+// setReconcileReport keeps the report of the last reconcile
+func (h *Handler) setReconcileReport(r *types.ReconcileReport) {
+	h.reconcileLock.Lock()
+	defer h.reconcileLock.Unlock()
+
+	h.lastReconcile = r
+}
+
+func (h *Handler) reconcileReport() *types.ReconcileReport {
+	h.reconcileLock.Lock()
+	defer h.reconcileLock.Unlock()
+
+	return h.lastReconcile
+}
+
+// newReconcileJob returns a job that reconciles the engines to the manifest
+func newReconcileJob(dryRun bool) *job {
+	j := newJob("", "", "", dryRun)
+	j.Reconcile = true
+
+	return j
+}
+
+// processReconcile runs the reconcile of the job with the global deploy
+// deadline
+func (h *Handler) processReconcile(j *job) {
+	ctx, cancel := deployContext(h.config.DeployTimeout)
+	defer cancel()
+
+	j.Reconciled = h.reconcile(ctx, j.DryRun)
+	h.setReconcileReport(j.Reconciled)
+}
+
+// runReconcile reconciles the engines to the manifest on start and then
+// periodically until the queue is done
+func (h *Handler) runReconcile() {
+	queue := func() {
+		j := newReconcileJob(h.config.DryRun)
+		// nobody waits for the result of a periodic reconcile
+		j.result = nil
+		if err := h.queue.push(j); err != nil {
+			logrus.Errorf("error queueing reconcile: %s", err)
+		}
+	}
+
+	queue()
+	if h.config.ReconcileInterval <= 0 {
+		return
+	}
+
+	t := time.NewTicker(h.config.ReconcileInterval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-t.C:
+			queue()
+		case <-h.queue.done:
+			return
+		}
+	}
+}
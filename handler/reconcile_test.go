@@ -0,0 +1,65 @@
+package handler
+
+import (
+	"testing"
+
+	dockertypes "github.com/docker/docker/api/types"
+)
+
+func TestServiceDrift(t *testing.T) {
+	s := &service{hash: "h1"}
+	labels := map[string]string{labelManifestHash: "h1"}
+
+	tests := []struct {
+		name  string
+		c     dockertypes.Container
+		image string
+		want  string
+	}{
+		{
+			name:  "matches",
+			c:     dockertypes.Container{Image: "app:1.0", State: "running", Labels: labels},
+			image: "app:1.0",
+		},
+		{
+			name:  "untagged image is latest",
+			c:     dockertypes.Container{Image: "app", State: "running", Labels: labels},
+			image: "app:latest",
+		},
+		{
+			name:  "paused is running",
+			c:     dockertypes.Container{Image: "app:1.0", State: "paused", Labels: labels},
+			image: "app:1.0",
+		},
+		{
+			name:  "spec changed",
+			c:     dockertypes.Container{Image: "app:1.0", State: "running", Labels: map[string]string{labelManifestHash: "h0"}},
+			image: "app:1.0",
+			want:  "service spec changed",
+		},
+		{
+			name:  "unlabeled",
+			c:     dockertypes.Container{Image: "app:1.0", State: "running"},
+			image: "app:1.0",
+			want:  "service spec changed",
+		},
+		{
+			name:  "other image",
+			c:     dockertypes.Container{Image: "app:0.9", State: "running", Labels: labels},
+			image: "app:1.0",
+			want:  "container runs app:0.9",
+		},
+		{
+			name:  "stopped",
+			c:     dockertypes.Container{Image: "app:1.0", State: "exited", Labels: labels},
+			image: "app:1.0",
+			want:  "container is exited",
+		},
+	}
+
+	for _, tt := range tests {
+		if got := s.drift(tt.c, tt.image); got != tt.want {
+			t.Errorf("%s: drift = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,224 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	defaultRegistry = "registry-1.docker.io"
+
+	mediaTypeManifest     = "application/vnd.docker.distribution.manifest.v2+json"
+	mediaTypeManifestList = "application/vnd.docker.distribution.manifest.list.v2+json"
+	mediaTypeOCIManifest  = "application/vnd.oci.image.manifest.v1+json"
+	mediaTypeOCIIndex     = "application/vnd.oci.image.index.v1+json"
+)
+
+// registryManifest is a schema 2 image manifest or manifest list or the
+// equivalent OCI image manifest or index
+type registryManifest struct {
+	MediaType string `json:"mediaType"`
+	Config    struct {
+		Size int64 `json:"size"`
+	} `json:"config"`
+	Layers []struct {
+		Size int64 `json:"size"`
+	} `json:"layers"`
+	Manifests []struct {
+		Digest   string `json:"digest"`
+		Platform struct {
+			Architecture string `json:"architecture"`
+			OS           string `json:"os"`
+		} `json:"platform"`
+	} `json:"manifests"`
+}
+
+// imageSize is the compressed size of an image in the registry
+type imageSize struct {
+	// Digest is the manifest digest of the image
+	Digest string
+	Size   int64
+}
+
+// registryClient looks up image manifests with anonymous access
+type registryClient struct {
+	client *http.Client
+}
+
+func newRegistryClient() *registryClient {
+	return &registryClient{
+		client: &http.Client{
+			Timeout: time.Second * 30,
+		},
+	}
+}
+
+// splitRepository returns the registry host and the repository path of
+// the repository as used by the registry api
+func splitRepository(repo string) (string, string) {
+	parts := strings.SplitN(repo, "/", 2)
+	if len(parts) == 2 && (strings.ContainsAny(parts[0], ".:") || parts[0] == "localhost") {
+		return parts[0], parts[1]
+	}
+
+	if len(parts) == 1 {
+		return defaultRegistry, "library/" + repo
+	}
+
+	return defaultRegistry, repo
+}
+
+// imageSize returns the compressed size of the image for the platform
+func (r *registryClient) imageSize(ctx context.Context, image, osType, arch string) (*imageSize, error) {
+	repo, tag := parseImage(image)
+	host, path := splitRepository(repo)
+
+	m, digest, err := r.manifest(ctx, host, path, tag)
+	if err != nil {
+		return nil, err
+	}
+
+	if m.MediaType == mediaTypeManifestList || m.MediaType == mediaTypeOCIIndex {
+		ref := ""
+		for _, p := range m.Manifests {
+			if p.Platform.OS == osType && p.Platform.Architecture == arch {
+				ref = p.Digest
+				break
+			}
+		}
+		if ref == "" {
+			return nil, fmt.Errorf("%s has no image for %s/%s", image, osType, arch)
+		}
+
+		if m, _, err = r.manifest(ctx, host, path, ref); err != nil {
+			return nil, err
+		}
+		digest = ref
+	}
+
+	size := m.Config.Size
+	for _, l := range m.Layers {
+		size += l.Size
+	}
+
+	return &imageSize{
+		Digest: digest,
+		Size:   size,
+	}, nil
+}
+
+// manifest fetches the manifest of the reference and returns it with its
+// digest
+func (r *registryClient) manifest(ctx context.Context, host, path, ref string) (*registryManifest, string, error) {
+	u := fmt.Sprintf("https://%s/v2/%s/manifests/%s", host, path, ref)
+
+	resp, err := r.get(ctx, u, "")
+	if err != nil {
+		return nil, "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusUnauthorized {
+		token, err := r.token(ctx, resp.Header.Get("WWW-Authenticate"))
+		if err != nil {
+			return nil, "", err
+		}
+		resp.Body.Close()
+
+		if resp, err = r.get(ctx, u, token); err != nil {
+			return nil, "", err
+		}
+		defer resp.Body.Close()
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, "", fmt.Errorf("error getting manifest of %s/%s:%s: %s", host, path, ref, resp.Status)
+	}
+
+	var m *registryManifest
+	if err := json.NewDecoder(resp.Body).Decode(&m); err != nil {
+		return nil, "", err
+	}
+
+	return m, resp.Header.Get("Docker-Content-Digest"), nil
+}
+
+func (r *registryClient) get(ctx context.Context, u, token string) (*http.Response, error) {
+	req, err := http.NewRequest("GET", u, nil)
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Accept", strings.Join([]string{
+		mediaTypeManifest,
+		mediaTypeManifestList,
+		mediaTypeOCIManifest,
+		mediaTypeOCIIndex,
+	}, ", "))
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	return r.client.Do(req)
+}
+
+// token requests an anonymous bearer token for the challenge
+func (r *registryClient) token(ctx context.Context, challenge string) (string, error) {
+	if !strings.HasPrefix(challenge, "Bearer ") {
+		return "", fmt.Errorf("unsupported registry authentication: %s", challenge)
+	}
+
+	params := map[string]string{}
+	for _, p := range strings.Split(strings.TrimPrefix(challenge, "Bearer "), ",") {
+		kv := strings.SplitN(strings.TrimSpace(p), "=", 2)
+		if len(kv) == 2 {
+			params[kv[0]] = strings.Trim(kv[1], `"`)
+		}
+	}
+
+	realm := params["realm"]
+	if realm == "" {
+		return "", fmt.Errorf("registry authentication challenge has no realm")
+	}
+
+	v := url.Values{}
+	for _, k := range []string{"service", "scope"} {
+		if params[k] != "" {
+			v.Set(k, params[k])
+		}
+	}
+
+	req, err := http.NewRequest("GET", realm+"?"+v.Encode(), nil)
+	if err != nil {
+		return "", err
+	}
+
+	resp, err := r.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("error getting registry token: %s", resp.Status)
+	}
+
+	var t struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&t); err != nil {
+		return "", err
+	}
+
+	if t.Token != "" {
+		return t.Token, nil
+	}
+
+	return t.AccessToken, nil
+}
@@ -0,0 +1,254 @@
+package handler
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/ehazlett/conduit/schedule"
+	"github.com/ehazlett/conduit/types"
+)
+
+const (
+	freezesFile = "freezes.json"
+
+	// deferredInterval is how often deferred deploys are checked against
+	// the repository schedule
+	deferredInterval = time.Second * 30
+)
+
+// deferredError is returned for a job that is held until the repository
+// schedule allows it to be deployed
+type deferredError struct {
+	reason string
+}
+
+func (e *deferredError) Error() string {
+	return fmt.Sprintf("deploy queued until allowed: %s", e.reason)
+}
+
+// supersededError is the result of a deferred job replaced by a newer
+// deploy of the same repository
+type supersededError struct {
+	repo string
+	id   string
+}
+
+func (e *supersededError) Error() string {
+	return fmt.Sprintf("deploy of %s was superseded by deploy %s", e.repo, e.id)
+}
+
+// checkSchedule returns a *schedule.Blocked error when the repository may
+// not be deployed now
+func (h *Handler) checkSchedule(repo string) error {
+	s, ok := h.schedules[repo]
+	if !ok {
+		// ad-hoc freezes apply to repositories without a schedule
+		s, _ = schedule.New(nil)
+	}
+
+	return s.Check(time.Now(), h.adhocFreezes(repo))
+}
+
+// deferJob holds the job until the repository schedule allows it and
+// the job is no longer held by NotBefore.  Only the newest deploy of a
+// repository is held; older deferred deploys are dropped as superseded.
+// Promotions are always held as they continue an earlier deploy.
+func (h *Handler) deferJob(j *job) {
+	h.deferredLock.Lock()
+	held := []*job{}
+	superseded := []*job{}
+	for _, d := range h.deferred {
+		if j.Stage == 0 && d.Stage == 0 && d.Repository == j.Repository {
+			superseded = append(superseded, d)
+			continue
+		}
+		held = append(held, d)
+	}
+	h.deferred = append(held, j)
+	h.deferredLock.Unlock()
+	h.queue.notifyChanged()
+
+	for _, d := range superseded {
+		h.supersedeJob(d, j)
+	}
+}
+
+// supersedeJob finishes the deferred job replaced by the newer job
+func (h *Handler) supersedeJob(old, j *job) {
+	logrus.WithFields(logrus.Fields{
+		"job":  old.ID,
+		"name": old.Repository,
+		"by":   j.ID,
+	}).Info("dropping superseded deferred deploy")
+
+	err := &supersededError{repo: old.Repository, id: j.ID}
+	if old.DeploymentID != "" {
+		h.failStage(old, nil, err)
+	}
+
+	h.sendCallback(&types.CallbackPayload{
+		State:       "error",
+		Description: err.Error(),
+	}, old.CallbackURL)
+	old.finish(err)
+}
+
+// releaseDeferred queues the deferred jobs that are now allowed to run
+func (h *Handler) releaseDeferred() {
+	h.deferredLock.Lock()
+	defer h.deferredLock.Unlock()
+
+	now := time.Now()
+	held := []*job{}
+	for _, j := range h.deferred {
+		if now.Before(j.NotBefore) {
+			held = append(held, j)
+			continue
+		}
+		if err := h.checkSchedule(j.Repository); err != nil {
+			held = append(held, j)
+			continue
+		}
+
+		logrus.WithFields(logrus.Fields{
+			"job":  j.ID,
+			"name": j.Repository,
+		}).Info("releasing deferred deploy")
+
+		if err := h.queue.push(j); err != nil {
+			held = append(held, j)
+		}
+	}
+	h.deferred = held
+	h.queue.notifyChanged()
+}
+
+// runDeferred periodically releases deferred jobs and expires pending
+// approvals until the queue is done
+func (h *Handler) runDeferred() {
+	t := time.NewTicker(deferredInterval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-t.C:
+			h.releaseDeferred()
+			h.expireApprovals()
+		case <-h.queue.done:
+			return
+		}
+	}
+}
+
+// takeDeferred removes and returns the deferred jobs
+func (h *Handler) takeDeferred() []*job {
+	h.deferredLock.Lock()
+	defer h.deferredLock.Unlock()
+
+	jobs := h.deferred
+	h.deferred = nil
+
+	return jobs
+}
+
+func (h *Handler) adhocFreezes(repo string) []types.Freeze {
+	h.freezeLock.Lock()
+	defer h.freezeLock.Unlock()
+
+	return append([]types.Freeze{}, h.freezes[repo]...)
+}
+
+// addFreeze adds an ad-hoc freeze for the repository
+func (h *Handler) addFreeze(repo string, f types.Freeze) error {
+	h.freezeLock.Lock()
+	defer h.freezeLock.Unlock()
+
+	h.freezes[repo] = append(h.freezes[repo], f)
+
+	return h.saveFreezes()
+}
+
+// clearFreezes removes the ad-hoc freezes of the repository
+func (h *Handler) clearFreezes(repo string) error {
+	h.freezeLock.Lock()
+	defer h.freezeLock.Unlock()
+
+	delete(h.freezes, repo)
+
+	return h.saveFreezes()
+}
+
+func (h *Handler) freezesPath() string {
+	return filepath.Join(h.config.StateDir, freezesFile)
+}
+
+// saveFreezes persists the ad-hoc freezes that have not expired.  The
+// freeze lock must be held.
+func (h *Handler) saveFreezes() error {
+	now := time.Now()
+	for repo, freezes := range h.freezes {
+		active := []types.Freeze{}
+		for _, f := range freezes {
+			if f.End.After(now) {
+				active = append(active, f)
+			}
+		}
+		if len(active) == 0 {
+			delete(h.freezes, repo)
+			continue
+		}
+		h.freezes[repo] = active
+	}
+
+	data, err := json.MarshalIndent(h.freezes, "", "    ")
+	if err != nil {
+		return err
+	}
+
+	tmp := h.freezesPath() + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, h.freezesPath())
+}
+
+func loadFreezes(path string) (map[string][]types.Freeze, error) {
+	freezes := map[string][]types.Freeze{}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return freezes, nil
+		}
+		return nil, err
+	}
+
+	if err := json.Unmarshal(data, &freezes); err != nil {
+		return nil, err
+	}
+
+	return freezes, nil
+}
+
+func buildSchedules(configs map[string]*types.RepositoryConfig) (map[string]*schedule.Schedule, error) {
+	schedules := map[string]*schedule.Schedule{}
+	for repo, rc := range configs {
+		if rc == nil || rc.Schedule == nil {
+			continue
+		}
+
+		s, err := schedule.New(rc.Schedule)
+		if err != nil {
+			return nil, fmt.Errorf("invalid schedule for %s: %s", repo, err)
+		}
+		schedules[repo] = s
+	}
+
+	return schedules, nil
+}
@@ -0,0 +1,61 @@
+package handler
+
+import (
+	"testing"
+
+	"github.com/ehazlett/conduit/types"
+)
+
+func TestDeferJobSupersedes(t *testing.T) {
+	h := &Handler{
+		config: &HandlerConfig{StateDir: t.TempDir()},
+		queue:  newJobQueue(),
+	}
+
+	first := newJob("app", "1.0", "", false)
+	other := newJob("db", "1.0", "", false)
+	promotion := newJob("app", "0.9", "", false)
+	promotion.Stage = 1
+	second := newJob("app", "1.1", "", false)
+	result := first.result
+
+	for _, j := range []*job{first, other, promotion, second} {
+		h.deferJob(j)
+	}
+
+	want := []*job{other, promotion, second}
+	if len(h.deferred) != len(want) {
+		t.Fatalf("deferred %d jobs, want %d", len(h.deferred), len(want))
+	}
+	for i, j := range want {
+		if h.deferred[i] != j {
+			t.Errorf("deferred[%d] = %s %s, want %s %s", i, h.deferred[i].Repository, h.deferred[i].Tag, j.Repository, j.Tag)
+		}
+	}
+
+	select {
+	case err := <-result:
+		if _, ok := err.(*supersededError); !ok {
+			t.Errorf("superseded job result = %v, want *supersededError", err)
+		}
+	default:
+		t.Error("superseded job did not finish")
+	}
+}
+
+func TestFailedStatus(t *testing.T) {
+	tests := []struct {
+		err  error
+		want string
+	}{
+		{&cancelledError{repo: "app"}, types.DeploymentCancelled},
+		{&supersededError{repo: "app", id: "1"}, types.DeploymentCancelled},
+		{&deferredError{reason: "freeze"}, types.DeploymentFailed},
+	}
+
+	for _, tt := range tests {
+		if got := failedStatus(tt.err); got != tt.want {
+			t.Errorf("failedStatus(%T) = %s, want %s", tt.err, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,59 @@
+package handler
+
+import (
+	"testing"
+
+	"github.com/ehazlett/conduit/types"
+)
+
+func TestParseImage(t *testing.T) {
+	tests := []struct {
+		image string
+		repo  string
+		tag   string
+	}{
+		{"app", "app", "latest"},
+		{"app:1.2", "app", "1.2"},
+		{"ehazlett/go-demo", "ehazlett/go-demo", "latest"},
+		{"ehazlett/go-demo:v2", "ehazlett/go-demo", "v2"},
+		{"registry:5000/ns/app", "registry:5000/ns/app", "latest"},
+		{"registry:5000/ns/app:v1", "registry:5000/ns/app", "v1"},
+		{"app@sha256:abcdef", "app", "latest"},
+		{"app:1.2@sha256:abcdef", "app", "1.2"},
+		{"registry:5000/app@sha256:abcdef", "registry:5000/app", "latest"},
+	}
+
+	for _, tt := range tests {
+		repo, tag := parseImage(tt.image)
+		if repo != tt.repo || tag != tt.tag {
+			t.Errorf("parseImage(%q) = %q, %q, want %q, %q", tt.image, repo, tag, tt.repo, tt.tag)
+		}
+	}
+}
+
+func TestAllowsOtherTags(t *testing.T) {
+	h := &Handler{
+		config: &HandlerConfig{
+			RepositoryConfig: map[string]*types.RepositoryConfig{
+				"exact":   {Policy: &types.UpdatePolicy{Type: "exact"}},
+				"default": {Policy: &types.UpdatePolicy{}},
+				"minor":   {Policy: &types.UpdatePolicy{Type: "minor"}},
+				"none":    {},
+			},
+		},
+	}
+
+	tests := map[string]bool{
+		"exact":        false,
+		"default":      false,
+		"none":         false,
+		"unconfigured": false,
+		"minor":        true,
+	}
+
+	for repo, want := range tests {
+		if got := h.allowsOtherTags(repo); got != want {
+			t.Errorf("allowsOtherTags(%q) = %t, want %t", repo, got, want)
+		}
+	}
+}
@@ -0,0 +1,61 @@
+package handler
+
+import (
+	"context"
+	"strings"
+
+	"github.com/Sirupsen/logrus"
+	dockertypes "github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/mount"
+)
+
+// reattachVolumes returns the host config for the replacement of the
+// container with the anonymous volumes of the container bound by name so
+// the replacement keeps their data
+func (h *Handler) reattachVolumes(ctx context.Context, e *engine, cfg dockertypes.ContainerJSON) (*container.HostConfig, error) {
+	// named volumes and volumes of other containers are already part of
+	// the configuration
+	configured := map[string]bool{}
+	for _, b := range cfg.HostConfig.Binds {
+		configured[strings.SplitN(b, ":", 2)[0]] = true
+	}
+	for _, m := range cfg.HostConfig.Mounts {
+		configured[m.Source] = true
+	}
+	for _, from := range cfg.HostConfig.VolumesFrom {
+		c, err := e.client.ContainerInspect(ctx, strings.SplitN(from, ":", 2)[0])
+		if err != nil {
+			return nil, err
+		}
+		for _, m := range c.Mounts {
+			configured[m.Name] = true
+		}
+	}
+
+	hostConfig := *cfg.HostConfig
+	hostConfig.Binds = append([]string{}, cfg.HostConfig.Binds...)
+	for _, m := range cfg.Mounts {
+		if m.Name == "" || configured[m.Name] {
+			continue
+		}
+		if m.Type != "" && m.Type != mount.TypeVolume {
+			continue
+		}
+
+		bind := m.Name + ":" + m.Destination
+		if !m.RW {
+			bind += ":ro"
+		}
+
+		logrus.WithFields(logrus.Fields{
+			"container": shortID(cfg.ID),
+			"volume":    shortID(m.Name),
+			"path":      m.Destination,
+		}).Debug("reattaching anonymous volume")
+
+		hostConfig.Binds = append(hostConfig.Binds, bind)
+	}
+
+	return &hostConfig, nil
+}
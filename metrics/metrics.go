@@ -0,0 +1,114 @@
+// Package metrics registers the Prometheus metrics of conduit with the
+// Prometheus client and exposes them over http.
+package metrics
+
+import (
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Handler returns the http handler exposing the registered metrics
+func Handler() http.Handler {
+	return prometheus.Handler()
+}
+
+// DefaultBuckets are histogram buckets in seconds suited to deploy and
+// pull durations
+var DefaultBuckets = []float64{1, 5, 10, 30, 60, 120, 300, 600}
+
+// NewCounter registers a counter without labels
+func NewCounter(name, help string) prometheus.Counter {
+	c := prometheus.NewCounter(prometheus.CounterOpts{
+		Name: name,
+		Help: help,
+	})
+	prometheus.MustRegister(c)
+
+	return c
+}
+
+// NewGauge registers a gauge without labels
+func NewGauge(name, help string) prometheus.Gauge {
+	g := prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: name,
+		Help: help,
+	})
+	prometheus.MustRegister(g)
+
+	return g
+}
+
+// CounterVec is a counter partitioned by label values
+type CounterVec struct {
+	vec *prometheus.CounterVec
+}
+
+// NewCounterVec registers a counter with the labels
+func NewCounterVec(name, help string, labels ...string) *CounterVec {
+	vec := prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: name,
+		Help: help,
+	}, labels)
+	prometheus.MustRegister(vec)
+
+	return &CounterVec{vec: vec}
+}
+
+// Inc increments the counter of the label values
+func (c *CounterVec) Inc(labels ...string) {
+	c.vec.WithLabelValues(labels...).Inc()
+}
+
+// GaugeVec is a gauge partitioned by label values
+type GaugeVec struct {
+	vec *prometheus.GaugeVec
+}
+
+// NewGaugeVec registers a gauge with the labels
+func NewGaugeVec(name, help string, labels ...string) *GaugeVec {
+	vec := prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: name,
+		Help: help,
+	}, labels)
+	prometheus.MustRegister(vec)
+
+	return &GaugeVec{vec: vec}
+}
+
+// Inc increments the gauge of the label values
+func (g *GaugeVec) Inc(labels ...string) {
+	g.vec.WithLabelValues(labels...).Inc()
+}
+
+// Dec decrements the gauge of the label values
+func (g *GaugeVec) Dec(labels ...string) {
+	g.vec.WithLabelValues(labels...).Dec()
+}
+
+// Set sets the gauge of the label values
+func (g *GaugeVec) Set(value float64, labels ...string) {
+	g.vec.WithLabelValues(labels...).Set(value)
+}
+
+// HistogramVec is a histogram partitioned by label values
+type HistogramVec struct {
+	vec *prometheus.HistogramVec
+}
+
+// NewHistogramVec registers a histogram with the buckets and labels
+func NewHistogramVec(name, help string, buckets []float64, labels ...string) *HistogramVec {
+	vec := prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    name,
+		Help:    help,
+		Buckets: buckets,
+	}, labels)
+	prometheus.MustRegister(vec)
+
+	return &HistogramVec{vec: vec}
+}
+
+// Observe adds the value to the histogram of the label values
+func (h *HistogramVec) Observe(value float64, labels ...string) {
+	h.vec.WithLabelValues(labels...).Observe(value)
+}
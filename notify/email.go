@@ -0,0 +1,48 @@
+package notify
+
+import (
+	"bytes"
+	"fmt"
+	"net/smtp"
+	"strings"
+
+	"github.com/ehazlett/conduit/types"
+)
+
+// Email sends events through an SMTP relay.  No authentication is used
+// so the relay is expected to be local or otherwise trusted.
+type Email struct {
+	addr string
+	from string
+	to   []string
+}
+
+func NewEmail(cfg types.NotifierConfig) (*Email, error) {
+	if cfg.SMTPAddr == "" {
+		return nil, fmt.Errorf("smtp_addr is required")
+	}
+	if cfg.From == "" || len(cfg.To) == 0 {
+		return nil, fmt.Errorf("from and to are required")
+	}
+
+	return &Email{
+		addr: cfg.SMTPAddr,
+		from: cfg.From,
+		to:   cfg.To,
+	}, nil
+}
+
+func (m *Email) Notify(e *Event) error {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "From: %s\r\n", m.from)
+	fmt.Fprintf(&buf, "To: %s\r\n", strings.Join(m.to, ", "))
+	fmt.Fprintf(&buf, "Subject: [conduit] %s\r\n", e.Title())
+	fmt.Fprintf(&buf, "Date: %s\r\n", e.Time.Format("Mon, 02 Jan 2006 15:04:05 -0700"))
+	fmt.Fprintf(&buf, "Content-Type: text/plain; charset=utf-8\r\n\r\n")
+	fmt.Fprintf(&buf, "%s\r\n", e.Description)
+	if e.URL != "" {
+		fmt.Fprintf(&buf, "\r\n%s\r\n", e.URL)
+	}
+
+	return smtp.SendMail(m.addr, nil, m.from, m.to, buf.Bytes())
+}
@@ -0,0 +1,206 @@
+package notify
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"text/template"
+
+	"github.com/ehazlett/conduit/types"
+)
+
+func postJSON(client *http.Client, url string, headers map[string]string, body io.Reader) error {
+	req, err := http.NewRequest("POST", url, body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		b, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("unexpected status %s: %s", resp.Status, bytes.TrimSpace(b))
+	}
+
+	return nil
+}
+
+func linkText(e *Event) string {
+	if e.Type == EventApproval {
+		return "Approve"
+	}
+
+	return "Details"
+}
+
+func encode(v interface{}) (io.Reader, error) {
+	var buf bytes.Buffer
+	if err := json.NewEncoder(&buf).Encode(v); err != nil {
+		return nil, err
+	}
+
+	return &buf, nil
+}
+
+// jsonValue encodes the value for use in a webhook template
+func jsonValue(v interface{}) (string, error) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return "", err
+	}
+
+	return string(b), nil
+}
+
+// Slack posts events to a Slack incoming webhook
+type Slack struct {
+	client *http.Client
+	url    string
+}
+
+func NewSlack(client *http.Client, cfg types.NotifierConfig) (*Slack, error) {
+	if cfg.URL == "" {
+		return nil, fmt.Errorf("url is required")
+	}
+
+	return &Slack{
+		client: client,
+		url:    cfg.URL,
+	}, nil
+}
+
+func (s *Slack) Notify(e *Event) error {
+	text := fmt.Sprintf("*%s*\n%s", e.Title(), e.Description)
+	if e.URL != "" {
+		text += fmt.Sprintf("\n<%s|%s>", e.URL, linkText(e))
+	}
+
+	body, err := encode(map[string]interface{}{
+		"text": text,
+	})
+	if err != nil {
+		return err
+	}
+
+	return postJSON(s.client, s.url, nil, body)
+}
+
+// Teams posts events to a Microsoft Teams incoming webhook
+type Teams struct {
+	client *http.Client
+	url    string
+}
+
+func NewTeams(client *http.Client, cfg types.NotifierConfig) (*Teams, error) {
+	if cfg.URL == "" {
+		return nil, fmt.Errorf("url is required")
+	}
+
+	return &Teams{
+		client: client,
+		url:    cfg.URL,
+	}, nil
+}
+
+func (t *Teams) Notify(e *Event) error {
+	color := "0076D7"
+	switch e.Type {
+	case EventSuccess:
+		color = "2EB886"
+	case EventFailure, EventRollback:
+		color = "D00000"
+	}
+
+	card := map[string]interface{}{
+		"@type":      "MessageCard",
+		"@context":   "http://schema.org/extensions",
+		"summary":    e.Title(),
+		"title":      e.Title(),
+		"text":       e.Description,
+		"themeColor": color,
+	}
+	if e.URL != "" {
+		card["potentialAction"] = []map[string]interface{}{
+			{
+				"@type": "OpenUri",
+				"name":  linkText(e),
+				"targets": []map[string]string{
+					{"os": "default", "uri": e.URL},
+				},
+			},
+		}
+	}
+
+	body, err := encode(card)
+	if err != nil {
+		return err
+	}
+
+	return postJSON(t.client, t.url, nil, body)
+}
+
+// Webhook posts events as JSON to an arbitrary URL.  When a template is
+// configured it is executed with the event to build the request body; the
+// json function encodes a value so that it can be embedded safely.
+type Webhook struct {
+	client   *http.Client
+	url      string
+	headers  map[string]string
+	template *template.Template
+}
+
+func NewWebhook(client *http.Client, cfg types.NotifierConfig) (*Webhook, error) {
+	if cfg.URL == "" {
+		return nil, fmt.Errorf("url is required")
+	}
+
+	w := &Webhook{
+		client:  client,
+		url:     cfg.URL,
+		headers: cfg.Headers,
+	}
+
+	if cfg.Template != "" {
+		t, err := template.New("webhook").Funcs(template.FuncMap{
+			"json": jsonValue,
+		}).Parse(cfg.Template)
+		if err != nil {
+			return nil, err
+		}
+		w.template = t
+	}
+
+	return w, nil
+}
+
+func (w *Webhook) Notify(e *Event) error {
+	if w.template == nil {
+		body, err := encode(e)
+		if err != nil {
+			return err
+		}
+
+		return postJSON(w.client, w.url, w.headers, body)
+	}
+
+	var buf bytes.Buffer
+	if err := w.template.Execute(&buf, e); err != nil {
+		return err
+	}
+	if !json.Valid(buf.Bytes()) {
+		return fmt.Errorf("webhook template did not produce valid JSON")
+	}
+
+	return postJSON(w.client, w.url, w.headers, &buf)
+}
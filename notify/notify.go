@@ -0,0 +1,174 @@
+// Package notify delivers deployment events to external services such
+// as Slack, Microsoft Teams, generic webhooks and email.
+package notify
+
+import (
+	"fmt"
+	"net/http"
+	"path"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/ehazlett/conduit/types"
+)
+
+const (
+	EventStart    = "start"
+	EventSuccess  = "success"
+	EventFailure  = "failure"
+	EventRollback = "rollback"
+	EventApproval = "approval"
+)
+
+// Event is a deployment event sent to the notifiers
+type Event struct {
+	Type        string    `json:"type"`
+	Repository  string    `json:"repository"`
+	Description string    `json:"description"`
+	Time        time.Time `json:"time"`
+	// URL is an optional link for the event such as an approval link
+	URL string `json:"url,omitempty"`
+}
+
+func NewEvent(eventType, repository, description string) *Event {
+	return &Event{
+		Type:        eventType,
+		Repository:  repository,
+		Description: description,
+		Time:        time.Now(),
+	}
+}
+
+// Title returns a short human readable summary of the event
+func (e *Event) Title() string {
+	switch e.Type {
+	case EventStart:
+		return fmt.Sprintf("Deploying %s", e.Repository)
+	case EventSuccess:
+		return fmt.Sprintf("Deployed %s", e.Repository)
+	case EventFailure:
+		return fmt.Sprintf("Deploy of %s failed", e.Repository)
+	case EventRollback:
+		return fmt.Sprintf("Deploy of %s rolled back", e.Repository)
+	case EventApproval:
+		return fmt.Sprintf("Deploy of %s needs approval", e.Repository)
+	}
+
+	return fmt.Sprintf("%s: %s", e.Repository, e.Type)
+}
+
+// Notifier sends an event to a single destination
+type Notifier interface {
+	Notify(e *Event) error
+}
+
+type route struct {
+	name         string
+	notifier     Notifier
+	repositories []string
+	events       []string
+}
+
+func (r *route) matches(e *Event) bool {
+	if len(r.events) > 0 && !contains(r.events, e.Type) {
+		return false
+	}
+
+	if len(r.repositories) == 0 {
+		return true
+	}
+
+	for _, p := range r.repositories {
+		if ok, _ := path.Match(p, e.Repository); ok {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Dispatcher routes events to the configured notifiers
+type Dispatcher struct {
+	routes []*route
+	wg     sync.WaitGroup
+}
+
+// NewDispatcher creates a dispatcher for the notifier configuration
+func NewDispatcher(configs []types.NotifierConfig) (*Dispatcher, error) {
+	client := &http.Client{
+		Timeout: time.Second * 10,
+	}
+
+	d := &Dispatcher{}
+	for i, cfg := range configs {
+		name := cfg.Name
+		if name == "" {
+			name = fmt.Sprintf("%s-%d", cfg.Type, i)
+		}
+
+		var n Notifier
+		var err error
+		switch cfg.Type {
+		case "slack":
+			n, err = NewSlack(client, cfg)
+		case "teams":
+			n, err = NewTeams(client, cfg)
+		case "webhook":
+			n, err = NewWebhook(client, cfg)
+		case "email":
+			n, err = NewEmail(cfg)
+		default:
+			err = fmt.Errorf("unknown notifier type %q", cfg.Type)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("notifier %s: %s", name, err)
+		}
+
+		d.routes = append(d.routes, &route{
+			name:         name,
+			notifier:     n,
+			repositories: cfg.Repositories,
+			events:       cfg.Events,
+		})
+	}
+
+	return d, nil
+}
+
+// Send delivers the event to all matching notifiers in the background
+func (d *Dispatcher) Send(e *Event) {
+	for _, r := range d.routes {
+		if !r.matches(e) {
+			continue
+		}
+
+		d.wg.Add(1)
+		go func(r *route) {
+			defer d.wg.Done()
+
+			if err := r.notifier.Notify(e); err != nil {
+				logrus.WithFields(logrus.Fields{
+					"notifier": r.name,
+					"event":    e.Type,
+					"repo":     e.Repository,
+				}).Errorf("error sending notification: %s", err)
+			}
+		}(r)
+	}
+}
+
+// Wait blocks until all pending notifications have been sent
+func (d *Dispatcher) Wait() {
+	d.wg.Wait()
+}
+
+func contains(values []string, s string) bool {
+	for _, v := range values {
+		if v == s {
+			return true
+		}
+	}
+
+	return false
+}
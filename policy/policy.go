@@ -0,0 +1,129 @@
+// Package policy decides whether a container running one tag of a
+// repository should be moved to a newly pushed tag.
+package policy
+
+import (
+	"fmt"
+	"regexp"
+
+	"github.com/ehazlett/conduit/types"
+)
+
+const (
+	// Exact only redeploys containers running the pushed tag
+	Exact = "exact"
+	// Semver moves containers to pushed tags within a version range
+	Semver = "semver"
+	// Major moves containers to newer pushed tags with the same major version
+	Major = "major"
+	// Minor moves containers to newer pushed tags with the same major and
+	// minor version
+	Minor = "minor"
+	// Regex moves containers between tags matching a pattern
+	Regex = "regex"
+)
+
+// Policy decides if a container running the current tag should be
+// deployed with the pushed tag
+type Policy interface {
+	Match(current, pushed string) bool
+}
+
+// New returns the policy for the configuration.  A nil configuration
+// returns the exact policy.
+func New(cfg *types.UpdatePolicy) (Policy, error) {
+	if cfg == nil {
+		return &exact{}, nil
+	}
+
+	switch cfg.Type {
+	case "", Exact:
+		return &exact{}, nil
+	case Semver:
+		r, err := ParseRange(cfg.Range)
+		if err != nil {
+			return nil, err
+		}
+		return &semverRange{r: r}, nil
+	case Major:
+		return &locked{minor: false}, nil
+	case Minor:
+		return &locked{minor: true}, nil
+	case Regex:
+		re, err := regexp.Compile(cfg.Pattern)
+		if err != nil {
+			return nil, err
+		}
+		return &pattern{re: re}, nil
+	}
+
+	return nil, fmt.Errorf("unknown policy type %q", cfg.Type)
+}
+
+type exact struct{}
+
+func (p *exact) Match(current, pushed string) bool {
+	return current == pushed
+}
+
+// semverRange moves containers to a pushed tag in the range that is not
+// older than the current tag
+type semverRange struct {
+	r *Range
+}
+
+func (p *semverRange) Match(current, pushed string) bool {
+	if current == pushed {
+		return true
+	}
+
+	c, err := ParseVersion(current)
+	if err != nil {
+		return false
+	}
+	v, err := ParseVersion(pushed)
+	if err != nil {
+		return false
+	}
+
+	return p.r.Match(c) && p.r.Match(v) && v.Compare(c) >= 0
+}
+
+// locked moves containers to a newer pushed tag with the same major (and
+// optionally minor) version
+type locked struct {
+	minor bool
+}
+
+func (p *locked) Match(current, pushed string) bool {
+	if current == pushed {
+		return true
+	}
+
+	c, err := ParseVersion(current)
+	if err != nil {
+		return false
+	}
+	v, err := ParseVersion(pushed)
+	if err != nil {
+		return false
+	}
+
+	if c.Major != v.Major || (p.minor && c.Minor != v.Minor) {
+		return false
+	}
+
+	return v.Compare(c) >= 0
+}
+
+type pattern struct {
+	re *regexp.Regexp
+}
+
+func (p *pattern) Match(current, pushed string) bool {
+	if current == pushed {
+		return true
+	}
+
+	return p.re.MatchString(current) && p.re.MatchString(pushed)
+}
@@ -0,0 +1,308 @@
+package policy
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Version is a semantic version parsed from an image tag
+type Version struct {
+	Major      int
+	Minor      int
+	Patch      int
+	Prerelease string
+}
+
+// ParseVersion parses a tag such as "1.4.7", "v2.0.0-rc1" or "1.4".
+// Missing minor and patch components are treated as zero.
+func ParseVersion(tag string) (*Version, error) {
+	s := strings.TrimPrefix(tag, "v")
+
+	v := &Version{}
+	if i := strings.IndexAny(s, "-+"); i >= 0 {
+		if s[i] == '-' {
+			v.Prerelease = s[i+1:]
+			if j := strings.Index(v.Prerelease, "+"); j >= 0 {
+				v.Prerelease = v.Prerelease[:j]
+			}
+		}
+		s = s[:i]
+	}
+
+	parts := strings.Split(s, ".")
+	if len(parts) == 0 || len(parts) > 3 {
+		return nil, fmt.Errorf("invalid version %q", tag)
+	}
+
+	nums := []*int{&v.Major, &v.Minor, &v.Patch}
+	for i, p := range parts {
+		n, err := strconv.Atoi(p)
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("invalid version %q", tag)
+		}
+		*nums[i] = n
+	}
+
+	return v, nil
+}
+
+// Compare returns -1, 0 or 1 if v is less than, equal to or greater than o
+func (v *Version) Compare(o *Version) int {
+	for _, d := range []int{v.Major - o.Major, v.Minor - o.Minor, v.Patch - o.Patch} {
+		if d < 0 {
+			return -1
+		}
+		if d > 0 {
+			return 1
+		}
+	}
+
+	// a pre-release has lower precedence than the release
+	switch {
+	case v.Prerelease == o.Prerelease:
+		return 0
+	case v.Prerelease == "":
+		return 1
+	case o.Prerelease == "":
+		return -1
+	}
+
+	return comparePrerelease(v.Prerelease, o.Prerelease)
+}
+
+// comparePrerelease compares pre-releases by their dot separated
+// identifiers.  Numeric identifiers are compared numerically and have
+// lower precedence than alphanumeric identifiers; a pre-release with fewer
+// identifiers has lower precedence when the others are equal.  Digit runs
+// in alphanumeric identifiers are also compared numerically so that the
+// common "rc10" tag sorts above "rc2".
+func comparePrerelease(a, b string) int {
+	as := strings.Split(a, ".")
+	bs := strings.Split(b, ".")
+	for i := 0; i < len(as) && i < len(bs); i++ {
+		an, aErr := strconv.Atoi(as[i])
+		bn, bErr := strconv.Atoi(bs[i])
+
+		var n int
+		switch {
+		case aErr == nil && bErr == nil:
+			n = compareInts(an, bn)
+		case aErr == nil:
+			n = -1
+		case bErr == nil:
+			n = 1
+		default:
+			n = compareIdentifiers(as[i], bs[i])
+		}
+		if n != 0 {
+			return n
+		}
+	}
+
+	return compareInts(len(as), len(bs))
+}
+
+// compareIdentifiers compares alphanumeric identifiers with their digit
+// runs compared numerically
+func compareIdentifiers(a, b string) int {
+	for a != "" && b != "" {
+		ad, bd := leadingDigits(a), leadingDigits(b)
+		if ad != "" && bd != "" {
+			an, _ := strconv.Atoi(ad)
+			bn, _ := strconv.Atoi(bd)
+			if n := compareInts(an, bn); n != 0 {
+				return n
+			}
+			a, b = a[len(ad):], b[len(bd):]
+			continue
+		}
+
+		if a[0] != b[0] {
+			if a[0] < b[0] {
+				return -1
+			}
+			return 1
+		}
+		a, b = a[1:], b[1:]
+	}
+
+	return compareInts(len(a), len(b))
+}
+
+func leadingDigits(s string) string {
+	i := 0
+	for i < len(s) && s[i] >= '0' && s[i] <= '9' {
+		i++
+	}
+
+	return s[:i]
+}
+
+func compareInts(a, b int) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+
+	return 0
+}
+
+func (v *Version) String() string {
+	s := fmt.Sprintf("%d.%d.%d", v.Major, v.Minor, v.Patch)
+	if v.Prerelease != "" {
+		s += "-" + v.Prerelease
+	}
+
+	return s
+}
+
+type comparator struct {
+	op      string
+	version *Version
+}
+
+func (c *comparator) match(v *Version) bool {
+	n := v.Compare(c.version)
+	switch c.op {
+	case "<":
+		return n < 0
+	case "<=":
+		return n <= 0
+	case ">":
+		return n > 0
+	case ">=":
+		return n >= 0
+	}
+
+	return n == 0
+}
+
+// Range is a set of version constraints such as ">=1.4.0 <2.0.0",
+// "1.4.x", "^1.4.2" or "~1.4".  Constraint sets can be combined with "||".
+type Range struct {
+	sets [][]*comparator
+}
+
+// ParseRange parses a version range
+func ParseRange(s string) (*Range, error) {
+	r := &Range{}
+	for _, set := range strings.Split(s, "||") {
+		comparators := []*comparator{}
+		for _, f := range strings.Fields(set) {
+			c, err := parseConstraint(f)
+			if err != nil {
+				return nil, err
+			}
+			comparators = append(comparators, c...)
+		}
+		if len(comparators) == 0 {
+			return nil, fmt.Errorf("invalid range %q", s)
+		}
+		r.sets = append(r.sets, comparators)
+	}
+
+	return r, nil
+}
+
+// Match reports whether the version satisfies the range.  A pre-release
+// only satisfies a constraint set that names a pre-release of the same
+// major, minor and patch version so that i.e. "^1.4.2" does not match
+// 2.0.0-beta and "1.4.x" does not match 1.5.0-rc1.
+func (r *Range) Match(v *Version) bool {
+	for _, set := range r.sets {
+		if v.Prerelease != "" && !allowsPrerelease(set, v) {
+			continue
+		}
+
+		ok := true
+		for _, c := range set {
+			if !c.match(v) {
+				ok = false
+				break
+			}
+		}
+		if ok {
+			return true
+		}
+	}
+
+	return false
+}
+
+func allowsPrerelease(set []*comparator, v *Version) bool {
+	for _, c := range set {
+		cv := c.version
+		if cv.Prerelease != "" && cv.Major == v.Major && cv.Minor == v.Minor && cv.Patch == v.Patch {
+			return true
+		}
+	}
+
+	return false
+}
+
+func parseConstraint(s string) ([]*comparator, error) {
+	for _, op := range []string{">=", "<=", ">", "<", "="} {
+		if strings.HasPrefix(s, op) {
+			v, err := ParseVersion(s[len(op):])
+			if err != nil {
+				return nil, err
+			}
+			return []*comparator{{op: op, version: v}}, nil
+		}
+	}
+
+	switch {
+	case strings.HasPrefix(s, "^"):
+		v, err := ParseVersion(s[1:])
+		if err != nil {
+			return nil, err
+		}
+		upper := &Version{Major: v.Major + 1}
+		if v.Major == 0 {
+			upper = &Version{Minor: v.Minor + 1}
+		}
+		return []*comparator{{op: ">=", version: v}, {op: "<", version: upper}}, nil
+	case strings.HasPrefix(s, "~"):
+		v, err := ParseVersion(s[1:])
+		if err != nil {
+			return nil, err
+		}
+		return []*comparator{{op: ">=", version: v}, {op: "<", version: &Version{Major: v.Major, Minor: v.Minor + 1}}}, nil
+	}
+
+	// wildcards: 1.4.x, 1.x, 1.4.*
+	parts := strings.Split(strings.TrimPrefix(s, "v"), ".")
+	fixed := []int{}
+	for _, p := range parts {
+		if p == "x" || p == "X" || p == "*" {
+			break
+		}
+		n, err := strconv.Atoi(p)
+		if err != nil {
+			return nil, fmt.Errorf("invalid constraint %q", s)
+		}
+		fixed = append(fixed, n)
+	}
+
+	switch len(fixed) {
+	case 0:
+		return []*comparator{{op: ">=", version: &Version{}}}, nil
+	case 1:
+		return []*comparator{
+			{op: ">=", version: &Version{Major: fixed[0]}},
+			{op: "<", version: &Version{Major: fixed[0] + 1}},
+		}, nil
+	case 2:
+		return []*comparator{
+			{op: ">=", version: &Version{Major: fixed[0], Minor: fixed[1]}},
+			{op: "<", version: &Version{Major: fixed[0], Minor: fixed[1] + 1}},
+		}, nil
+	case 3:
+		return []*comparator{{op: "=", version: &Version{Major: fixed[0], Minor: fixed[1], Patch: fixed[2]}}}, nil
+	}
+
+	return nil, fmt.Errorf("invalid constraint %q", s)
+}
@@ -0,0 +1,164 @@
+package policy
+
+import "testing"
+
+func TestParseVersion(t *testing.T) {
+	tests := []struct {
+		tag     string
+		want    Version
+		invalid bool
+	}{
+		{tag: "1.4.7", want: Version{Major: 1, Minor: 4, Patch: 7}},
+		{tag: "v2.0.0-rc1", want: Version{Major: 2, Prerelease: "rc1"}},
+		{tag: "1.4", want: Version{Major: 1, Minor: 4}},
+		{tag: "3", want: Version{Major: 3}},
+		{tag: "1.2.3-beta.2+build.5", want: Version{Major: 1, Minor: 2, Patch: 3, Prerelease: "beta.2"}},
+		{tag: "1.2.3+build.5", want: Version{Major: 1, Minor: 2, Patch: 3}},
+		{tag: "latest", invalid: true},
+		{tag: "1.2.3.4", invalid: true},
+		{tag: "1.-2.3", invalid: true},
+		{tag: "", invalid: true},
+	}
+
+	for _, tt := range tests {
+		v, err := ParseVersion(tt.tag)
+		if tt.invalid {
+			if err == nil {
+				t.Errorf("ParseVersion(%q) = %s, want error", tt.tag, v)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("ParseVersion(%q) error: %s", tt.tag, err)
+			continue
+		}
+		if *v != tt.want {
+			t.Errorf("ParseVersion(%q) = %+v, want %+v", tt.tag, *v, tt.want)
+		}
+	}
+}
+
+func TestVersionCompare(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want int
+	}{
+		{"1.4.7", "1.4.7", 0},
+		{"1.4.7", "1.4.8", -1},
+		{"1.5.0", "1.4.9", 1},
+		{"2.0.0", "1.99.99", 1},
+		{"1.0.0-rc1", "1.0.0", -1},
+		{"1.0.0", "1.0.0-rc1", 1},
+		{"1.0.0-alpha", "1.0.0-alpha.1", -1},
+		{"1.0.0-alpha.1", "1.0.0-alpha.beta", -1},
+		{"1.0.0-alpha.beta", "1.0.0-beta", -1},
+		{"1.0.0-beta.2", "1.0.0-beta.11", -1},
+		{"1.0.0-beta.11", "1.0.0-rc.1", -1},
+		{"1.0.0-rc.2", "1.0.0-rc.10", -1},
+		{"1.0.0-rc2", "1.0.0-rc10", -1},
+		{"1.0.0-rc10", "1.0.0-rc2", 1},
+		{"1.0.0-1", "1.0.0-alpha", -1},
+	}
+
+	for _, tt := range tests {
+		a, err := ParseVersion(tt.a)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := ParseVersion(tt.b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := a.Compare(b); got != tt.want {
+			t.Errorf("%s.Compare(%s) = %d, want %d", tt.a, tt.b, got, tt.want)
+		}
+	}
+}
+
+func TestParseRange(t *testing.T) {
+	valid := []string{
+		">=1.4.0 <2.0.0",
+		"1.4.x",
+		"1.x",
+		"*",
+		"^1.4.2",
+		"~1.4",
+		"=1.2.3",
+		"1.2.3",
+		"^1.0.0 || ^2.0.0",
+		">=2.0.0-rc1 <2.0.0",
+	}
+	for _, s := range valid {
+		if _, err := ParseRange(s); err != nil {
+			t.Errorf("ParseRange(%q) error: %s", s, err)
+		}
+	}
+
+	invalid := []string{
+		"",
+		"1.4 ||",
+		">=latest",
+		"^one",
+		"~1.a",
+		"1.y",
+	}
+	for _, s := range invalid {
+		if _, err := ParseRange(s); err == nil {
+			t.Errorf("ParseRange(%q) = nil error, want error", s)
+		}
+	}
+}
+
+func TestRangeMatch(t *testing.T) {
+	tests := []struct {
+		r       string
+		version string
+		want    bool
+	}{
+		{">=1.4.0 <2.0.0", "1.4.0", true},
+		{">=1.4.0 <2.0.0", "1.9.9", true},
+		{">=1.4.0 <2.0.0", "2.0.0", false},
+		{">=1.4.0 <2.0.0", "1.3.9", false},
+		{">=1.4.0 <2.0.0", "2.0.0-rc1", false},
+		{"1.4.x", "1.4.12", true},
+		{"1.4.x", "1.5.0", false},
+		{"1.4.x", "1.5.0-rc1", false},
+		{"1.x", "1.99.0", true},
+		{"1.x", "2.0.0", false},
+		{"*", "0.0.1", true},
+		{"^1.4.2", "1.4.2", true},
+		{"^1.4.2", "1.9.0", true},
+		{"^1.4.2", "1.4.1", false},
+		{"^1.4.2", "2.0.0", false},
+		{"^1.4.2", "2.0.0-beta", false},
+		{"^1.4.2", "1.5.0-rc1", false},
+		{"^0.3.1", "0.3.9", true},
+		{"^0.3.1", "0.4.0", false},
+		{"~1.4", "1.4.9", true},
+		{"~1.4", "1.5.0", false},
+		{"1.2.3", "1.2.3", true},
+		{"1.2.3", "1.2.4", false},
+		{"^1.0.0 || ^2.0.0", "2.3.0", true},
+		{"^1.0.0 || ^2.0.0", "3.0.0", false},
+		{">=2.0.0-rc1 <2.0.0", "2.0.0-rc2", true},
+		{">=2.0.0-rc1 <2.0.0", "2.0.0-rc10", true},
+		{">=2.0.0-rc1 <2.0.0", "2.0.0", false},
+		{"^2.0.0-rc1", "2.0.0-rc3", true},
+		{"^2.0.0-rc1", "2.0.1-rc1", false},
+		{"^2.0.0-rc1", "2.1.0", true},
+	}
+
+	for _, tt := range tests {
+		r, err := ParseRange(tt.r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		v, err := ParseVersion(tt.version)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := r.Match(v); got != tt.want {
+			t.Errorf("%q.Match(%s) = %t, want %t", tt.r, tt.version, got, tt.want)
+		}
+	}
+}
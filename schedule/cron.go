@@ -0,0 +1,119 @@
+package schedule
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Cron is a cron style time expression with the fields
+// "minute hour day-of-month month day-of-week".  A time matches when
+// every field matches.
+type Cron struct {
+	minute  []bool
+	hour    []bool
+	dom     []bool
+	month   []bool
+	dow     []bool
+	domStar bool
+	dowStar bool
+}
+
+// ParseCron parses a cron expression such as "* 9-17 * * 1-5"
+func ParseCron(expr string) (*Cron, error) {
+	fields := strings.Fields(expr)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("invalid cron expression %q: expected 5 fields", expr)
+	}
+
+	c := &Cron{
+		domStar: fields[2] == "*",
+		dowStar: fields[4] == "*",
+	}
+
+	var err error
+	if c.minute, err = parseField(fields[0], 0, 59); err != nil {
+		return nil, err
+	}
+	if c.hour, err = parseField(fields[1], 0, 23); err != nil {
+		return nil, err
+	}
+	if c.dom, err = parseField(fields[2], 1, 31); err != nil {
+		return nil, err
+	}
+	if c.month, err = parseField(fields[3], 1, 12); err != nil {
+		return nil, err
+	}
+	if c.dow, err = parseField(fields[4], 0, 7); err != nil {
+		return nil, err
+	}
+	// 7 is an alias for sunday
+	if c.dow[7] {
+		c.dow[0] = true
+	}
+
+	return c, nil
+}
+
+// Match reports whether the time matches the expression
+func (c *Cron) Match(t time.Time) bool {
+	if !c.minute[t.Minute()] || !c.hour[t.Hour()] || !c.month[int(t.Month())] {
+		return false
+	}
+
+	dom := c.dom[t.Day()]
+	dow := c.dow[int(t.Weekday())]
+
+	// as with cron, when both day fields are restricted either may match
+	if !c.domStar && !c.dowStar {
+		return dom || dow
+	}
+
+	return dom && dow
+}
+
+// parseField parses a comma separated list of values, ranges and steps
+// such as "*", "1-5", "*/15" or "0,30"
+func parseField(field string, min, max int) ([]bool, error) {
+	values := make([]bool, max+1)
+
+	for _, part := range strings.Split(field, ",") {
+		step := 1
+		if i := strings.Index(part, "/"); i >= 0 {
+			n, err := strconv.Atoi(part[i+1:])
+			if err != nil || n <= 0 {
+				return nil, fmt.Errorf("invalid step in %q", field)
+			}
+			step = n
+			part = part[:i]
+		}
+
+		lo, hi := min, max
+		if part != "*" {
+			bounds := strings.SplitN(part, "-", 2)
+			n, err := strconv.Atoi(bounds[0])
+			if err != nil {
+				return nil, fmt.Errorf("invalid value in %q", field)
+			}
+			lo, hi = n, n
+			if len(bounds) == 2 {
+				if hi, err = strconv.Atoi(bounds[1]); err != nil {
+					return nil, fmt.Errorf("invalid range in %q", field)
+				}
+			} else if step > 1 {
+				hi = max
+			}
+		}
+
+		if lo < min || hi > max || lo > hi {
+			return nil, fmt.Errorf("value out of range in %q", field)
+		}
+
+		for i := lo; i <= hi; i += step {
+			values[i] = true
+		}
+	}
+
+	return values, nil
+}
@@ -0,0 +1,126 @@
+package schedule
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseCronInvalid(t *testing.T) {
+	tests := []string{
+		"",
+		"* * * *",
+		"* * * * * *",
+		"60 * * * *",
+		"* 24 * * *",
+		"* * 0 * *",
+		"* * 32 * *",
+		"* * * 13 *",
+		"* * * * 8",
+		"5-1 * * * *",
+		"*/0 * * * *",
+		"*/x * * * *",
+		"a * * * *",
+		"1-b * * * *",
+	}
+
+	for _, expr := range tests {
+		if _, err := ParseCron(expr); err == nil {
+			t.Errorf("ParseCron(%q) = nil error, want error", expr)
+		}
+	}
+}
+
+func TestParseField(t *testing.T) {
+	tests := []struct {
+		field string
+		min   int
+		max   int
+		want  []int
+	}{
+		{"*", 0, 5, []int{0, 1, 2, 3, 4, 5}},
+		{"3", 0, 5, []int{3}},
+		{"1-3", 0, 5, []int{1, 2, 3}},
+		{"0,4", 0, 5, []int{0, 4}},
+		{"*/2", 0, 5, []int{0, 2, 4}},
+		{"1-5/2", 0, 5, []int{1, 3, 5}},
+		{"2/3", 0, 10, []int{2, 5, 8}},
+		{"1,3-4,*/5", 0, 10, []int{0, 1, 3, 4, 5, 10}},
+	}
+
+	for _, tt := range tests {
+		values, err := parseField(tt.field, tt.min, tt.max)
+		if err != nil {
+			t.Errorf("parseField(%q) error: %s", tt.field, err)
+			continue
+		}
+
+		got := []int{}
+		for i, ok := range values {
+			if ok {
+				got = append(got, i)
+			}
+		}
+		if !equalInts(got, tt.want) {
+			t.Errorf("parseField(%q) = %v, want %v", tt.field, got, tt.want)
+		}
+	}
+}
+
+func TestCronMatch(t *testing.T) {
+	// 2026-10-19 is a monday, 2026-10-18 a sunday
+	monday := time.Date(2026, 10, 19, 9, 30, 0, 0, time.UTC)
+	sunday := time.Date(2026, 10, 18, 9, 30, 0, 0, time.UTC)
+	fifteenth := time.Date(2026, 10, 15, 9, 30, 0, 0, time.UTC)
+
+	tests := []struct {
+		expr string
+		t    time.Time
+		want bool
+	}{
+		{"* * * * *", monday, true},
+		{"30 9 * * *", monday, true},
+		{"31 9 * * *", monday, false},
+		{"* 9-17 * * 1-5", monday, true},
+		{"* 9-17 * * 1-5", sunday, false},
+		{"* 10-17 * * 1-5", monday, false},
+		{"*/15 * * * *", monday, true},
+		{"*/20 * * * *", monday, false},
+		{"* * * 10 *", monday, true},
+		{"* * * 11 *", monday, false},
+		// 7 is an alias for sunday
+		{"* * * * 7", sunday, true},
+		{"* * * * 0", sunday, true},
+		// with one day field restricted only that field has to match
+		{"* * 15 * *", fifteenth, true},
+		{"* * 15 * *", monday, false},
+		{"* * * * 1", monday, true},
+		{"* * * * 1", fifteenth, false},
+		// with both day fields restricted either may match
+		{"* * 15 * 1", fifteenth, true},
+		{"* * 15 * 1", monday, true},
+		{"* * 15 * 1", sunday, false},
+	}
+
+	for _, tt := range tests {
+		c, err := ParseCron(tt.expr)
+		if err != nil {
+			t.Fatalf("ParseCron(%q) error: %s", tt.expr, err)
+		}
+		if got := c.Match(tt.t); got != tt.want {
+			t.Errorf("%q.Match(%s) = %t, want %t", tt.expr, tt.t.Format(time.RFC1123), got, tt.want)
+		}
+	}
+}
+
+func equalInts(a, b []int) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+
+	return true
+}
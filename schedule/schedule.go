@@ -0,0 +1,109 @@
+// Package schedule decides whether a repository may be deployed at a
+// given time based on deployment windows and freeze periods.
+package schedule
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/ehazlett/conduit/types"
+)
+
+const (
+	// OutsideQueue holds hooks outside a window until the window opens
+	OutsideQueue = "queue"
+	// OutsideReject rejects hooks outside a window
+	OutsideReject = "reject"
+)
+
+// Blocked is returned when a deploy is not allowed
+type Blocked struct {
+	Reason string
+	// Queue is set when the deploy should wait for the window to open
+	Queue bool
+}
+
+func (b *Blocked) Error() string {
+	return b.Reason
+}
+
+// Schedule holds the deployment windows and freeze periods of a repository
+type Schedule struct {
+	windows []*Cron
+	freezes []types.Freeze
+	loc     *time.Location
+	queue   bool
+}
+
+// New returns the schedule for the configuration.  A nil configuration
+// always allows deploys and queues hooks held by ad-hoc freezes.
+func New(cfg *types.ScheduleConfig) (*Schedule, error) {
+	s := &Schedule{
+		loc:   time.Local,
+		queue: true,
+	}
+	if cfg == nil {
+		return s, nil
+	}
+
+	if cfg.Timezone != "" {
+		loc, err := time.LoadLocation(cfg.Timezone)
+		if err != nil {
+			return nil, err
+		}
+		s.loc = loc
+	}
+
+	for _, w := range cfg.Windows {
+		c, err := ParseCron(w)
+		if err != nil {
+			return nil, err
+		}
+		s.windows = append(s.windows, c)
+	}
+
+	for _, f := range cfg.Freezes {
+		if !f.End.After(f.Start) {
+			return nil, fmt.Errorf("freeze %q ends before it starts", f.Reason)
+		}
+	}
+	s.freezes = cfg.Freezes
+
+	switch cfg.Outside {
+	case "", OutsideQueue:
+	case OutsideReject:
+		s.queue = false
+	default:
+		return nil, fmt.Errorf("invalid outside window action %q", cfg.Outside)
+	}
+
+	return s, nil
+}
+
+// Check returns a *Blocked error if a deploy is not allowed at the time.
+// Additional freezes such as ad-hoc freezes set through the API are
+// checked along with the configured ones.
+func (s *Schedule) Check(t time.Time, freezes []types.Freeze) error {
+	for _, f := range append(append([]types.Freeze{}, s.freezes...), freezes...) {
+		if !t.Before(f.Start) && t.Before(f.End) {
+			reason := fmt.Sprintf("deploys are frozen until %s", f.End.In(s.loc).Format(time.RFC3339))
+			if f.Reason != "" {
+				reason += ": " + f.Reason
+			}
+			return &Blocked{Reason: reason, Queue: s.queue}
+		}
+	}
+
+	if len(s.windows) == 0 {
+		return nil
+	}
+
+	lt := t.In(s.loc)
+	for _, w := range s.windows {
+		if w.Match(lt) {
+			return nil
+		}
+	}
+
+	return &Blocked{Reason: "outside of the deployment window", Queue: s.queue}
+}
@@ -0,0 +1,107 @@
+package schedule
+
+import (
+	"testing"
+	"time"
+
+	"github.com/ehazlett/conduit/types"
+)
+
+func TestCheck(t *testing.T) {
+	now := time.Date(2026, 10, 19, 9, 30, 0, 0, time.UTC)
+	freeze := types.Freeze{
+		Start:  now.Add(-time.Hour),
+		End:    now.Add(time.Hour),
+		Reason: "incident",
+	}
+
+	tests := []struct {
+		name    string
+		cfg     *types.ScheduleConfig
+		freezes []types.Freeze
+		blocked bool
+		queue   bool
+	}{
+		{name: "no schedule"},
+		{
+			name:    "ad-hoc freeze without a schedule",
+			freezes: []types.Freeze{freeze},
+			blocked: true,
+			queue:   true,
+		},
+		{
+			name: "inside window",
+			cfg:  &types.ScheduleConfig{Timezone: "UTC", Windows: []string{"* 9-17 * * 1-5"}},
+		},
+		{
+			name:    "outside window",
+			cfg:     &types.ScheduleConfig{Timezone: "UTC", Windows: []string{"* 10-17 * * 1-5"}},
+			blocked: true,
+			queue:   true,
+		},
+		{
+			name:    "outside window rejected",
+			cfg:     &types.ScheduleConfig{Timezone: "UTC", Windows: []string{"* 10-17 * * 1-5"}, Outside: OutsideReject},
+			blocked: true,
+		},
+		{
+			name:    "configured freeze",
+			cfg:     &types.ScheduleConfig{Freezes: []types.Freeze{freeze}},
+			blocked: true,
+			queue:   true,
+		},
+		{
+			name: "freeze ended",
+			cfg: &types.ScheduleConfig{Freezes: []types.Freeze{{
+				Start: now.Add(-2 * time.Hour),
+				End:   now,
+			}}},
+		},
+		{
+			name:    "ad-hoc freeze rejected",
+			cfg:     &types.ScheduleConfig{Outside: OutsideReject},
+			freezes: []types.Freeze{freeze},
+			blocked: true,
+		},
+	}
+
+	for _, tt := range tests {
+		s, err := New(tt.cfg)
+		if err != nil {
+			t.Fatalf("%s: %s", tt.name, err)
+		}
+
+		err = s.Check(now, tt.freezes)
+		if !tt.blocked {
+			if err != nil {
+				t.Errorf("%s: unexpected error: %s", tt.name, err)
+			}
+			continue
+		}
+
+		b, ok := err.(*Blocked)
+		if !ok {
+			t.Errorf("%s: error = %v, want *Blocked", tt.name, err)
+			continue
+		}
+		if b.Queue != tt.queue {
+			t.Errorf("%s: queue = %t, want %t", tt.name, b.Queue, tt.queue)
+		}
+	}
+}
+
+func TestNewInvalid(t *testing.T) {
+	now := time.Now()
+	tests := []*types.ScheduleConfig{
+		{Timezone: "Nowhere/Invalid"},
+		{Windows: []string{"* * *"}},
+		{Freezes: []types.Freeze{{Start: now, End: now}}},
+		{Outside: "drop"},
+	}
+
+	for _, cfg := range tests {
+		if _, err := New(cfg); err == nil {
+			t.Errorf("New(%+v) = nil error, want error", cfg)
+		}
+	}
+}
@@ -0,0 +1,12 @@
+package types
+
+import "time"
+
+// Approval is a deploy waiting to be approved
+type Approval struct {
+	ID         string    `json:"id"`
+	Repository string    `json:"repository"`
+	Tag        string    `json:"tag"`
+	Created    time.Time `json:"created"`
+	Expires    time.Time `json:"expires"`
+}
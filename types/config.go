@@ -0,0 +1,127 @@
+package types
+
+import "time"
+
+// Config is the conduit configuration file
+type Config struct {
+	Notifiers    []NotifierConfig             `json:"notifiers"`
+	Repositories map[string]*RepositoryConfig `json:"repositories"`
+	Engines      []EngineConfig               `json:"engines"`
+}
+
+// EngineConfig is a Docker engine conduit deploys to.  CertPath is a
+// directory with ca.pem, cert.pem and key.pem for TLS.
+type EngineConfig struct {
+	Name      string `json:"name"`
+	Group     string `json:"group"`
+	URL       string `json:"url"`
+	CertPath  string `json:"cert_path"`
+	TLSVerify bool   `json:"tls_verify"`
+}
+
+// RepositoryConfig holds the settings for a single repository
+type RepositoryConfig struct {
+	Policy    *UpdatePolicy    `json:"policy"`
+	Schedule  *ScheduleConfig  `json:"schedule"`
+	Approval  *ApprovalConfig  `json:"approval"`
+	Promotion *PromotionConfig `json:"promotion"`
+	Canary    *CanaryConfig    `json:"canary"`
+	// StopTimeout (i.e. "1m") and StopSignal override how the old
+	// container is stopped
+	StopTimeout string `json:"stop_timeout"`
+	StopSignal  string `json:"stop_signal"`
+	// KeepVolumes keeps the volumes of the old container when it is
+	// removed.  ReattachVolumes also attaches its anonymous volumes to
+	// the replacement.
+	KeepVolumes     bool `json:"keep_volumes"`
+	ReattachVolumes bool `json:"reattach_volumes"`
+	// KeepPrevious is the number of previous containers of each service
+	// kept stopped for rollback
+	KeepPrevious int `json:"keep_previous"`
+	// KeepImages is the number of unused images kept for rollback when
+	// images are cleaned up
+	KeepImages int `json:"keep_images"`
+	// DeployTimeout (i.e. "10m") is the deadline of a deploy after which
+	// it is aborted and rolled back
+	DeployTimeout string `json:"deploy_timeout"`
+}
+
+// CanaryConfig rotates a single canary container first and watches it for
+// Period (i.e. "5m") before the other containers are rotated.  The canary
+// is rolled back when it stops, becomes unhealthy or restarts more than
+// MaxRestarts times.  When MetricsURL is set the Prometheus text format
+// endpoint is scraped at the start and end of the period and the canary
+// is rolled back when the increase of ErrorMetric divided by the increase
+// of RequestMetric is above MaxErrorRate.
+type CanaryConfig struct {
+	Period        string  `json:"period"`
+	MaxRestarts   int     `json:"max_restarts"`
+	MetricsURL    string  `json:"metrics_url"`
+	ErrorMetric   string  `json:"error_metric"`
+	RequestMetric string  `json:"request_metric"`
+	MaxErrorRate  float64 `json:"max_error_rate"`
+}
+
+// PromotionConfig deploys a repository to engine groups in stages.  A
+// push deploys the first stage; each following stage is deployed once the
+// previous stage has stayed healthy for its soak period.
+type PromotionConfig struct {
+	Stages []PromotionStage `json:"stages"`
+}
+
+// PromotionStage is an engine group and how long it must stay healthy
+// (i.e. "30m") before the deploy is promoted to the next stage
+type PromotionStage struct {
+	Group string `json:"group"`
+	Soak  string `json:"soak"`
+}
+
+// ApprovalConfig requires deploys to be approved before they run.
+// Pending approvals expire after Expire (i.e. "4h", default 24h).
+type ApprovalConfig struct {
+	Required bool   `json:"required"`
+	Expire   string `json:"expire"`
+}
+
+// UpdatePolicy decides which pushed tags a container is moved to.  Type is
+// one of exact, semver, major, minor or regex.  Range is used by semver
+// and Pattern by regex.
+type UpdatePolicy struct {
+	Type    string `json:"type"`
+	Range   string `json:"range"`
+	Pattern string `json:"pattern"`
+}
+
+// NotifierConfig configures a notification sink.  Repositories and Events
+// restrict which events are sent; when empty all events are sent.
+type NotifierConfig struct {
+	Name         string            `json:"name"`
+	Type         string            `json:"type"`
+	Repositories []string          `json:"repositories"`
+	Events       []string          `json:"events"`
+	URL          string            `json:"url"`
+	Headers      map[string]string `json:"headers"`
+	Template     string            `json:"template"`
+	SMTPAddr     string            `json:"smtp_addr"`
+	From         string            `json:"from"`
+	To           []string          `json:"to"`
+}
+
+// ScheduleConfig restricts when a repository is deployed.  Windows are
+// cron style expressions ("minute hour day month weekday") for the times
+// deploys are allowed; when empty deploys are allowed at any time outside
+// of the freezes.  Outside is "queue" (default) to hold hooks until
+// deploys are allowed or "reject" to reject them.
+type ScheduleConfig struct {
+	Windows  []string `json:"windows"`
+	Freezes  []Freeze `json:"freezes"`
+	Outside  string   `json:"outside"`
+	Timezone string   `json:"timezone"`
+}
+
+// Freeze is a period during which deploys are not allowed
+type Freeze struct {
+	Start  time.Time `json:"start"`
+	End    time.Time `json:"end"`
+	Reason string    `json:"reason"`
+}
@@ -0,0 +1,17 @@
+package types
+
+import "time"
+
+// ContainerStatus is a container of a repository as seen by conduit
+type ContainerStatus struct {
+	ID      string    `json:"id"`
+	Engine  string    `json:"engine"`
+	Name    string    `json:"name"`
+	Image   string    `json:"image"`
+	ImageID string    `json:"image_id"`
+	State   string    `json:"state"`
+	Status  string    `json:"status"`
+	Created time.Time `json:"created"`
+	// Retained is set for previous containers kept for rollback
+	Retained bool `json:"retained"`
+}
@@ -0,0 +1,45 @@
+package types
+
+import "time"
+
+const (
+	DeploymentPending   = "pending"
+	DeploymentRunning   = "running"
+	DeploymentSoaking   = "soaking"
+	DeploymentSucceeded = "succeeded"
+	DeploymentFailed    = "failed"
+	DeploymentCancelled = "cancelled"
+	// DeploymentInterrupted is a deployment that was running or soaking
+	// when conduit stopped without persisting it
+	DeploymentInterrupted = "interrupted"
+)
+
+// Deployment is the history of a single deploy of a repository through
+// its promotion stages
+type Deployment struct {
+	ID         string `json:"id"`
+	Repository string `json:"repository"`
+	Tag        string `json:"tag"`
+	Status     string `json:"status"`
+	// Rollback is set when the deployment restored previous containers
+	Rollback bool              `json:"rollback,omitempty"`
+	Started  time.Time         `json:"started"`
+	Finished time.Time         `json:"finished,omitempty"`
+	Stages   []DeploymentStage `json:"stages"`
+}
+
+// DeploymentStage is the status of the deploy to a single engine group.
+// Group is empty when the repository is deployed to all engines.
+type DeploymentStage struct {
+	Group    string    `json:"group"`
+	Status   string    `json:"status"`
+	Started  time.Time `json:"started,omitempty"`
+	Finished time.Time `json:"finished,omitempty"`
+	// SoakUntil is when the stage is promoted if it stays healthy
+	SoakUntil time.Time `json:"soak_until,omitempty"`
+	// Restarts is the restart count of the deployed containers by id when
+	// the stage finished and is compared when the soak ends
+	Restarts   map[string]int `json:"restarts,omitempty"`
+	Containers int            `json:"containers"`
+	Error      string         `json:"error,omitempty"`
+}
@@ -12,6 +12,7 @@ type PushData struct {
 	Images   []string  `json:"images"`
 	PushedAt time.Time `json:"pushed_at"`
 	Pusher   string    `json:"pusher"`
+	Tag      string    `json:"tag"`
 }
 
 type Repository struct {
@@ -0,0 +1,60 @@
+package types
+
+import "time"
+
+// Manifest is the desired state of the services conduit reconciles the
+// engines to
+type Manifest struct {
+	Services []ServiceSpec `json:"services"`
+}
+
+// ServiceSpec is a service of the manifest.  Image is the repository and
+// the initial tag of the service; pushed tags that match Policy move the
+// service to the pushed tag once it is deployed.  The service runs
+// Replicas containers (default 1) on each engine of Group (all engines
+// when empty).  Ports use the docker run format (i.e. "8080:80/tcp"),
+// Volumes are binds (i.e. "data:/data") and the first of Networks is the
+// network the containers are created on.  Restart defaults to
+// "unless-stopped".
+type ServiceSpec struct {
+	Name     string            `json:"name"`
+	Image    string            `json:"image"`
+	Policy   *UpdatePolicy     `json:"policy"`
+	Replicas int               `json:"replicas"`
+	Group    string            `json:"group"`
+	Env      []string          `json:"env"`
+	Ports    []string          `json:"ports"`
+	Networks []string          `json:"networks"`
+	Volumes  []string          `json:"volumes"`
+	Labels   map[string]string `json:"labels"`
+	Restart  string            `json:"restart"`
+}
+
+const (
+	ReconcileCreate  = "create"
+	ReconcileReplace = "replace"
+	ReconcileRemove  = "remove"
+)
+
+// ReconcileReport lists the changes made by a reconcile or, for a dry run,
+// the changes that would be made
+type ReconcileReport struct {
+	DryRun  bool              `json:"dry_run"`
+	Time    time.Time         `json:"time"`
+	Actions []ReconcileAction `json:"actions"`
+	Errors  []string          `json:"errors,omitempty"`
+}
+
+// ReconcileAction is a single container created, replaced or removed to
+// match the manifest
+type ReconcileAction struct {
+	Engine  string `json:"engine"`
+	Service string `json:"service"`
+	Replica int    `json:"replica"`
+	Action  string `json:"action"`
+	// Container is the existing container that is replaced or removed
+	Container string `json:"container,omitempty"`
+	Image     string `json:"image,omitempty"`
+	Reason    string `json:"reason"`
+	Error     string `json:"error,omitempty"`
+}
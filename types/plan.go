@@ -0,0 +1,40 @@
+package types
+
+// DeployPlan describes the images that are pulled and the containers
+// that are rotated when a repository is deployed
+type DeployPlan struct {
+	Repository string            `json:"repository"`
+	Engines    []string          `json:"engines"`
+	DryRun     bool              `json:"dry_run"`
+	Images     []string          `json:"images"`
+	Containers []PlannedRotation `json:"containers"`
+	// Blocked is the reason the repository cannot be deployed now
+	Blocked string `json:"blocked,omitempty"`
+	// Preflight is the reason the preflight checks would fail
+	Preflight string `json:"preflight,omitempty"`
+	// SizeUnknown are the images the disk preflight could not get the
+	// size of from the registry and did not account for
+	SizeUnknown []string `json:"size_unknown,omitempty"`
+}
+
+// PlannedRotation is a single container that will be replaced
+type PlannedRotation struct {
+	ID     string `json:"id"`
+	Engine string `json:"engine"`
+	Name   string `json:"name"`
+	Image  string `json:"image"`
+	// Target is the image the container is replaced with
+	Target  string `json:"target"`
+	ImageID string `json:"image_id"`
+	// Digests are the registry digests of the current image
+	Digests  []string `json:"digests"`
+	Strategy string   `json:"strategy"`
+	// StopFirst is set when the container is removed before its
+	// replacement is started
+	StopFirst bool `json:"stop_first"`
+	// Canary is set for the container that is rotated and watched
+	// before the others
+	Canary bool `json:"canary"`
+	// Group is the container group the container is rotated with
+	Group string `json:"group,omitempty"`
+}
@@ -0,0 +1,22 @@
+package types
+
+import "time"
+
+// PreviousContainer is a stopped container kept for rollback
+type PreviousContainer struct {
+	ID     string `json:"id"`
+	Engine string `json:"engine"`
+	// Name is the name the container is restored with
+	Name         string    `json:"name"`
+	Image        string    `json:"image"`
+	DeploymentID string    `json:"deployment_id"`
+	Retired      time.Time `json:"retired"`
+}
+
+// RollbackPlan is the previous containers a rollback would restore.  It is
+// returned instead of running the rollback when conduit is in dry run.
+type RollbackPlan struct {
+	Repository string              `json:"repository"`
+	DryRun     bool                `json:"dry_run"`
+	Containers []PreviousContainer `json:"containers"`
+}
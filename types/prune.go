@@ -0,0 +1,24 @@
+package types
+
+import "time"
+
+// PruneReport lists the images removed by an image prune or, for a dry
+// run, the images that would be removed
+type PruneReport struct {
+	DryRun bool          `json:"dry_run"`
+	Time   time.Time     `json:"time"`
+	Images []PrunedImage `json:"images"`
+	// Reclaimed is the total size of the images in bytes
+	Reclaimed int64    `json:"reclaimed"`
+	Errors    []string `json:"errors,omitempty"`
+}
+
+// PrunedImage is an image of a repository that is no longer used
+type PrunedImage struct {
+	Engine     string    `json:"engine"`
+	Repository string    `json:"repository"`
+	ID         string    `json:"id"`
+	References []string  `json:"references"`
+	Created    time.Time `json:"created"`
+	Size       int64     `json:"size"`
+}